@@ -0,0 +1,533 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/geo"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/types"
+)
+
+// The groups fleet totals can be broken down by.
+const (
+	GroupDay  = "day"
+	GroupWeek = "week"
+	GroupZone = "zone"
+)
+
+// ZoneOther is the zone of trips that start outside of every zone.
+const ZoneOther = "other"
+
+const (
+	defaultPageLimit = 50
+	maxPageLimit     = 500
+)
+
+// Zone is a named area, a trip belongs to the first zone it starts in.
+type Zone struct {
+	Name    string  `json:"name"`
+	MinLat  float64 `json:"minLat"`
+	MinLong float64 `json:"minLong"`
+	MaxLat  float64 `json:"maxLat"`
+	MaxLong float64 `json:"maxLong"`
+}
+
+func (z Zone) contains(lat, long float64) bool {
+	return lat >= z.MinLat && lat <= z.MaxLat && long >= z.MinLong && long <= z.MaxLong
+}
+
+// LoadZones reads a JSON array of zones, an empty path has no zones.
+func LoadZones(path string) ([]Zone, error) {
+	if path == "" {
+		return nil, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var zones []Zone
+	if err := json.Unmarshal(b, &zones); err != nil {
+		return nil, fmt.Errorf("zones %s: %w", path, err)
+	}
+	return zones, nil
+}
+
+// Analytics answers questions about the whole fleet rather than a single
+// OBU. FleetAnalytics answers for the OBUs of its store, in a cluster
+// ClusterAnalytics for all of them. Amounts are priced like invoices, after
+// discounts and before tax, in the currency of the tariff.
+type Analytics interface {
+	// OBUTotals returns every OBU with what it drove in [from, to).
+	OBUTotals(from, to time.Time) ([]types.OBUTotal, error)
+	// GroupTotals sums the fleet per day, ISO week or zone of [from, to).
+	GroupTotals(group string, from, to time.Time) ([]types.GroupTotal, error)
+	ActiveVehicles(from, to time.Time) (*types.ActiveVehicles, error)
+}
+
+type FleetAnalytics struct {
+	store Storer
+	// nil prices every OBU as a car
+	vehicles VehicleLookup
+	tariff   *Tariff
+	rules    PricingRules
+	// nil doesn't tax
+	taxes *Taxes
+	zones []Zone
+}
+
+func NewFleetAnalytics(store Storer, vehicles VehicleLookup, tariff *Tariff, rules PricingRules, taxes *Taxes, zones []Zone) Analytics {
+	return &FleetAnalytics{
+		store:    store,
+		vehicles: vehicles,
+		tariff:   tariff,
+		rules:    rules,
+		taxes:    taxes,
+		zones:    zones,
+	}
+}
+
+// OBUTotals prices the period of every OBU as one invoice.
+func (a *FleetAnalytics) OBUTotals(from, to time.Time) ([]types.OBUTotal, error) {
+	totals, err := a.store.TotalsByOBU(from, to)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]int, len(totals))
+	for i, t := range totals {
+		ids[i] = t.OBUID
+	}
+	invoices := a.invoicer(ids, to)
+	for i := range totals {
+		t := &totals[i]
+		inv, _, err := invoices.calculatePeriod(t.OBUID, from, to)
+		if err != nil {
+			t.Error = err.Error()
+			continue
+		}
+		t.Amount = inv.TotalAmount
+		t.Tax = inv.TotalTax
+		t.AccountID = inv.AccountID
+		t.Plate = inv.Plate
+		t.VehicleClass = inv.VehicleClass
+	}
+	return totals, nil
+}
+
+// GroupTotals prices every day of an OBU like a daily invoice, a week is
+// the sum of its days.
+func (a *FleetAnalytics) GroupTotals(group string, from, to time.Time) ([]types.GroupTotal, error) {
+	var key func(time.Time) (string, time.Time, time.Time)
+	switch group {
+	case GroupDay:
+		key = dayGroup
+	case GroupWeek:
+		key = weekGroup
+	case GroupZone:
+		return a.zoneTotals(from, to)
+	default:
+		return nil, fmt.Errorf("unknown group %q", group)
+	}
+
+	days, err := a.store.TotalsByDay(from, to)
+	if err != nil {
+		return nil, err
+	}
+	trips, err := a.store.TripsBetween(from, to)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]int, len(days))
+	for i, d := range days {
+		ids[i] = d.OBUID
+	}
+	var (
+		groups   = newGroupTotals()
+		invoices = a.invoicer(ids, to)
+	)
+	for _, d := range days {
+		name, start, end := key(d.Day)
+		g := groups.get(name)
+		g.From, g.To = &start, &end
+		g.Distance += geo.FromKm(d.Distance)
+		groups.active(name, d.OBUID)
+		day := BillingPeriodDaily.start(d.Day)
+		inv, _, err := invoices.calculatePeriod(d.OBUID, day, day.AddDate(0, 0, 1))
+		if err != nil {
+			groups.unpriced(name, d.OBUID)
+			continue
+		}
+		g.Amount += inv.TotalAmount
+		g.Tax += inv.TotalTax
+	}
+	for _, trip := range trips {
+		name, start, end := key(time.Unix(0, trip.StartUnix))
+		g := groups.get(name)
+		g.From, g.To = &start, &end
+		g.Trips++
+	}
+	return groups.list(), nil
+}
+
+// zoneTotals only knows the distance OBUs drove on trips, road usage
+// outside of trips has no position to put it in a zone by. The period of
+// every OBU is priced as one invoice, a zone gets what the lines of the
+// trips started in it charge after discounts and their share of the taxes.
+func (a *FleetAnalytics) zoneTotals(from, to time.Time) ([]types.GroupTotal, error) {
+	trips, err := a.store.TripsBetween(from, to)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		ids    []int
+		byOBU  = make(map[int][]types.Trip)
+		groups = newGroupTotals()
+	)
+	for _, trip := range trips {
+		if _, ok := byOBU[trip.OBUID]; !ok {
+			ids = append(ids, trip.OBUID)
+		}
+		byOBU[trip.OBUID] = append(byOBU[trip.OBUID], trip)
+	}
+	invoices := a.invoicer(ids, to)
+	for _, id := range ids {
+		inv, lines, err := invoices.calculatePeriod(id, from, to)
+		if err != nil {
+			for _, trip := range byOBU[id] {
+				name := zoneOf(a.zones, trip.StartLat, trip.StartLong)
+				g := groups.get(name)
+				g.Distance += geo.FromKm(trip.Distance)
+				g.Trips++
+				groups.active(name, id)
+				groups.unpriced(name, id)
+			}
+			continue
+		}
+		for i, trip := range inv.Trips {
+			name := zoneOf(a.zones, trip.StartLat, trip.StartLong)
+			g := groups.get(name)
+			g.Distance += geo.FromKm(trip.Distance)
+			g.Trips++
+			g.Amount += lines[i].amount
+			g.Tax += lines[i].tax
+			groups.active(name, id)
+		}
+	}
+	return groups.list(), nil
+}
+
+// zoneOf is the first of zones containing the position, or ZoneOther.
+func zoneOf(zones []Zone, lat, long float64) string {
+	for _, z := range zones {
+		if z.contains(lat, long) {
+			return z.Name
+		}
+	}
+	return ZoneOther
+}
+
+func (a *FleetAnalytics) ActiveVehicles(from, to time.Time) (*types.ActiveVehicles, error) {
+	totals, err := a.store.TotalsByOBU(from, to)
+	if err != nil {
+		return nil, err
+	}
+	res := &types.ActiveVehicles{From: from, To: to, Known: len(totals)}
+	for _, t := range totals {
+		if t.Distance > 0 || t.Trips > 0 {
+			res.Active++
+		}
+	}
+	return res, nil
+}
+
+// BatchVehicleLookup looks up many OBUs with a single request.
+type BatchVehicleLookup interface {
+	LookupOBUs([]int, time.Time) (map[int]*types.OBURecord, error)
+}
+
+// invoicer prices invoices like the invoice service, in the currency of the
+// tariff, with the vehicle of every OBU as of the end of the period or now,
+// whichever comes first. A registry that can look up the OBUs of obuIDs in
+// one go gets a single request, others one per OBU.
+func (a *FleetAnalytics) invoicer(obuIDs []int, to time.Time) *InvoiceAggregator {
+	inv := &InvoiceAggregator{
+		store:            a.store,
+		tariff:           a.tariff,
+		rules:            a.rules,
+		taxes:            a.taxes,
+		inTariffCurrency: true,
+	}
+	if a.vehicles == nil {
+		return inv
+	}
+	at := to.Add(-time.Nanosecond)
+	if now := time.Now(); at.After(now) {
+		at = now
+	}
+	lookup := &prefetchedVehicles{
+		next: a.vehicles,
+		at:   at,
+		recs: make(map[int]*types.OBURecord),
+		errs: make(map[int]error),
+	}
+	if batch, ok := a.vehicles.(BatchVehicleLookup); ok && len(obuIDs) > 0 {
+		ids := slices.Compact(slices.Sorted(slices.Values(obuIDs)))
+		recs, err := batch.LookupOBUs(ids, at)
+		for _, id := range ids {
+			switch rec, ok := recs[id]; {
+			case err != nil:
+				lookup.errs[id] = err
+			case !ok:
+				lookup.errs[id] = fmt.Errorf("no active registration for obu %d", id)
+			default:
+				lookup.recs[id] = rec
+			}
+		}
+	}
+	inv.vehicles = lookup
+	return inv
+}
+
+// prefetchedVehicles looks every OBU up once, as of at whenever it is
+// asked.
+type prefetchedVehicles struct {
+	next VehicleLookup
+	at   time.Time
+	recs map[int]*types.OBURecord
+	errs map[int]error
+}
+
+func (p *prefetchedVehicles) LookupOBU(obuID int, _ time.Time) (*types.OBURecord, error) {
+	if rec, ok := p.recs[obuID]; ok {
+		return rec, nil
+	}
+	if err, ok := p.errs[obuID]; ok {
+		return nil, err
+	}
+	rec, err := p.next.LookupOBU(obuID, p.at)
+	if err != nil {
+		p.errs[obuID] = err
+		return nil, err
+	}
+	p.recs[obuID] = rec
+	return rec, nil
+}
+
+func dayGroup(t time.Time) (string, time.Time, time.Time) {
+	start := BillingPeriodDaily.start(t)
+	return start.Format(time.DateOnly), start, start.AddDate(0, 0, 1)
+}
+
+// weekGroup groups by ISO week, which starts on Monday.
+func weekGroup(t time.Time) (string, time.Time, time.Time) {
+	day := BillingPeriodDaily.start(t)
+	start := day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+	year, week := start.ISOWeek()
+	return fmt.Sprintf("%d-W%02d", year, week), start, start.AddDate(0, 0, 7)
+}
+
+// groupTotals collects group totals in the order the groups are first seen.
+type groupTotals struct {
+	order  []string
+	totals map[string]*types.GroupTotal
+	obus   map[string]map[int]struct{}
+	// the OBUs of a group that couldn't be priced
+	failed map[string]map[int]struct{}
+}
+
+func newGroupTotals() *groupTotals {
+	return &groupTotals{
+		totals: make(map[string]*types.GroupTotal),
+		obus:   make(map[string]map[int]struct{}),
+		failed: make(map[string]map[int]struct{}),
+	}
+}
+
+func (g *groupTotals) get(name string) *types.GroupTotal {
+	if g.totals[name] == nil {
+		g.totals[name] = &types.GroupTotal{Group: name}
+		g.obus[name] = make(map[int]struct{})
+		g.order = append(g.order, name)
+	}
+	return g.totals[name]
+}
+
+func (g *groupTotals) active(name string, obuID int) {
+	g.obus[name][obuID] = struct{}{}
+	g.totals[name].Active = len(g.obus[name])
+}
+
+func (g *groupTotals) unpriced(name string, obuID int) {
+	if g.failed[name] == nil {
+		g.failed[name] = make(map[int]struct{})
+	}
+	g.failed[name][obuID] = struct{}{}
+	g.totals[name].Unpriced = len(g.failed[name])
+}
+
+func (g *groupTotals) list() []types.GroupTotal {
+	sort.Strings(g.order)
+	res := make([]types.GroupTotal, 0, len(g.order))
+	for _, name := range g.order {
+		res = append(res, *g.totals[name])
+	}
+	return res
+}
+
+// obuSorts order OBU totals, everything but the OBU ID biggest first.
+var obuSorts = map[string]func(a, b types.OBUTotal) bool{
+	"obu":      func(a, b types.OBUTotal) bool { return a.OBUID < b.OBUID },
+	"distance": func(a, b types.OBUTotal) bool { return a.Distance > b.Distance },
+	"amount":   func(a, b types.OBUTotal) bool { return a.Amount > b.Amount },
+	"trips":    func(a, b types.OBUTotal) bool { return a.Trips > b.Trips },
+}
+
+// handleOBUTotals lists the OBUs with their totals in ?from= to ?to=, in
+// the order of ?sort=, by OBU ID by default.
+func handleOBUTotals(a Analytics) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sortBy := r.URL.Query().Get("sort")
+		if sortBy == "" {
+			sortBy = "obu"
+		}
+		serveOBUTotals(w, r, a, sortBy)
+	}
+}
+
+// handleTopOBUs lists the OBUs that drove the most, by distance or amount.
+func handleTopOBUs(a Analytics) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		by := r.PathValue("by")
+		if by != "distance" && by != "amount" {
+			WriteJSON(w, http.StatusBadRequest, map[string]string{"error": "top OBUs are by distance or amount"})
+			return
+		}
+		serveOBUTotals(w, r, a, by)
+	}
+}
+
+func serveOBUTotals(w http.ResponseWriter, r *http.Request, a Analytics, sortBy string) {
+	less, ok := obuSorts[sortBy]
+	if !ok {
+		WriteJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("cannot sort by %q", sortBy)})
+		return
+	}
+	from, to, err := parseRange(r)
+	if err != nil {
+		WriteJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	offset, limit, err := parsePage(r)
+	if err != nil {
+		WriteJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	totals, err := a.OBUTotals(from, to)
+	if err != nil {
+		WriteJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	sort.SliceStable(totals, func(i, j int) bool { return less(totals[i], totals[j]) })
+	WriteJSON(w, http.StatusOK, page(totals, offset, limit))
+}
+
+func handleGroupTotals(a Analytics) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		group := r.PathValue("group")
+		if group != GroupDay && group != GroupWeek && group != GroupZone {
+			WriteJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("unknown group %q", group)})
+			return
+		}
+		from, to, err := parseRange(r)
+		if err != nil {
+			WriteJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		offset, limit, err := parsePage(r)
+		if err != nil {
+			WriteJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		totals, err := a.GroupTotals(group, from, to)
+		if err != nil {
+			WriteJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		WriteJSON(w, http.StatusOK, page(totals, offset, limit))
+	}
+}
+
+func handleActiveVehicles(a Analytics) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		from, to, err := parseRange(r)
+		if err != nil {
+			WriteJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		res, err := a.ActiveVehicles(from, to)
+		if err != nil {
+			WriteJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		WriteJSON(w, http.StatusOK, res)
+	}
+}
+
+// parseRange reads the RFC3339 ?from= and ?to= of an analytics query, both
+// are optional: from defaults to the epoch and to to the end of today.
+func parseRange(r *http.Request) (time.Time, time.Time, error) {
+	var (
+		q    = r.URL.Query()
+		from = time.Unix(0, 0).UTC()
+		to   = BillingPeriodDaily.start(time.Now()).AddDate(0, 0, 1)
+		err  error
+	)
+	if s := q.Get("from"); s != "" {
+		if from, err = time.Parse(time.RFC3339, s); err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid from: %w", err)
+		}
+	}
+	if s := q.Get("to"); s != "" {
+		if to, err = time.Parse(time.RFC3339, s); err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid to: %w", err)
+		}
+	}
+	if !to.After(from) {
+		return time.Time{}, time.Time{}, fmt.Errorf("period ends before it starts")
+	}
+	return from, to, wholeDays(from, to)
+}
+
+// parsePage reads ?offset= and ?limit= of a listing.
+func parsePage(r *http.Request) (int, int, error) {
+	var (
+		q      = r.URL.Query()
+		offset = 0
+		limit  = defaultPageLimit
+		err    error
+	)
+	if s := q.Get("offset"); s != "" {
+		if offset, err = strconv.Atoi(s); err != nil || offset < 0 {
+			return 0, 0, fmt.Errorf("invalid offset %q", s)
+		}
+	}
+	if s := q.Get("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit < 1 || limit > maxPageLimit {
+			return 0, 0, fmt.Errorf("limit must be between 1 and %d", maxPageLimit)
+		}
+	}
+	return offset, limit, nil
+}
+
+func page[T any](items []T, offset, limit int) types.Page[T] {
+	p := types.Page[T]{Items: []T{}, Total: len(items), Offset: offset, Limit: limit}
+	if offset < len(items) {
+		p.Items = items[offset:min(offset+limit, len(items))]
+	}
+	return p
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/money"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/types"
+)
+
+// onlyOBULookup knows a single OBU, of an NL account billed in USD.
+type onlyOBULookup int
+
+func (l onlyOBULookup) LookupOBU(obuID int, _ time.Time) (*types.OBURecord, error) {
+	if obuID != int(l) {
+		return nil, errors.New("not registered")
+	}
+	return &types.OBURecord{
+		Vehicle: types.Vehicle{Plate: "AB-123-C", Class: types.VehicleClassCar},
+		Account: types.Account{ID: "acc", Country: "NL", Currency: "USD"},
+	}, nil
+}
+
+// TestAnalyticsPriceLikeInvoices checks that every view prices an OBU like
+// its invoice, in the tariff's currency, and reports the OBUs it can't.
+func TestAnalyticsPriceLikeInvoices(t *testing.T) {
+	var (
+		day    = time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC)
+		from   = day
+		to     = day.AddDate(0, 0, 1)
+		store  = NewMemoryStore()
+		tariff = &Tariff{Currency: "EUR", Prices: defaultPrices}
+		rules  = PricingRules{{Name: "Discount", Kind: types.PricingDiscount, Rate: 100_000}}
+	)
+	for _, id := range []int{1, 2} {
+		// 10 km in the center, 5 km elsewhere on a trip, 5 km off trips
+		store.Insert(types.Distance{OBUID: id, Value: 20, Unix: day.Add(8 * time.Hour).UnixNano()})
+		store.InsertTrip(types.Trip{OBUID: id, StartUnix: day.Add(8 * time.Hour).UnixNano(), StartLat: 52.35, StartLong: 4.9, Distance: 10})
+		store.InsertTrip(types.Trip{OBUID: id, StartUnix: day.Add(9 * time.Hour).UnixNano(), StartLat: 51.9, StartLong: 4.5, Distance: 5})
+	}
+	a := NewFleetAnalytics(store, onlyOBULookup(1), tariff, rules, testTaxes(), testZones)
+	agg := &InvoiceAggregator{store: store, vehicles: onlyOBULookup(1), tariff: tariff, rules: rules, taxes: testTaxes(), inTariffCurrency: true}
+	inv, err := agg.CalculatePeriodInvoice(1, from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	obus, err := a.OBUTotals(from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, o := range obus {
+		switch {
+		case o.OBUID == 1 && (o.Amount != inv.TotalAmount || o.Tax != inv.TotalTax || o.Error != ""):
+			t.Errorf("OBU 1 totals %s tax %s (%s), want %s tax %s", o.Amount, o.Tax, o.Error, inv.TotalAmount, inv.TotalTax)
+		case o.OBUID == 2 && o.Error == "":
+			t.Error("OBU 2 was priced without a registration")
+		}
+	}
+
+	days, err := a.GroupTotals(GroupDay, from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(days) != 1 || days[0].Amount != inv.TotalAmount || days[0].Tax != inv.TotalTax || days[0].Active != 2 || days[0].Unpriced != 1 {
+		t.Errorf("got day totals %+v, want amount %s tax %s of 1 of 2 OBUs", days, inv.TotalAmount, inv.TotalTax)
+	}
+
+	zones, err := a.GroupTotals(GroupZone, from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the lines are 31.50 and 15.75 on trips and 15.75 off them, less 6.30
+	// spread over them; the center pays its levy and 5.96 VAT, the other
+	// trip 0.14 road levy and 2.97 VAT
+	want := map[string][2]money.Amount{
+		"center":  {2835, 738},
+		ZoneOther: {1417, 311},
+	}
+	var amount, tax money.Amount
+	for _, z := range zones {
+		if w := want[z.Group]; z.Amount != w[0] || z.Tax != w[1] || z.Unpriced != 1 || z.Trips != 2 {
+			t.Errorf("zone %s: amount %s tax %s unpriced %d trips %d, want %s tax %s of 1 unpriced and 2 trips", z.Group, z.Amount, z.Tax, z.Unpriced, z.Trips, w[0], w[1])
+		}
+		amount += z.Amount
+		tax += z.Tax
+	}
+	// the line off trips charges 14.18 and 2.98 VAT
+	if amount+1418 != inv.TotalAmount || tax+298 != inv.TotalTax {
+		t.Errorf("zones and the line off trips charge %s tax %s, the invoice %s tax %s", amount+1418, tax+298, inv.TotalAmount, inv.TotalTax)
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/geo"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/types"
+)
+
+// BillingPeriod is how long a billing period runs, periods are aligned to
+// UTC days and months.
+type BillingPeriod string
+
+const (
+	BillingPeriodDaily   BillingPeriod = "daily"
+	BillingPeriodMonthly BillingPeriod = "monthly"
+)
+
+func ParseBillingPeriod(s string) (BillingPeriod, error) {
+	switch p := BillingPeriod(s); p {
+	case BillingPeriodDaily, BillingPeriodMonthly:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown billing period %q", s)
+}
+
+// start returns the start of the period t falls in.
+func (p BillingPeriod) start(t time.Time) time.Time {
+	t = t.UTC()
+	if p == BillingPeriodMonthly {
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+func (p BillingPeriod) add(start time.Time, n int) time.Time {
+	if p == BillingPeriodMonthly {
+		return start.AddDate(0, n, 0)
+	}
+	return start.AddDate(0, 0, n)
+}
+
+// BillingScheduler invoices every OBU that drove in a billing period once
+// the period closed, which is closeDelay after it ended. It keeps no state
+// of its own: every run works out from the invoice store what is missing
+// for the last lookback closed periods, so a rerun after a crash carries on
+// where the last run stopped. Distance that arrived for a period after it
+// was invoiced is billed with an adjustment to the invoice.
+//
+// With a registry it bills the OBUs that were active in a period, without
+// one every OBU in the store. In a cluster every node bills the OBUs it
+// owns.
+type BillingScheduler struct {
+	mu         sync.Mutex
+	period     BillingPeriod
+	closeDelay time.Duration
+	lookback   int
+	store      Storer
+	obus       ActiveOBULister
+	invoices   Invoicer
+}
+
+// ActiveOBULister tells which OBUs were registered to a vehicle at any time
+// in [from, to), in ascending order.
+type ActiveOBULister interface {
+	ActiveOBUs(from, to time.Time) ([]int, error)
+}
+
+// NewBillingScheduler bills the OBUs in store, or with a non nil obus only
+// those of them that were active in a period.
+func NewBillingScheduler(period BillingPeriod, closeDelay time.Duration, lookback int, store Storer, obus ActiveOBULister, invoices Invoicer) *BillingScheduler {
+	return &BillingScheduler{
+		period:     period,
+		closeDelay: closeDelay,
+		lookback:   lookback,
+		store:      store,
+		obus:       obus,
+		invoices:   invoices,
+	}
+}
+
+// Start runs once right away, to finish whatever a crash interrupted, and
+// then every time a period closes, until ctx is done. A run in progress is
+// finished first.
+func (s *BillingScheduler) Start(ctx context.Context) {
+	for {
+		s.Run(time.Now())
+		timer := time.NewTimer(time.Until(s.nextClose(time.Now())))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+func (s *BillingScheduler) nextClose(now time.Time) time.Time {
+	return s.period.add(s.period.start(now.Add(-s.closeDelay)), 1).Add(s.closeDelay)
+}
+
+// Run bills the closed periods as of now.
+func (s *BillingScheduler) Run(now time.Time) types.BillingRun {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	run := types.BillingRun{At: now, Invoices: []string{}}
+	held, err := s.store.IDs()
+	if err != nil {
+		logrus.Errorf("billing run error %s", err)
+		run.Failed++
+		return run
+	}
+	// the most recent period that closed
+	last := s.period.add(s.period.start(now.Add(-s.closeDelay)), -1)
+	for i := s.lookback - 1; i >= 0; i-- {
+		from := s.period.add(last, -i)
+		to := s.period.add(from, 1)
+		run.Periods++
+		ids, err := s.billable(held, from, to)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"from": from,
+				"to":   to,
+			}).Errorf("billing run error %s", err)
+			run.Failed++
+			continue
+		}
+		for _, id := range ids {
+			numbers, err := s.bill(id, from, to)
+			if err != nil {
+				logrus.WithFields(logrus.Fields{
+					"obuID": id,
+					"from":  from,
+					"to":    to,
+				}).Errorf("billing error %s", err)
+				run.Failed++
+			}
+			run.Invoices = append(run.Invoices, numbers...)
+		}
+	}
+	logrus.WithFields(logrus.Fields{
+		"periods":  run.Periods,
+		"invoices": len(run.Invoices),
+		"failed":   run.Failed,
+	}).Info("Billing Run")
+	return run
+}
+
+// billable returns the OBUs of held to bill for [from, to). Distance of an
+// OBU the registry doesn't know in the period is left unbilled, and logged.
+func (s *BillingScheduler) billable(held []int, from, to time.Time) ([]int, error) {
+	if s.obus == nil {
+		return held, nil
+	}
+	active, err := s.obus.ActiveOBUs(from, to)
+	if err != nil {
+		return nil, err
+	}
+	var ids []int
+	for _, id := range held {
+		if _, ok := slices.BinarySearch(active, id); ok {
+			ids = append(ids, id)
+			continue
+		}
+		if dist, err := s.store.GetRange(id, from, to); err == nil && geo.FromKm(dist) > 0 {
+			logrus.WithFields(logrus.Fields{
+				"obuID": id,
+				"from":  from,
+				"to":    to,
+			}).Warn("distance of an OBU that wasn't registered is not billed")
+		}
+	}
+	return ids, nil
+}
+
+// bill makes sure the OBU's distance in [from, to) is invoiced and the
+// invoices are issued. It returns the numbers of the invoices it issued.
+func (s *BillingScheduler) bill(obuID int, from, to time.Time) ([]string, error) {
+	dist, err := s.store.GetRange(obuID, from, to)
+	if err != nil {
+		return nil, err
+	}
+	docs, err := s.invoices.ListInvoices(obuID)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		orig   *types.InvoiceDocument
+		drafts []string
+		seen   bool
+	)
+	for i, doc := range docs {
+		if !doc.PeriodStart.Equal(from) || !doc.PeriodEnd.Equal(to) {
+			continue
+		}
+		// a voided period stays voided, it is up to whoever voided it to
+		// invoice it again
+		seen = true
+		if doc.Status == types.InvoiceStatusVoid {
+			continue
+		}
+		if doc.Adjusts == "" && orig == nil {
+			orig = &docs[i]
+		}
+		if doc.Status == types.InvoiceStatusDraft {
+			drafts = append(drafts, doc.Number)
+		}
+	}
+
+	switch {
+	case !seen && geo.FromKm(dist) > 0:
+		doc, err := s.invoices.CreateInvoice(obuID, from, to)
+		if err != nil {
+			return nil, err
+		}
+		drafts = append(drafts, doc.Number)
+	case orig != nil:
+		doc, err := s.invoices.CreateAdjustment(orig.Number)
+		switch {
+		case err == nil:
+			drafts = append(drafts, doc.Number)
+		case !errors.Is(err, ErrNothingToAdjust):
+			return nil, err
+		}
+	}
+
+	var issued []string
+	for _, number := range drafts {
+		if _, err := s.invoices.IssueInvoice(number); err != nil {
+			return issued, err
+		}
+		issued = append(issued, number)
+	}
+	return issued, nil
+}
+
+func handleBillingRun(s *BillingScheduler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		WriteJSON(w, http.StatusOK, s.Run(time.Now()))
+	}
+}
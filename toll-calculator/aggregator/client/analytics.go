@@ -0,0 +1,166 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/types"
+)
+
+// Query narrows an analytics query, zero values are left to the
+// aggregator's defaults.
+type Query struct {
+	From   time.Time
+	To     time.Time
+	Sort   string
+	Offset int
+	Limit  int
+}
+
+func (q Query) values() url.Values {
+	v := url.Values{}
+	if !q.From.IsZero() {
+		v.Set("from", q.From.Format(time.RFC3339))
+	}
+	if !q.To.IsZero() {
+		v.Set("to", q.To.Format(time.RFC3339))
+	}
+	if q.Sort != "" {
+		v.Set("sort", q.Sort)
+	}
+	if q.Offset > 0 {
+		v.Set("offset", strconv.Itoa(q.Offset))
+	}
+	if q.Limit > 0 {
+		v.Set("limit", strconv.Itoa(q.Limit))
+	}
+	return v
+}
+
+// OBUTotals lists the OBUs of the node with their totals.
+func (c *Client) OBUTotals(q Query) (*types.Page[types.OBUTotal], error) {
+	var page types.Page[types.OBUTotal]
+	if err := c.get("/analytics/obus", q.values(), &page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+// TopOBUs lists the OBUs that drove the most, by distance or amount.
+func (c *Client) TopOBUs(by string, q Query) (*types.Page[types.OBUTotal], error) {
+	var page types.Page[types.OBUTotal]
+	if err := c.get("/analytics/top/"+url.PathEscape(by), q.values(), &page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+// GroupTotals sums the fleet per day, week or zone.
+func (c *Client) GroupTotals(group string, q Query) (*types.Page[types.GroupTotal], error) {
+	var page types.Page[types.GroupTotal]
+	if err := c.get("/analytics/totals/"+url.PathEscape(group), q.values(), &page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+func (c *Client) ActiveVehicles(q Query) (*types.ActiveVehicles, error) {
+	var active types.ActiveVehicles
+	if err := c.get("/analytics/active", q.values(), &active); err != nil {
+		return nil, err
+	}
+	return &active, nil
+}
+
+// NodeOBUTotals lists every OBU the node owns with its totals, without
+// sorting or paginating them. Nodes only answer the other nodes of their
+// cluster, like the other Node queries.
+func (c *Client) NodeOBUTotals(from, to time.Time) ([]types.OBUTotal, error) {
+	var totals []types.OBUTotal
+	err := c.get("/admin/analytics/obus", Query{From: from, To: to}.values(), &totals)
+	return totals, err
+}
+
+// NodeGroupTotals sums the OBUs the node owns per day, week or zone.
+func (c *Client) NodeGroupTotals(group string, from, to time.Time) ([]types.GroupTotal, error) {
+	var totals []types.GroupTotal
+	err := c.get("/admin/analytics/totals/"+url.PathEscape(group), Query{From: from, To: to}.values(), &totals)
+	return totals, err
+}
+
+func (c *Client) NodeActiveVehicles(from, to time.Time) (*types.ActiveVehicles, error) {
+	var active types.ActiveVehicles
+	if err := c.get("/admin/analytics/active", Query{From: from, To: to}.values(), &active); err != nil {
+		return nil, err
+	}
+	return &active, nil
+}
+
+// Stream calls fn with every live update of the OBUs in obuIDs, or of the
+// account, until ctx is done or fn fails. Empty filters get every update.
+func (c *Client) Stream(ctx context.Context, obuIDs []int, account string, fn func(types.InvoiceUpdate) error) error {
+	q := url.Values{}
+	if len(obuIDs) > 0 {
+		ids := make([]string, len(obuIDs))
+		for i, id := range obuIDs {
+			ids[i] = strconv.Itoa(id)
+		}
+		q.Set("obu", strings.Join(ids, ","))
+	}
+	if account != "" {
+		q.Set("account", account)
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", c.Endpoint+"/stream?"+q.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+
+	var (
+		sc    = bufio.NewScanner(resp.Body)
+		event string
+		data  bytes.Buffer
+	)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		line := sc.Text()
+		switch {
+		case line == "":
+			// an event ends with a blank line
+			if event == "update" && data.Len() > 0 {
+				var u types.InvoiceUpdate
+				if err := json.Unmarshal(data.Bytes(), &u); err != nil {
+					return err
+				}
+				if err := fn(u); err != nil {
+					return err
+				}
+			}
+			event = ""
+			data.Reset()
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data.WriteString(strings.TrimSpace(strings.TrimPrefix(line, "data:")))
+		}
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	return sc.Err()
+}
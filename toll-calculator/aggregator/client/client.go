@@ -4,13 +4,33 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
+	"net/url"
+	"strconv"
+	"time"
 
 	"github.com/tunangoo/full-time-go-dev/toll-calculator/types"
 )
 
+// ForwardedHeader marks a request one aggregator node forwarded to another,
+// the receiving node handles it locally instead of routing it again.
+const ForwardedHeader = "X-Aggregator-Forwarded"
+
+// TokenHeader carries the token the nodes of a cluster share, a forwarded
+// request without it is routed like any other.
+const TokenHeader = "X-Aggregator-Token"
+
+type Aggregator interface {
+	AggregateInvoice(types.Distance) error
+	AggregateTrip(types.Trip) error
+	GetInvoice(int) (*types.Invoice, error)
+	GetPeriodInvoice(int, time.Time, time.Time) (*types.Invoice, error)
+}
+
 type Client struct {
 	Endpoint string
+	Header   http.Header
 }
 
 func NewClient(endpoint string) *Client {
@@ -20,22 +40,144 @@ func NewClient(endpoint string) *Client {
 }
 
 func (c *Client) AggregateInvoice(distance types.Distance) error {
-	b, err := json.Marshal(distance)
+	return c.post("/aggregate", distance, nil)
+}
+
+func (c *Client) AggregateTrip(trip types.Trip) error {
+	return c.post("/trip", trip, nil)
+}
+
+// Transfer hands the state of OBUs over to the node at Endpoint.
+func (c *Client) Transfer(states []types.OBUState) error {
+	return c.post("/admin/transfer", states, nil)
+}
+
+func (c *Client) GetInvoice(obuID int) (*types.Invoice, error) {
+	return c.getInvoice(url.Values{"obu": {strconv.Itoa(obuID)}})
+}
+
+func (c *Client) GetPeriodInvoice(obuID int, from, to time.Time) (*types.Invoice, error) {
+	return c.getInvoice(url.Values{
+		"obu":  {strconv.Itoa(obuID)},
+		"from": {from.Format(time.RFC3339)},
+		"to":   {to.Format(time.RFC3339)},
+	})
+}
+
+func (c *Client) getInvoice(q url.Values) (*types.Invoice, error) {
+	var inv types.Invoice
+	if err := c.get("/invoice", q, &inv); err != nil {
+		return nil, err
+	}
+	return &inv, nil
+}
+
+// Invoice returns the invoice document numbered number.
+func (c *Client) Invoice(number string) (*types.InvoiceDocument, error) {
+	var doc types.InvoiceDocument
+	if err := c.get("/invoices/"+url.PathEscape(number)+".json", nil, &doc); err != nil {
+		return nil, err
+	}
+	return &doc, nil
+}
+
+// CreateInvoice creates a draft invoice of the OBU's distance in [from, to).
+func (c *Client) CreateInvoice(obuID int, from, to time.Time) (*types.InvoiceDocument, error) {
+	req := struct {
+		OBUID int       `json:"obuID"`
+		From  time.Time `json:"from"`
+		To    time.Time `json:"to"`
+	}{obuID, from, to}
+	var doc types.InvoiceDocument
+	if err := c.post("/invoices", req, &doc); err != nil {
+		return nil, err
+	}
+	return &doc, nil
+}
+
+// ListInvoices returns the invoice documents of the OBU.
+func (c *Client) ListInvoices(obuID int) ([]types.InvoiceDocument, error) {
+	var docs []types.InvoiceDocument
+	err := c.get("/invoices", url.Values{"obu": {strconv.Itoa(obuID)}}, &docs)
+	return docs, err
+}
+
+// RunBilling runs the billing scheduler of the node right away.
+func (c *Client) RunBilling() (*types.BillingRun, error) {
+	var run types.BillingRun
+	if err := c.post("/admin/billing", nil, &run); err != nil {
+		return nil, err
+	}
+	return &run, nil
+}
+
+// get decodes the JSON the service answers GET path?q with into v.
+func (c *Client) get(path string, q url.Values, v any) error {
+	u := c.Endpoint + path
+	if len(q) > 0 {
+		u += "?" + q.Encode()
+	}
+	req, err := http.NewRequest("GET", u, nil)
 	if err != nil {
 		return err
 	}
-	req, err := http.NewRequest("POST", c.Endpoint, bytes.NewReader(b))
+	resp, err := c.do(req)
 	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
 
-	resp, err := http.DefaultClient.Do(req)
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// post posts in as JSON, and decodes the answer into out unless it is nil.
+func (c *Client) post(path string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest("POST", c.Endpoint+path, body)
 	if err != nil {
 		return err
 	}
 
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
 	if resp.StatusCode != http.StatusOK {
-		fmt.Printf("the service responded with non 200 status code %d", resp.StatusCode)
+		return responseError(resp)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// responseError tells what went wrong, with the error the service
+// answered if it did.
+func responseError(resp *http.Response) error {
+	var body struct {
+		Error string `json:"error"`
+	}
+	if json.NewDecoder(resp.Body).Decode(&body) == nil && body.Error != "" {
+		return fmt.Errorf("the service responded with non 200 status code %d: %s", resp.StatusCode, body.Error)
+	}
+	return fmt.Errorf("the service responded with non 200 status code %d", resp.StatusCode)
+}
+
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	for k, v := range c.Header {
+		req.Header[k] = v
 	}
-	return nil
+	return http.DefaultClient.Do(req)
 }
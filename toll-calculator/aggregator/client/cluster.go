@@ -0,0 +1,45 @@
+package client
+
+import (
+	"time"
+
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/aggregator/ring"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/types"
+)
+
+// ClusterClient routes every call to the aggregator node owning the OBU.
+type ClusterClient struct {
+	ring    *ring.Ring
+	clients map[string]*Client
+}
+
+func NewClusterClient(endpoints ...string) *ClusterClient {
+	clients := make(map[string]*Client, len(endpoints))
+	for _, endpoint := range endpoints {
+		clients[endpoint] = NewClient(endpoint)
+	}
+	return &ClusterClient{
+		ring:    ring.New(endpoints...),
+		clients: clients,
+	}
+}
+
+func (c *ClusterClient) AggregateInvoice(distance types.Distance) error {
+	return c.owner(distance.OBUID).AggregateInvoice(distance)
+}
+
+func (c *ClusterClient) AggregateTrip(trip types.Trip) error {
+	return c.owner(trip.OBUID).AggregateTrip(trip)
+}
+
+func (c *ClusterClient) GetInvoice(obuID int) (*types.Invoice, error) {
+	return c.owner(obuID).GetInvoice(obuID)
+}
+
+func (c *ClusterClient) GetPeriodInvoice(obuID int, from, to time.Time) (*types.Invoice, error) {
+	return c.owner(obuID).GetPeriodInvoice(obuID, from, to)
+}
+
+func (c *ClusterClient) owner(obuID int) *Client {
+	return c.clients[c.ring.Get(obuID)]
+}
@@ -0,0 +1,482 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/aggregator/client"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/aggregator/ring"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/types"
+)
+
+// Cluster tracks which aggregator node owns which OBU. self is the endpoint
+// the other nodes and the calculators reach this node on, token is shared
+// by all nodes to tell each other from clients.
+type Cluster struct {
+	self  string
+	token string
+	ring  *ring.Ring
+	store Storer
+	// serializes membership changes and transfers, so the OBUs one change
+	// takes aren't transferred by another
+	mu sync.Mutex
+}
+
+func NewCluster(self, token string, nodes []string, store Storer) *Cluster {
+	return &Cluster{
+		self:  self,
+		token: token,
+		ring:  ring.New(nodes...),
+		store: store,
+	}
+}
+
+func (c *Cluster) Owner(obuID int) string {
+	return c.ring.Get(obuID)
+}
+
+func (c *Cluster) Nodes() []string {
+	return c.ring.Nodes()
+}
+
+// SetNodes changes the members of the cluster and transfers the state of
+// every OBU this node no longer owns to its new owner. What can't be
+// transferred now is stashed and retried by Run.
+func (c *Cluster) SetNodes(nodes []string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ring.Set(nodes)
+
+	ids, err := c.store.IDs()
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if c.Owner(id) == c.self {
+			continue
+		}
+		state, err := c.store.Take(id)
+		if err != nil {
+			return err
+		}
+		// the ID stays with the state through every retry, the owner
+		// merges it once even if a transfer timed out after it arrived
+		state.TransferID = fmt.Sprintf("%s/%d/%d", c.self, id, time.Now().UnixNano())
+		if err := c.store.Stash(state); err != nil {
+			return err
+		}
+	}
+	c.transfer()
+	return nil
+}
+
+// Run retries the stashed transfers every interval until ctx is done.
+func (c *Cluster) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.mu.Lock()
+			c.transfer()
+			c.mu.Unlock()
+		}
+	}
+}
+
+// transfer hands every stashed state over to the node owning its OBU now,
+// the ring may have changed since it was stashed. It must be called with
+// c.mu held.
+func (c *Cluster) transfer() {
+	states, err := c.store.Unstash()
+	if err != nil {
+		logrus.Errorf("unstash error %s", err)
+		return
+	}
+	moving := make(map[string][]types.OBUState)
+	for _, state := range states {
+		moving[c.Owner(state.OBUID)] = append(moving[c.Owner(state.OBUID)], state)
+	}
+
+	for owner, states := range moving {
+		if owner == c.self {
+			for _, state := range states {
+				c.store.Merge(state)
+			}
+			continue
+		}
+		if err := c.forward(owner).Transfer(states); err != nil {
+			logrus.Errorf("transfer to %s error %s, retrying later", owner, err)
+			for _, state := range states {
+				c.store.Stash(state)
+			}
+			continue
+		}
+		logrus.WithFields(logrus.Fields{
+			"node": owner,
+			"obus": len(states),
+		}).Info("transferred OBU state")
+	}
+}
+
+func (c *Cluster) forward(node string) *client.Client {
+	return &client.Client{
+		Endpoint: node,
+		Header: http.Header{
+			client.ForwardedHeader: {c.self},
+			client.TokenHeader:     {c.token},
+		},
+	}
+}
+
+// RelayStreams relays the updates every other node prices to the
+// subscribers of s until ctx is done, so a subscriber of any node gets the
+// updates of the whole fleet. Only the updates of each node's own OBUs are
+// asked for, none goes round twice. A stream that fails is opened again
+// after retry, the updates it missed meanwhile are lost.
+func (c *Cluster) RelayStreams(ctx context.Context, s *Streamer, retry time.Duration) {
+	relays := make(map[string]context.CancelFunc)
+	defer func() {
+		for _, stop := range relays {
+			stop()
+		}
+	}()
+	ticker := time.NewTicker(retry)
+	defer ticker.Stop()
+	for {
+		nodes := c.Nodes()
+		for node, stop := range relays {
+			if !slices.Contains(nodes, node) {
+				stop()
+				delete(relays, node)
+			}
+		}
+		for _, node := range nodes {
+			if _, ok := relays[node]; ok || node == c.self {
+				continue
+			}
+			relayCtx, stop := context.WithCancel(ctx)
+			relays[node] = stop
+			go c.relay(relayCtx, node, s, retry)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// relay relays the updates node prices to s until ctx is done.
+func (c *Cluster) relay(ctx context.Context, node string, s *Streamer, retry time.Duration) {
+	for {
+		err := c.forward(node).Stream(ctx, nil, "", func(u types.InvoiceUpdate) error {
+			s.Relay(u)
+			return nil
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		logrus.Errorf("stream of %s ended %v, reopening in %s", node, err, retry)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retry):
+		}
+	}
+}
+
+// fromPeer tells whether r was sent by another node of the cluster.
+func (c *Cluster) fromPeer(r *http.Request) bool {
+	token := r.Header.Get(client.TokenHeader)
+	return c.token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(c.token)) == 1
+}
+
+// ShardMiddleware handles the OBUs this node owns and forwards everything
+// else to the owning node.
+type ShardMiddleware struct {
+	cluster *Cluster
+	next    Aggregator
+}
+
+func NewShardMiddleware(cluster *Cluster, next Aggregator) Aggregator {
+	return &ShardMiddleware{
+		cluster: cluster,
+		next:    next,
+	}
+}
+
+func (s *ShardMiddleware) AggregateDistance(distance types.Distance) error {
+	if owner := s.cluster.Owner(distance.OBUID); owner != s.cluster.self {
+		return s.cluster.forward(owner).AggregateInvoice(distance)
+	}
+	return s.next.AggregateDistance(distance)
+}
+
+func (s *ShardMiddleware) AggregateTrip(trip types.Trip) error {
+	if owner := s.cluster.Owner(trip.OBUID); owner != s.cluster.self {
+		return s.cluster.forward(owner).AggregateTrip(trip)
+	}
+	return s.next.AggregateTrip(trip)
+}
+
+func (s *ShardMiddleware) CalculateInvoice(obuID int) (*types.Invoice, error) {
+	if owner := s.cluster.Owner(obuID); owner != s.cluster.self {
+		return s.cluster.forward(owner).GetInvoice(obuID)
+	}
+	return s.next.CalculateInvoice(obuID)
+}
+
+func (s *ShardMiddleware) CalculatePeriodInvoice(obuID int, from, to time.Time) (*types.Invoice, error) {
+	if owner := s.cluster.Owner(obuID); owner != s.cluster.self {
+		return s.cluster.forward(owner).GetPeriodInvoice(obuID, from, to)
+	}
+	return s.next.CalculatePeriodInvoice(obuID, from, to)
+}
+
+// InvoiceShardMiddleware creates the invoices of the OBUs other nodes own
+// on their owner. The owner's billing run only knows the invoices in its
+// own store, an invoice created anywhere else would be billed again.
+type InvoiceShardMiddleware struct {
+	cluster *Cluster
+	next    Invoicer
+}
+
+func NewInvoiceShardMiddleware(cluster *Cluster, next Invoicer) Invoicer {
+	return &InvoiceShardMiddleware{
+		cluster: cluster,
+		next:    next,
+	}
+}
+
+func (s *InvoiceShardMiddleware) CreateInvoice(obuID int, from, to time.Time) (*types.InvoiceDocument, error) {
+	if owner := s.cluster.Owner(obuID); owner != s.cluster.self {
+		return s.cluster.forward(owner).CreateInvoice(obuID, from, to)
+	}
+	return s.next.CreateInvoice(obuID, from, to)
+}
+
+func (s *InvoiceShardMiddleware) CreateAdjustment(number string) (*types.InvoiceDocument, error) {
+	return s.next.CreateAdjustment(number)
+}
+
+func (s *InvoiceShardMiddleware) IssueInvoice(number string) (*types.InvoiceDocument, error) {
+	return s.next.IssueInvoice(number)
+}
+
+func (s *InvoiceShardMiddleware) PayInvoice(number string) (*types.InvoiceDocument, error) {
+	return s.next.PayInvoice(number)
+}
+
+func (s *InvoiceShardMiddleware) VoidInvoice(number string) (*types.InvoiceDocument, error) {
+	return s.next.VoidInvoice(number)
+}
+
+func (s *InvoiceShardMiddleware) GetInvoice(number string) (*types.InvoiceDocument, error) {
+	return s.next.GetInvoice(number)
+}
+
+func (s *InvoiceShardMiddleware) ListInvoices(obuID int) ([]types.InvoiceDocument, error) {
+	return s.next.ListInvoices(obuID)
+}
+
+func (s *InvoiceShardMiddleware) ListPeriodInvoices(from, to time.Time) ([]types.InvoiceDocument, error) {
+	return s.next.ListPeriodInvoices(from, to)
+}
+
+// ClusterAnalytics answers for the whole fleet: it asks every other node for
+// the totals of the OBUs it owns and merges them with those of local. It
+// fails if any node does, partial fleet totals would look complete.
+type ClusterAnalytics struct {
+	cluster *Cluster
+	local   Analytics
+}
+
+func NewClusterAnalytics(cluster *Cluster, local Analytics) Analytics {
+	return &ClusterAnalytics{
+		cluster: cluster,
+		local:   local,
+	}
+}
+
+func (a *ClusterAnalytics) OBUTotals(from, to time.Time) ([]types.OBUTotal, error) {
+	results, err := gather(a.cluster, func() ([]types.OBUTotal, error) {
+		return a.local.OBUTotals(from, to)
+	}, func(node *client.Client) ([]types.OBUTotal, error) {
+		return node.NodeOBUTotals(from, to)
+	})
+	if err != nil {
+		return nil, err
+	}
+	// every OBU is owned by a single node
+	return slices.Concat(results...), nil
+}
+
+func (a *ClusterAnalytics) GroupTotals(group string, from, to time.Time) ([]types.GroupTotal, error) {
+	results, err := gather(a.cluster, func() ([]types.GroupTotal, error) {
+		return a.local.GroupTotals(group, from, to)
+	}, func(node *client.Client) ([]types.GroupTotal, error) {
+		return node.NodeGroupTotals(group, from, to)
+	})
+	if err != nil {
+		return nil, err
+	}
+	merged := make(map[string]*types.GroupTotal)
+	for _, totals := range results {
+		for _, t := range totals {
+			m, ok := merged[t.Group]
+			if !ok {
+				merged[t.Group] = &t
+				continue
+			}
+			m.Distance += t.Distance
+			m.Amount += t.Amount
+			m.Tax += t.Tax
+			m.Trips += t.Trips
+			// the nodes count disjoint OBUs
+			m.Active += t.Active
+			m.Unpriced += t.Unpriced
+		}
+	}
+	res := make([]types.GroupTotal, 0, len(merged))
+	for _, name := range slices.Sorted(maps.Keys(merged)) {
+		res = append(res, *merged[name])
+	}
+	return res, nil
+}
+
+func (a *ClusterAnalytics) ActiveVehicles(from, to time.Time) (*types.ActiveVehicles, error) {
+	results, err := gather(a.cluster, func() (*types.ActiveVehicles, error) {
+		return a.local.ActiveVehicles(from, to)
+	}, func(node *client.Client) (*types.ActiveVehicles, error) {
+		return node.NodeActiveVehicles(from, to)
+	})
+	if err != nil {
+		return nil, err
+	}
+	res := &types.ActiveVehicles{From: from, To: to}
+	for _, r := range results {
+		res.Active += r.Active
+		res.Known += r.Known
+	}
+	return res, nil
+}
+
+// gather asks every node of the cluster at once, itself with local and the
+// others with remote.
+func gather[T any](c *Cluster, local func() (T, error), remote func(*client.Client) (T, error)) ([]T, error) {
+	var (
+		nodes   = c.Nodes()
+		results = make([]T, len(nodes))
+		errs    = make([]error, len(nodes))
+		wg      sync.WaitGroup
+	)
+	for i, node := range nodes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if node == c.self {
+				results[i], errs[i] = local()
+				return
+			}
+			if results[i], errs[i] = remote(c.forward(node)); errs[i] != nil {
+				errs[i] = fmt.Errorf("node %s: %w", node, errs[i])
+			}
+		}()
+	}
+	wg.Wait()
+	return results, errors.Join(errs...)
+}
+
+// handleNodeAnalytics answers the Node analytics queries of the other
+// nodes with what this node owns. The totals are neither sorted nor
+// paginated, the asking node does that once it merged them.
+func handleNodeAnalytics(cluster *Cluster, a Analytics) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !cluster.fromPeer(r) {
+			WriteJSON(w, http.StatusForbidden, map[string]string{"error": "only cluster nodes may ask"})
+			return
+		}
+		from, to, err := parseRange(r)
+		if err != nil {
+			WriteJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		var res any
+		switch group := r.PathValue("group"); {
+		case group != "":
+			res, err = a.GroupTotals(group, from, to)
+		case strings.HasSuffix(r.URL.Path, "/active"):
+			res, err = a.ActiveVehicles(from, to)
+		default:
+			res, err = a.OBUTotals(from, to)
+		}
+		if err != nil {
+			WriteJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		WriteJSON(w, http.StatusOK, res)
+	}
+}
+
+// handleNodes lists the nodes, and changes them for the holders of the
+// cluster token only: the OBUs that move are handed to the new nodes along
+// with the token.
+func handleNodes(cluster *Cluster) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			if !cluster.fromPeer(r) {
+				WriteJSON(w, http.StatusForbidden, map[string]string{"error": "only holders of the cluster token may change the nodes"})
+				return
+			}
+			var req struct {
+				Nodes []string `json:"nodes"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				WriteJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
+			if len(req.Nodes) == 0 {
+				WriteJSON(w, http.StatusBadRequest, map[string]string{"error": "missing nodes"})
+				return
+			}
+			if err := cluster.SetNodes(req.Nodes); err != nil {
+				WriteJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+				return
+			}
+		}
+		WriteJSON(w, http.StatusOK, map[string][]string{"nodes": cluster.Nodes()})
+	}
+}
+
+func handleTransfer(cluster *Cluster, store Storer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !cluster.fromPeer(r) {
+			WriteJSON(w, http.StatusForbidden, map[string]string{"error": "transfers are only accepted from cluster nodes"})
+			return
+		}
+		var states []types.OBUState
+		if err := json.NewDecoder(r.Body).Decode(&states); err != nil {
+			WriteJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		for _, state := range states {
+			if err := store.Merge(state); err != nil {
+				WriteJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+				return
+			}
+		}
+	}
+}
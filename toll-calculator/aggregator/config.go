@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/money"
+)
+
+// defaultInvoicePrefix only suits a single node.
+const defaultInvoicePrefix = "INV"
+
+type Config struct {
+	ListenAddr       string        `yaml:"listenAddr" usage:"the listen address of HTTP Server"`
+	Snapshot         string        `yaml:"snapshot" usage:"the file the store is snapshotted to"`
+	SnapshotInterval time.Duration `yaml:"snapshotInterval" usage:"how often the store is snapshotted"`
+	Self             string        `yaml:"self" usage:"the endpoint other cluster nodes reach this node on"`
+	Nodes            []string      `yaml:"nodes" usage:"comma separated endpoints of all aggregator nodes, empty runs a single node"`
+	ClusterToken     string        `yaml:"clusterToken" secret:"true" usage:"the token shared by all aggregator nodes, requests forwarded without it are routed again"`
+	TransferRetry    time.Duration `yaml:"transferRetry" usage:"how often transfers of OBU state to another node that failed are retried"`
+	Registry         string        `yaml:"registry" usage:"the vehicle registry endpoint"`
+	NoRegistry       bool          `yaml:"noRegistry" usage:"run without the vehicle registry, every OBU is invoiced at the car price"`
+	Zones            string        `yaml:"zones" usage:"JSON file of the zones fleet totals can be grouped by"`
+	Currency         string        `yaml:"currency" usage:"the ISO 4217 code of the currency of the tariff"`
+	Tariff           string        `yaml:"tariff" usage:"JSON file of the price per km of every vehicle class, empty has the default prices"`
+	ExchangeRates    string        `yaml:"exchangeRates" usage:"JSON file of the exchange rates of accounts billed in another currency than the tariff's"`
+	PricingRules     string        `yaml:"pricingRules" usage:"JSON file of the exemptions, discounts and monthly caps applied to invoices"`
+	Taxes            string        `yaml:"taxes" usage:"JSON file of the tax rules of every country and zone"`
+	Invoices         string        `yaml:"invoices" usage:"the log invoice documents are kept in"`
+	InvoicePrefix    string        `yaml:"invoicePrefix" usage:"the prefix of invoice numbers, unique per aggregator node"`
+	PaymentTerm      time.Duration `yaml:"paymentTerm" usage:"how long after issuing an invoice is due"`
+	Ledger           string        `yaml:"ledger" usage:"the log of the account ledger"`
+	LowBalanceHook   string        `yaml:"lowBalanceWebhook" usage:"the URL low prepaid balances are posted to, empty only logs them"`
+	BillingPeriod    string        `yaml:"billingPeriod" usage:"daily or monthly, empty turns the invoice run off"`
+	BillingDelay     time.Duration `yaml:"billingDelay" usage:"how long after a billing period ended it is invoiced"`
+	BillingLookback  int           `yaml:"billingLookback" usage:"how many closed billing periods late distance is still billed for"`
+	StreamBuffer     int           `yaml:"streamBuffer" usage:"how many updates a live stream subscriber may fall behind before it misses some"`
+	ShutdownTimeout  time.Duration `yaml:"shutdownTimeout" usage:"how long the service gets to stop on SIGTERM"`
+}
+
+func NewConfig() *Config {
+	return &Config{
+		ListenAddr:       ":3000",
+		Snapshot:         "./data/aggregator.snapshot.json",
+		SnapshotInterval: time.Minute,
+		Self:             "http://localhost:3000",
+		TransferRetry:    30 * time.Second,
+		Registry:         "http://localhost:3100",
+		Currency:         "EUR",
+		Invoices:         "./data/invoices.jsonl",
+		InvoicePrefix:    defaultInvoicePrefix,
+		PaymentTerm:      30 * 24 * time.Hour,
+		Ledger:           "./data/ledger.jsonl",
+		BillingPeriod:    string(BillingPeriodMonthly),
+		BillingDelay:     time.Hour,
+		BillingLookback:  3,
+		StreamBuffer:     64,
+		ShutdownTimeout:  10 * time.Second,
+	}
+}
+
+func (c *Config) Validate() error {
+	if c.ListenAddr == "" {
+		return errors.New("listenAddr is required")
+	}
+	if c.SnapshotInterval <= 0 {
+		return errors.New("snapshotInterval must be positive")
+	}
+	if len(c.Nodes) > 0 && !slices.Contains(c.Nodes, c.Self) {
+		return fmt.Errorf("nodes must contain self %s", c.Self)
+	}
+	if len(c.Nodes) > 0 && c.ClusterToken == "" {
+		return errors.New("clusterToken is required with nodes")
+	}
+	if len(c.Nodes) > 0 && c.TransferRetry <= 0 {
+		return errors.New("transferRetry must be positive")
+	}
+	if c.Registry == "" && !c.NoRegistry {
+		return errors.New("registry is required, set noRegistry to invoice every OBU at the car price")
+	}
+	if !money.ValidCurrency(c.Currency) {
+		return fmt.Errorf("currency %q is not an ISO 4217 code", c.Currency)
+	}
+	if c.InvoicePrefix == "" {
+		return errors.New("invoicePrefix is required")
+	}
+	// the default would number the invoices of every node the same
+	if len(c.Nodes) > 0 && c.InvoicePrefix == defaultInvoicePrefix {
+		return fmt.Errorf("invoicePrefix must be set per node with nodes, not the default %s", defaultInvoicePrefix)
+	}
+	if c.BillingPeriod != "" {
+		if _, err := ParseBillingPeriod(c.BillingPeriod); err != nil {
+			return err
+		}
+		if c.BillingLookback < 1 {
+			return errors.New("billingLookback must be at least 1")
+		}
+	}
+	if c.StreamBuffer < 1 {
+		return errors.New("streamBuffer must be at least 1")
+	}
+	if c.ShutdownTimeout <= 0 {
+		return errors.New("shutdownTimeout must be positive")
+	}
+	return nil
+}
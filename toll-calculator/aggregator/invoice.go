@@ -0,0 +1,521 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/aggregator/render"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/geo"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/types"
+)
+
+var (
+	ErrInvoiceNotFound = errors.New("invoice not found")
+	ErrNothingToAdjust = errors.New("nothing to adjust")
+)
+
+// Invoicer issues invoice documents and moves them through their lifecycle:
+// draft -> issued -> paid, with draft and issued invoices voidable.
+type Invoicer interface {
+	CreateInvoice(int, time.Time, time.Time) (*types.InvoiceDocument, error)
+	// CreateAdjustment bills the distance of the invoice's period that
+	// isn't on it or on its earlier adjustments yet. It returns
+	// ErrNothingToAdjust if there is none.
+	CreateAdjustment(string) (*types.InvoiceDocument, error)
+	IssueInvoice(string) (*types.InvoiceDocument, error)
+	PayInvoice(string) (*types.InvoiceDocument, error)
+	VoidInvoice(string) (*types.InvoiceDocument, error)
+	GetInvoice(string) (*types.InvoiceDocument, error)
+	ListInvoices(int) ([]types.InvoiceDocument, error)
+	// ListPeriodInvoices lists the invoices of every OBU for billing
+	// periods within [from, to).
+	ListPeriodInvoices(time.Time, time.Time) ([]types.InvoiceDocument, error)
+}
+
+type InvoiceStorer interface {
+	Put(types.InvoiceDocument) error
+	Get(string) (*types.InvoiceDocument, error)
+	List(int) ([]types.InvoiceDocument, error)
+	ListPeriod(time.Time, time.Time) ([]types.InvoiceDocument, error)
+	// Len is how many invoices were ever created, invoices are never deleted.
+	Len() (int, error)
+}
+
+type InvoiceService struct {
+	mu          sync.Mutex
+	agg         Aggregator
+	store       InvoiceStorer
+	prefix      string
+	paymentTerm time.Duration
+	// tax adjustments, the aggregator taxes everything else
+	taxes *Taxes
+}
+
+// NewInvoiceService numbers invoices <prefix>-00000001 onwards. Every
+// aggregator node of a cluster needs its own prefix.
+func NewInvoiceService(agg Aggregator, store InvoiceStorer, prefix string, paymentTerm time.Duration, taxes *Taxes) Invoicer {
+	return &InvoiceService{
+		agg:         agg,
+		store:       store,
+		prefix:      prefix,
+		paymentTerm: paymentTerm,
+		taxes:       taxes,
+	}
+}
+
+func (s *InvoiceService) CreateInvoice(obuID int, from, to time.Time) (*types.InvoiceDocument, error) {
+	inv, err := s.agg.CalculatePeriodInvoice(obuID, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	number, err := s.nextNumber()
+	if err != nil {
+		return nil, err
+	}
+	doc := types.InvoiceDocument{
+		Number:        number,
+		Status:        types.InvoiceStatusDraft,
+		OBUID:         obuID,
+		AccountID:     inv.AccountID,
+		Plate:         inv.Plate,
+		VehicleClass:  inv.VehicleClass,
+		PeriodStart:   from,
+		PeriodEnd:     to,
+		CreatedAt:     time.Now(),
+		Currency:      inv.Currency,
+		ExchangeRate:  inv.ExchangeRate,
+		Lines:         invoiceLines(inv),
+		TotalDistance: inv.TotalDistance,
+		TotalAmount:   inv.TotalAmount,
+		TotalTax:      inv.TotalTax,
+		TotalGross:    inv.TotalGross,
+	}
+	if err := s.store.Put(doc); err != nil {
+		return nil, err
+	}
+	return &doc, nil
+}
+
+func (s *InvoiceService) CreateAdjustment(number string) (*types.InvoiceDocument, error) {
+	orig, err := s.store.Get(number)
+	if err != nil {
+		return nil, err
+	}
+	if orig.Adjusts != "" {
+		return nil, fmt.Errorf("%s is an adjustment itself, adjust %s", number, orig.Adjusts)
+	}
+	inv, err := s.agg.CalculatePeriodInvoice(orig.OBUID, orig.PeriodStart, orig.PeriodEnd)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	docs, err := s.store.List(orig.OBUID)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		billed     geo.Distance
+		billedDocs []types.InvoiceDocument
+	)
+	for _, doc := range docs {
+		if doc.Status != types.InvoiceStatusVoid && (doc.Number == number || doc.Adjusts == number) {
+			billed += doc.TotalDistance
+			billedDocs = append(billedDocs, doc)
+		}
+	}
+	late := inv.TotalDistance - billed
+	if late <= 0 {
+		return nil, ErrNothingToAdjust
+	}
+
+	// late distance has no trip to tell where it was driven
+	charge := inv.UnitPrice.Charge(late)
+	discounts := lateDiscounts(inv.Discounts, billedDocs)
+	amount := charge + totalDiscount(discounts)
+	lines := []taxable{{amount: charge}}
+	lines = append(lines, spread(totalDiscount(discounts), lines)...)
+	taxes := s.taxes.apply(inv.Country, lines)
+
+	number, err = s.nextNumber()
+	if err != nil {
+		return nil, err
+	}
+	doc := types.InvoiceDocument{
+		Number:       number,
+		Status:       types.InvoiceStatusDraft,
+		Adjusts:      orig.Number,
+		OBUID:        orig.OBUID,
+		AccountID:    inv.AccountID,
+		Plate:        inv.Plate,
+		VehicleClass: inv.VehicleClass,
+		PeriodStart:  orig.PeriodStart,
+		PeriodEnd:    orig.PeriodEnd,
+		CreatedAt:    time.Now(),
+		Currency:     inv.Currency,
+		ExchangeRate: inv.ExchangeRate,
+		Lines: []types.InvoiceLine{{
+			Description: fmt.Sprintf("Road usage reported after invoice %s", orig.Number),
+			Distance:    late,
+			UnitPrice:   inv.UnitPrice,
+			Amount:      charge,
+		}},
+		TotalDistance: late,
+		TotalAmount:   amount,
+		TotalTax:      totalTax(taxes),
+		TotalGross:    amount + totalTax(taxes),
+	}
+	doc.Lines = append(doc.Lines, discountLines(discounts)...)
+	doc.Lines = append(doc.Lines, taxLines(taxes)...)
+	if err := s.store.Put(doc); err != nil {
+		return nil, err
+	}
+	return &doc, nil
+}
+
+// lateDiscounts is how the discounts of a period changed since it was
+// billed on docs: the pricing rules see the whole period again, and
+// adjustments get what they take off now that they didn't before.
+func lateDiscounts(now []types.InvoiceDiscount, docs []types.InvoiceDocument) []types.InvoiceDiscount {
+	var (
+		billed = make(map[string]*types.InvoiceDiscount)
+		names  []string
+	)
+	for _, doc := range docs {
+		for _, line := range doc.Lines {
+			if d := line.Discount; d != nil {
+				if billed[d.Name] == nil {
+					billed[d.Name] = &types.InvoiceDiscount{PricingRule: d.PricingRule}
+					names = append(names, d.Name)
+				}
+				billed[d.Name].Amount += line.Amount
+			}
+		}
+	}
+	var discounts []types.InvoiceDiscount
+	for _, d := range now {
+		if b := billed[d.Name]; b != nil {
+			d.Amount -= b.Amount
+			delete(billed, d.Name)
+		}
+		if d.Amount != 0 {
+			discounts = append(discounts, d)
+		}
+	}
+	// rules that no longer apply give back what they took off
+	for _, name := range names {
+		if b := billed[name]; b != nil && b.Amount != 0 {
+			discounts = append(discounts, types.InvoiceDiscount{PricingRule: b.PricingRule, Amount: -b.Amount})
+		}
+	}
+	return discounts
+}
+
+// nextNumber must be called with s.mu held.
+func (s *InvoiceService) nextNumber() (string, error) {
+	n, err := s.store.Len()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s-%08d", s.prefix, n+1), nil
+}
+
+// invoiceLines lists every trip on its own line. Distance that wasn't part
+// of any trip goes on a line after them, then the discounts and the taxes,
+// so the lines add up to the totals.
+func invoiceLines(inv *types.Invoice) []types.InvoiceLine {
+	var (
+		lines    []types.InvoiceLine
+		tripDist geo.Distance
+	)
+	for _, t := range inv.Trips {
+		trip := t.Trip
+		lines = append(lines, types.InvoiceLine{
+			Description: fmt.Sprintf("Trip %s - %s",
+				time.Unix(0, trip.StartUnix).UTC().Format(time.RFC3339),
+				time.Unix(0, trip.EndUnix).UTC().Format(time.RFC3339)),
+			Distance:  geo.FromKm(trip.Distance),
+			UnitPrice: inv.UnitPrice,
+			Amount:    t.Amount,
+			Trip:      &trip,
+		})
+		tripDist += geo.FromKm(trip.Distance)
+	}
+	if rest := inv.TotalDistance - tripDist; rest > 0 || len(lines) == 0 {
+		lines = append(lines, types.InvoiceLine{
+			Description: "Road usage outside of trips",
+			Distance:    rest,
+			UnitPrice:   inv.UnitPrice,
+			Amount:      inv.UnitPrice.Charge(rest),
+		})
+	}
+	lines = append(lines, discountLines(inv.Discounts)...)
+	return append(lines, taxLines(inv.Taxes)...)
+}
+
+func discountLines(discounts []types.InvoiceDiscount) []types.InvoiceLine {
+	var lines []types.InvoiceLine
+	for _, d := range discounts {
+		lines = append(lines, types.InvoiceLine{
+			Description: d.Name,
+			Amount:      d.Amount,
+			Discount:    &d,
+		})
+	}
+	return lines
+}
+
+func taxLines(taxes []types.InvoiceTax) []types.InvoiceLine {
+	var lines []types.InvoiceLine
+	for _, tax := range taxes {
+		lines = append(lines, types.InvoiceLine{
+			Description: fmt.Sprintf("%s %s%% of %s", tax.Name, tax.Rate.Percent(), tax.Base),
+			Amount:      tax.Amount,
+			Tax:         &tax,
+		})
+	}
+	return lines
+}
+
+func (s *InvoiceService) IssueInvoice(number string) (*types.InvoiceDocument, error) {
+	return s.transition(number, func(doc *types.InvoiceDocument, now time.Time) error {
+		if doc.Status != types.InvoiceStatusDraft {
+			return fmt.Errorf("can't issue a %s invoice", doc.Status)
+		}
+		due := now.Add(s.paymentTerm)
+		doc.Status = types.InvoiceStatusIssued
+		doc.IssuedAt = &now
+		doc.DueAt = &due
+		return nil
+	})
+}
+
+func (s *InvoiceService) PayInvoice(number string) (*types.InvoiceDocument, error) {
+	return s.transition(number, func(doc *types.InvoiceDocument, now time.Time) error {
+		if doc.Status != types.InvoiceStatusIssued {
+			return fmt.Errorf("can't pay a %s invoice", doc.Status)
+		}
+		doc.Status = types.InvoiceStatusPaid
+		doc.PaidAt = &now
+		return nil
+	})
+}
+
+func (s *InvoiceService) VoidInvoice(number string) (*types.InvoiceDocument, error) {
+	return s.transition(number, func(doc *types.InvoiceDocument, now time.Time) error {
+		if doc.Status != types.InvoiceStatusDraft && doc.Status != types.InvoiceStatusIssued {
+			return fmt.Errorf("can't void a %s invoice", doc.Status)
+		}
+		doc.Status = types.InvoiceStatusVoid
+		doc.VoidedAt = &now
+		return nil
+	})
+}
+
+func (s *InvoiceService) transition(number string, fn func(*types.InvoiceDocument, time.Time) error) (*types.InvoiceDocument, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	doc, err := s.store.Get(number)
+	if err != nil {
+		return nil, err
+	}
+	if err := fn(doc, time.Now()); err != nil {
+		return nil, err
+	}
+	if err := s.store.Put(*doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+func (s *InvoiceService) GetInvoice(number string) (*types.InvoiceDocument, error) {
+	return s.store.Get(number)
+}
+
+func (s *InvoiceService) ListInvoices(obuID int) ([]types.InvoiceDocument, error) {
+	return s.store.List(obuID)
+}
+
+func (s *InvoiceService) ListPeriodInvoices(from, to time.Time) ([]types.InvoiceDocument, error) {
+	return s.store.ListPeriod(from, to)
+}
+
+func handleCreateInvoice(svc Invoicer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			OBUID int       `json:"obuID"`
+			From  time.Time `json:"from"`
+			To    time.Time `json:"to"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			WriteJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		if !req.To.After(req.From) {
+			WriteJSON(w, http.StatusBadRequest, map[string]string{"error": "period ends before it starts"})
+			return
+		}
+		if err := wholeDays(req.From, req.To); err != nil {
+			WriteJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		doc, err := svc.CreateInvoice(req.OBUID, req.From, req.To)
+		if err != nil {
+			WriteJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		WriteJSON(w, http.StatusOK, doc)
+	}
+}
+
+func handleListInvoices(svc Invoicer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		obuID, err := strconv.Atoi(r.URL.Query().Get("obu"))
+		if err != nil {
+			WriteJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid OBU ID"})
+			return
+		}
+		docs, err := svc.ListInvoices(obuID)
+		if err != nil {
+			WriteJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		WriteJSON(w, http.StatusOK, docs)
+	}
+}
+
+// handleGetInvoiceDocument serves GET /invoices/{file}, where file is the
+// invoice number followed by .pdf, .csv (its lines) or .json, which is also
+// what no extension gets.
+func handleGetInvoiceDocument(svc Invoicer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		file := r.PathValue("file")
+		ext := path.Ext(file)
+		doc, err := svc.GetInvoice(strings.TrimSuffix(file, ext))
+		if err != nil {
+			writeInvoiceError(w, err)
+			return
+		}
+		switch ext {
+		case "", ".json":
+			WriteJSON(w, http.StatusOK, doc)
+		case ".pdf":
+			writeDocument(w, "application/pdf", doc.Number+".pdf", func(w io.Writer) error {
+				return render.PDF(w, *doc)
+			})
+		case ".csv":
+			writeDocument(w, "text/csv", doc.Number+".csv", func(w io.Writer) error {
+				return render.LinesCSV(w, []types.InvoiceDocument{*doc})
+			})
+		default:
+			WriteJSON(w, http.StatusNotFound, map[string]string{"error": "unknown format " + ext})
+		}
+	}
+}
+
+// handleExport serves GET /exports/{file}?from=&to=, the invoices or the
+// invoice lines of a period as invoices.csv, invoices.json, lines.csv or
+// lines.json.
+func handleExport(svc Invoicer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		file := r.PathValue("file")
+		var export func(io.Writer, []types.InvoiceDocument) error
+		switch file {
+		case "invoices.csv":
+			export = render.InvoicesCSV
+		case "lines.csv":
+			export = render.LinesCSV
+		case "invoices.json":
+			export = func(w io.Writer, docs []types.InvoiceDocument) error {
+				return render.JSON(w, docs)
+			}
+		case "lines.json":
+			export = func(w io.Writer, docs []types.InvoiceDocument) error {
+				return render.JSON(w, render.LineItems(docs))
+			}
+		default:
+			WriteJSON(w, http.StatusNotFound, map[string]string{"error": "unknown export " + file})
+			return
+		}
+		from, to, err := parsePeriod(r)
+		if err != nil {
+			WriteJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		docs, err := svc.ListPeriodInvoices(from, to)
+		if err != nil {
+			WriteJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		contentType := "text/csv"
+		if path.Ext(file) == ".json" {
+			contentType = "application/json"
+		}
+		writeDocument(w, contentType, file, func(w io.Writer) error {
+			return export(w, docs)
+		})
+	}
+}
+
+// writeDocument renders into memory first, so a failed render still gets
+// a proper error response.
+func writeDocument(w http.ResponseWriter, contentType, filename string, fn func(io.Writer) error) {
+	var buf bytes.Buffer
+	if err := fn(&buf); err != nil {
+		WriteJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%q", filename))
+	w.Write(buf.Bytes())
+}
+
+// handleInvoiceAction serves POST /invoices/{number}/{action}.
+func handleInvoiceAction(svc Invoicer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var action func(string) (*types.InvoiceDocument, error)
+		switch r.PathValue("action") {
+		case "issue":
+			action = svc.IssueInvoice
+		case "pay":
+			action = svc.PayInvoice
+		case "void":
+			action = svc.VoidInvoice
+		case "adjust":
+			action = svc.CreateAdjustment
+		default:
+			WriteJSON(w, http.StatusNotFound, map[string]string{"error": "unknown action"})
+			return
+		}
+		doc, err := action(r.PathValue("number"))
+		if err != nil {
+			writeInvoiceError(w, err)
+			return
+		}
+		WriteJSON(w, http.StatusOK, doc)
+	}
+}
+
+func writeInvoiceError(w http.ResponseWriter, err error) {
+	status := http.StatusConflict
+	switch {
+	case errors.Is(err, ErrInvoiceNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, ErrNothingToAdjust):
+		status = http.StatusUnprocessableEntity
+	}
+	WriteJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/types"
+)
+
+// FileInvoiceStore appends every version of every invoice to a JSON lines
+// log and fsyncs it, so the log doubles as the audit trail of an invoice.
+// On startup the log is replayed, the last version of an invoice wins.
+type FileInvoiceStore struct {
+	mu    sync.RWMutex
+	file  *os.File
+	docs  map[string]types.InvoiceDocument
+	byOBU map[int][]string
+}
+
+func NewFileInvoiceStore(path string) (*FileInvoiceStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	s := &FileInvoiceStore{
+		docs:  make(map[string]types.InvoiceDocument),
+		byOBU: make(map[int][]string),
+	}
+	if err := s.replay(path); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	s.file = f
+	return s, nil
+}
+
+// replay indexes the log at path. Put writes a record and its newline at
+// once, a last line without one is a write a crash tore: it is cut off the
+// log, it was never acknowledged. A record that doesn't decode anywhere else
+// is corruption and fails the replay.
+func (s *FileInvoiceStore) replay(path string) error {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var (
+		r    = bufio.NewReader(f)
+		size int64
+	)
+	for line := 1; ; line++ {
+		b, err := r.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(b) == 0 {
+				return nil
+			}
+			logrus.WithFields(logrus.Fields{
+				"log":   path,
+				"line":  line,
+				"bytes": len(b),
+			}).Warn("invoice log ends in a torn write, truncating it")
+			return os.Truncate(path, size)
+		}
+		if err != nil {
+			return err
+		}
+		var doc types.InvoiceDocument
+		if err := json.Unmarshal(b, &doc); err != nil {
+			return fmt.Errorf("invoice log %s line %d: %w", path, line, err)
+		}
+		s.index(doc)
+		size += int64(len(b))
+	}
+}
+
+func (s *FileInvoiceStore) index(doc types.InvoiceDocument) {
+	if _, ok := s.docs[doc.Number]; !ok {
+		s.byOBU[doc.OBUID] = append(s.byOBU[doc.OBUID], doc.Number)
+	}
+	s.docs[doc.Number] = doc
+}
+
+func (s *FileInvoiceStore) Put(doc types.InvoiceDocument) error {
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.file.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+	s.index(doc)
+	return nil
+}
+
+func (s *FileInvoiceStore) Get(number string) (*types.InvoiceDocument, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	doc, ok := s.docs[number]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrInvoiceNotFound, number)
+	}
+	return &doc, nil
+}
+
+func (s *FileInvoiceStore) List(obuID int) ([]types.InvoiceDocument, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	docs := make([]types.InvoiceDocument, 0, len(s.byOBU[obuID]))
+	for _, number := range s.byOBU[obuID] {
+		docs = append(docs, s.docs[number])
+	}
+	sort.Slice(docs, func(i, j int) bool { return docs[i].Number < docs[j].Number })
+	return docs, nil
+}
+
+func (s *FileInvoiceStore) ListPeriod(from, to time.Time) ([]types.InvoiceDocument, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	docs := []types.InvoiceDocument{}
+	for _, doc := range s.docs {
+		if !doc.PeriodStart.Before(from) && !doc.PeriodEnd.After(to) {
+			docs = append(docs, doc)
+		}
+	}
+	sort.Slice(docs, func(i, j int) bool { return docs[i].Number < docs[j].Number })
+	return docs, nil
+}
+
+func (s *FileInvoiceStore) Len() (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.docs), nil
+}
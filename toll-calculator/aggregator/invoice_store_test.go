@@ -0,0 +1,70 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/types"
+)
+
+func TestInvoiceLogTornWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "invoices.log")
+	s, err := NewFileInvoiceStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, number := range []string{"A-1", "A-2"} {
+		if err := s.Put(types.InvoiceDocument{Number: number, OBUID: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.file.Close()
+	complete, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a crash halfway through the next put
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"number":"A-3","obu`)
+	f.Close()
+
+	s, err = NewFileInvoiceStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := s.Len(); n != 2 {
+		t.Errorf("got %d invoices, want 2", n)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Size() != complete.Size() {
+		t.Fatalf("log not truncated to its complete records: %v %v", fi.Size(), err)
+	}
+	if err := s.Put(types.InvoiceDocument{Number: "A-3", OBUID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	s.file.Close()
+	if s, err = NewFileInvoiceStore(path); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := s.Len(); n != 3 {
+		t.Errorf("got %d invoices after the put, want 3", n)
+	}
+}
+
+func TestInvoiceLogCorruption(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "invoices.log")
+	log := `{"number":"A-1","obuID":1}` + "\n" + `{"numb` + "\n" + `{"number":"A-2","obuID":1}` + "\n"
+	if err := os.WriteFile(path, []byte(log), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewFileInvoiceStore(path); err == nil {
+		t.Fatal("corruption before the last record was replayed")
+	}
+	if b, _ := os.ReadFile(path); string(b) != log {
+		t.Error("corrupt log was changed")
+	}
+}
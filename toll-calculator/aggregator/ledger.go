@@ -0,0 +1,580 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/money"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/types"
+)
+
+var (
+	ErrInvalidAmount = errors.New("amount must be positive")
+	ErrOverpayment   = errors.New("payment exceeds what is due")
+)
+
+// Ledger keeps the balance of every account. Invoices are charged to the
+// ledger when they are issued, see LedgerMiddleware.
+type Ledger interface {
+	TopUp(string, money.Amount, string) (*types.LedgerEntry, error)
+	// Pay pays towards an issued invoice of the account, at most what is
+	// left to pay of it. The invoice is marked paid once its payments cover
+	// its charge.
+	Pay(string, string, money.Amount, string) (*types.LedgerEntry, error)
+	Balance(string) (*types.AccountBalance, error)
+	Entries(string) ([]types.LedgerEntry, error)
+	SetAccount(types.LedgerAccount) error
+}
+
+type LedgerStorer interface {
+	Append(types.LedgerEntry) error
+	PutAccount(types.LedgerAccount) error
+	// Account returns the settings of an account, the zero settings if it
+	// has none.
+	Account(string) (types.LedgerAccount, error)
+	Entries(string) ([]types.LedgerEntry, error)
+	Len() (int, error)
+}
+
+type LowBalanceNotifier interface {
+	NotifyLowBalance(types.AccountBalance) error
+}
+
+type LedgerService struct {
+	mu    sync.Mutex
+	store LedgerStorer
+	// settles invoices, it must not be wrapped in the LedgerMiddleware
+	invoices Invoicer
+	notifier LowBalanceNotifier
+}
+
+func NewLedgerService(store LedgerStorer, invoices Invoicer, notifier LowBalanceNotifier) *LedgerService {
+	return &LedgerService{
+		store:    store,
+		invoices: invoices,
+		notifier: notifier,
+	}
+}
+
+// ledgerAccountID is who an invoice is charged to. Without a vehicle
+// registry invoices have no account, the OBU gets one of its own then.
+func ledgerAccountID(doc *types.InvoiceDocument) string {
+	if doc.AccountID != "" {
+		return doc.AccountID
+	}
+	return fmt.Sprintf("obu-%d", doc.OBUID)
+}
+
+// TopUp credits the account. A prepaid account whose balance the top up
+// brings back to zero or above has its unpaid invoices paid.
+func (l *LedgerService) TopUp(accountID string, amount money.Amount, reference string) (*types.LedgerEntry, error) {
+	if amount <= 0 {
+		return nil, ErrInvalidAmount
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entry, err := l.post(types.LedgerEntry{
+		AccountID: accountID,
+		Kind:      types.LedgerEntryTopUp,
+		Amount:    amount,
+		Reference: reference,
+	})
+	if err != nil {
+		return nil, err
+	}
+	account, err := l.store.Account(accountID)
+	if err != nil {
+		return nil, err
+	}
+	if account.Prepaid && entry.Balance >= 0 {
+		if err := l.settle(accountID); err != nil {
+			return nil, err
+		}
+	}
+	return entry, nil
+}
+
+func (l *LedgerService) Pay(accountID, number string, amount money.Amount, reference string) (*types.LedgerEntry, error) {
+	if amount <= 0 {
+		return nil, ErrInvalidAmount
+	}
+
+	// voiding and paying invoices hold l.mu as well, the invoice stays
+	// issued until the payment is posted
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	doc, err := l.invoices.GetInvoice(number)
+	if err != nil {
+		return nil, err
+	}
+	if ledgerAccountID(doc) != accountID {
+		return nil, fmt.Errorf("%w: %s of account %s", ErrInvoiceNotFound, number, accountID)
+	}
+	if doc.Status != types.InvoiceStatusIssued {
+		return nil, fmt.Errorf("can't pay a %s invoice", doc.Status)
+	}
+	due, err := l.due(accountID, number)
+	if err != nil {
+		return nil, err
+	}
+	if amount > due {
+		return nil, fmt.Errorf("%w: %s is due on %s", ErrOverpayment, due, number)
+	}
+	entry, err := l.post(types.LedgerEntry{
+		AccountID: accountID,
+		Kind:      types.LedgerEntryPayment,
+		Amount:    amount,
+		Invoice:   number,
+		Reference: reference,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if amount == due {
+		if _, err := l.invoices.PayInvoice(number); err != nil {
+			return nil, err
+		}
+	}
+	return entry, nil
+}
+
+func (l *LedgerService) Balance(accountID string) (*types.AccountBalance, error) {
+	account, err := l.store.Account(accountID)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := l.store.Entries(accountID)
+	if err != nil {
+		return nil, err
+	}
+	bal := &types.AccountBalance{LedgerAccount: account}
+	if len(entries) > 0 {
+		bal.Balance = entries[len(entries)-1].Balance
+	}
+	if account.Prepaid {
+		return bal, nil
+	}
+	// what each invoice was charged and what was paid towards it
+	due := make(map[string]money.Amount)
+	for _, e := range entries {
+		if e.Invoice != "" {
+			due[e.Invoice] -= e.Amount
+		}
+	}
+	for _, d := range due {
+		if d > 0 {
+			bal.Outstanding += d
+		}
+	}
+	return bal, nil
+}
+
+func (l *LedgerService) Entries(accountID string) ([]types.LedgerEntry, error) {
+	return l.store.Entries(accountID)
+}
+
+func (l *LedgerService) SetAccount(account types.LedgerAccount) error {
+	if account.ID == "" {
+		return fmt.Errorf("missing account ID")
+	}
+	if account.LowBalance < 0 {
+		return fmt.Errorf("low balance threshold can't be negative")
+	}
+	return l.store.PutAccount(account)
+}
+
+// charge charges the invoice to its account, unless it already is.
+func (l *LedgerService) charge(doc *types.InvoiceDocument) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if charged, err := l.charged(doc); err != nil || len(charged) > 0 {
+		return err
+	}
+	_, err := l.post(types.LedgerEntry{
+		AccountID: ledgerAccountID(doc),
+		Kind:      types.LedgerEntryCharge,
+		Amount:    -doc.TotalGross,
+		Invoice:   doc.Number,
+	})
+	return err
+}
+
+// reverse reverses the charges of the invoice. Payments made towards it
+// stay on the account as credit. l.mu must be held.
+func (l *LedgerService) reverse(doc *types.InvoiceDocument, reference string) error {
+	charged, err := l.charged(doc)
+	if err != nil {
+		return err
+	}
+	for _, e := range charged {
+		_, err := l.post(types.LedgerEntry{
+			AccountID: e.AccountID,
+			Kind:      types.LedgerEntryReversal,
+			Amount:    -e.Amount,
+			Invoice:   e.Invoice,
+			Reverses:  e.ID,
+			Reference: reference,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// charged returns the charges of the invoice that weren't reversed.
+func (l *LedgerService) charged(doc *types.InvoiceDocument) ([]types.LedgerEntry, error) {
+	entries, err := l.store.Entries(ledgerAccountID(doc))
+	if err != nil {
+		return nil, err
+	}
+	var (
+		charges  []types.LedgerEntry
+		reversed = make(map[int]bool)
+	)
+	for _, e := range entries {
+		if e.Invoice != doc.Number {
+			continue
+		}
+		switch e.Kind {
+		case types.LedgerEntryCharge:
+			charges = append(charges, e)
+		case types.LedgerEntryReversal:
+			reversed[e.Reverses] = true
+		}
+	}
+	var open []types.LedgerEntry
+	for _, e := range charges {
+		if !reversed[e.ID] {
+			open = append(open, e)
+		}
+	}
+	return open, nil
+}
+
+// settle marks every issued invoice charged to the prepaid account paid,
+// l.mu must be held.
+func (l *LedgerService) settle(accountID string) error {
+	entries, err := l.store.Entries(accountID)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.Kind != types.LedgerEntryCharge {
+			continue
+		}
+		doc, err := l.invoices.GetInvoice(e.Invoice)
+		if err != nil {
+			return err
+		}
+		if doc.Status != types.InvoiceStatusIssued {
+			continue
+		}
+		if _, err := l.invoices.PayInvoice(e.Invoice); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// due is what is left to pay of the invoice, l.mu must be held.
+func (l *LedgerService) due(accountID, number string) (money.Amount, error) {
+	entries, err := l.store.Entries(accountID)
+	if err != nil {
+		return 0, err
+	}
+	var due money.Amount
+	for _, e := range entries {
+		if e.Invoice == number {
+			due -= e.Amount
+		}
+	}
+	return due, nil
+}
+
+// post numbers the entry, works out the balance after it and appends it,
+// l.mu must be held.
+func (l *LedgerService) post(entry types.LedgerEntry) (*types.LedgerEntry, error) {
+	n, err := l.store.Len()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := l.store.Entries(entry.AccountID)
+	if err != nil {
+		return nil, err
+	}
+	var before money.Amount
+	if len(entries) > 0 {
+		before = entries[len(entries)-1].Balance
+	}
+	entry.ID = n + 1
+	entry.At = time.Now()
+	entry.Balance = before + entry.Amount
+	if err := l.store.Append(entry); err != nil {
+		return nil, err
+	}
+
+	account, err := l.store.Account(entry.AccountID)
+	if err != nil {
+		return nil, err
+	}
+	// only notify when the balance crosses the threshold, not on every
+	// charge after that
+	if account.Prepaid && account.LowBalance > 0 && l.notifier != nil &&
+		before >= account.LowBalance && entry.Balance < account.LowBalance {
+		bal := types.AccountBalance{LedgerAccount: account, Balance: entry.Balance}
+		go func() {
+			if err := l.notifier.NotifyLowBalance(bal); err != nil {
+				logrus.Errorf("low balance notification error %s", err)
+			}
+		}()
+	}
+	return &entry, nil
+}
+
+// LedgerMiddleware charges invoices to the ledger when they are issued and
+// reverses the charge when they are voided. Invoices of prepaid accounts
+// are paid from the balance as soon as they are issued, if the balance
+// covers them. An invoice that takes the balance below zero stays issued,
+// and is paid by the top up that brings the balance back to zero, or with
+// a payment like any other.
+type LedgerMiddleware struct {
+	ledger *LedgerService
+	next   Invoicer
+}
+
+func NewLedgerMiddleware(ledger *LedgerService, next Invoicer) Invoicer {
+	return &LedgerMiddleware{
+		ledger: ledger,
+		next:   next,
+	}
+}
+
+func (m *LedgerMiddleware) CreateInvoice(obuID int, from, to time.Time) (*types.InvoiceDocument, error) {
+	return m.next.CreateInvoice(obuID, from, to)
+}
+
+func (m *LedgerMiddleware) CreateAdjustment(number string) (*types.InvoiceDocument, error) {
+	return m.next.CreateAdjustment(number)
+}
+
+// IssueInvoice charges before issuing, so an invoice is never out without
+// its charge. Charging again after a failed issue is a no-op.
+func (m *LedgerMiddleware) IssueInvoice(number string) (*types.InvoiceDocument, error) {
+	doc, err := m.next.GetInvoice(number)
+	if err != nil {
+		return nil, err
+	}
+	if doc.Status == types.InvoiceStatusDraft {
+		if err := m.ledger.charge(doc); err != nil {
+			return nil, err
+		}
+	}
+	doc, err = m.next.IssueInvoice(number)
+	if err != nil {
+		return nil, err
+	}
+	// a top up may have paid it since it was issued
+	m.ledger.mu.Lock()
+	defer m.ledger.mu.Unlock()
+	bal, err := m.ledger.Balance(ledgerAccountID(doc))
+	if err != nil {
+		return nil, err
+	}
+	if !bal.Prepaid {
+		return doc, nil
+	}
+	if doc, err = m.next.GetInvoice(number); err != nil || doc.Status != types.InvoiceStatusIssued {
+		return doc, err
+	}
+	if bal.Balance >= 0 {
+		return m.next.PayInvoice(number)
+	}
+	logrus.WithFields(logrus.Fields{
+		"accountID": bal.ID,
+		"balance":   bal.Balance,
+		"invoice":   number,
+	}).Warn("prepaid balance doesn't cover the invoice, it stays unpaid")
+	return doc, nil
+}
+
+// PayInvoice records whatever is left to pay of the invoice as paid, so
+// marking an invoice paid by hand still leaves a trace in the ledger.
+func (m *LedgerMiddleware) PayInvoice(number string) (*types.InvoiceDocument, error) {
+	m.ledger.mu.Lock()
+	defer m.ledger.mu.Unlock()
+	doc, err := m.next.GetInvoice(number)
+	if err != nil {
+		return nil, err
+	}
+	if doc.Status != types.InvoiceStatusIssued {
+		return m.next.PayInvoice(number)
+	}
+	accountID := ledgerAccountID(doc)
+	due, err := m.ledger.due(accountID, number)
+	if err != nil {
+		return nil, err
+	}
+	if due > 0 {
+		_, err := m.ledger.post(types.LedgerEntry{
+			AccountID: accountID,
+			Kind:      types.LedgerEntryPayment,
+			Amount:    due,
+			Invoice:   number,
+			Reference: "marked paid",
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return m.next.PayInvoice(number)
+}
+
+func (m *LedgerMiddleware) VoidInvoice(number string) (*types.InvoiceDocument, error) {
+	m.ledger.mu.Lock()
+	defer m.ledger.mu.Unlock()
+	doc, err := m.next.VoidInvoice(number)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.ledger.reverse(doc, "invoice voided"); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+func (m *LedgerMiddleware) GetInvoice(number string) (*types.InvoiceDocument, error) {
+	return m.next.GetInvoice(number)
+}
+
+func (m *LedgerMiddleware) ListInvoices(obuID int) ([]types.InvoiceDocument, error) {
+	return m.next.ListInvoices(obuID)
+}
+
+func (m *LedgerMiddleware) ListPeriodInvoices(from, to time.Time) ([]types.InvoiceDocument, error) {
+	return m.next.ListPeriodInvoices(from, to)
+}
+
+// LogNotifier only logs low balances.
+type LogNotifier struct{}
+
+func (LogNotifier) NotifyLowBalance(bal types.AccountBalance) error {
+	logrus.WithFields(logrus.Fields{
+		"accountID":  bal.ID,
+		"balance":    bal.Balance,
+		"lowBalance": bal.LowBalance,
+	}).Warn("Low Balance")
+	return nil
+}
+
+// WebhookNotifier posts the balance of the account as JSON.
+type WebhookNotifier struct {
+	URL string
+}
+
+func (n WebhookNotifier) NotifyLowBalance(bal types.AccountBalance) error {
+	b, err := json.Marshal(bal)
+	if err != nil {
+		return err
+	}
+	resp, err := http.Post(n.URL, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("low balance webhook responded with %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func handleGetBalance(ledger Ledger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		bal, err := ledger.Balance(r.PathValue("account"))
+		if err != nil {
+			WriteJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		WriteJSON(w, http.StatusOK, bal)
+	}
+}
+
+func handleGetEntries(ledger Ledger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		entries, err := ledger.Entries(r.PathValue("account"))
+		if err != nil {
+			WriteJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		WriteJSON(w, http.StatusOK, entries)
+	}
+}
+
+func handleSetAccount(ledger Ledger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var account types.LedgerAccount
+		if err := json.NewDecoder(r.Body).Decode(&account); err != nil {
+			WriteJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		account.ID = r.PathValue("account")
+		if err := ledger.SetAccount(account); err != nil {
+			WriteJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		WriteJSON(w, http.StatusOK, account)
+	}
+}
+
+// ledgerRequest is the body of a top-up or a payment.
+type ledgerRequest struct {
+	Amount    money.Amount `json:"amount"`
+	Invoice   string       `json:"invoice"`
+	Reference string       `json:"reference"`
+}
+
+func handleTopUp(ledger Ledger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req ledgerRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			WriteJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		entry, err := ledger.TopUp(r.PathValue("account"), req.Amount, req.Reference)
+		if err != nil {
+			writeLedgerError(w, err)
+			return
+		}
+		WriteJSON(w, http.StatusOK, entry)
+	}
+}
+
+func handlePayment(ledger Ledger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req ledgerRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			WriteJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		entry, err := ledger.Pay(r.PathValue("account"), req.Invoice, req.Amount, req.Reference)
+		if err != nil {
+			writeLedgerError(w, err)
+			return
+		}
+		WriteJSON(w, http.StatusOK, entry)
+	}
+}
+
+func writeLedgerError(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrInvalidAmount) || errors.Is(err, ErrOverpayment) {
+		WriteJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	writeInvoiceError(w, err)
+}
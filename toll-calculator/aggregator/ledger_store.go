@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/types"
+)
+
+// ledgerRecord is one line of the ledger log, either an entry or a change
+// to the settings of an account.
+type ledgerRecord struct {
+	Entry   *types.LedgerEntry   `json:"entry,omitempty"`
+	Account *types.LedgerAccount `json:"account,omitempty"`
+}
+
+// FileLedgerStore appends the ledger to a JSON lines log and fsyncs every
+// record. Entries are only ever appended, so the log is the audit trail.
+type FileLedgerStore struct {
+	mu       sync.RWMutex
+	file     *os.File
+	entries  map[string][]types.LedgerEntry
+	accounts map[string]types.LedgerAccount
+	count    int
+}
+
+func NewFileLedgerStore(path string) (*FileLedgerStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	s := &FileLedgerStore{
+		entries:  make(map[string][]types.LedgerEntry),
+		accounts: make(map[string]types.LedgerAccount),
+	}
+	if err := s.replay(path); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	s.file = f
+	return s, nil
+}
+
+func (s *FileLedgerStore) replay(path string) error {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		var rec ledgerRecord
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			return fmt.Errorf("ledger log %s line %d: %w", path, line, err)
+		}
+		s.index(rec)
+	}
+	return sc.Err()
+}
+
+func (s *FileLedgerStore) index(rec ledgerRecord) {
+	if e := rec.Entry; e != nil {
+		s.entries[e.AccountID] = append(s.entries[e.AccountID], *e)
+		s.count++
+	}
+	if a := rec.Account; a != nil {
+		s.accounts[a.ID] = *a
+	}
+}
+
+func (s *FileLedgerStore) append(rec ledgerRecord) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.file.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+	s.index(rec)
+	return nil
+}
+
+func (s *FileLedgerStore) Append(entry types.LedgerEntry) error {
+	return s.append(ledgerRecord{Entry: &entry})
+}
+
+func (s *FileLedgerStore) PutAccount(account types.LedgerAccount) error {
+	return s.append(ledgerRecord{Account: &account})
+}
+
+func (s *FileLedgerStore) Account(id string) (types.LedgerAccount, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if account, ok := s.accounts[id]; ok {
+		return account, nil
+	}
+	return types.LedgerAccount{ID: id}, nil
+}
+
+func (s *FileLedgerStore) Entries(accountID string) ([]types.LedgerEntry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]types.LedgerEntry{}, s.entries[accountID]...), nil
+}
+
+func (s *FileLedgerStore) Len() (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.count, nil
+}
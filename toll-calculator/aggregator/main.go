@@ -1,33 +1,217 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
-	"flag"
 	"fmt"
+	"log"
 	"net/http"
+	"path/filepath"
 	"strconv"
+	"time"
 
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/aggregator/client"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/config"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/health"
+	registry "github.com/tunangoo/full-time-go-dev/toll-calculator/registry/client"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/run"
 	"github.com/tunangoo/full-time-go-dev/toll-calculator/types"
 )
 
 func main() {
+	cfg := NewConfig()
+	config.MustLoad("aggregator", cfg)
 
-	listenAddr := flag.String("listenaddr", ":3000", "the listen address of HTTP Server")
-	flag.Parse()
+	var vehicles VehicleLookup
+	if !cfg.NoRegistry {
+		vehicles = registry.NewClient(cfg.Registry)
+	}
+
+	zones, err := LoadZones(cfg.Zones)
+	if err != nil {
+		log.Fatal(err)
+	}
+	tariff, err := LoadTariff(cfg.Tariff, cfg.Currency)
+	if err != nil {
+		log.Fatal(err)
+	}
+	rates, err := LoadExchangeRates(cfg.ExchangeRates)
+	if err != nil {
+		log.Fatal(err)
+	}
+	rules, err := LoadPricingRules(cfg.PricingRules)
+	if err != nil {
+		log.Fatal(err)
+	}
+	taxes, err := LoadTaxes(cfg.Taxes, zones)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	var (
 		store = NewMemoryStore()
-		svc   = NewInvoiceAggregator(store)
+		svc   = NewInvoiceAggregator(store, vehicles, tariff, rates, rules, taxes)
 	)
-	svc = NewLogMiddleware(svc)
-	makeHTTPTransport(*listenAddr, svc)
+	if err := LoadSnapshot(store, cfg.Snapshot); err != nil {
+		log.Fatal(err)
+	}
+	// stopped bottom up: requests in flight finish, then the billing run,
+	// and the last snapshot has all of it
+	g := run.New(cfg.ShutdownTimeout)
+	snapshotCtx, stopSnapshots := context.WithCancel(context.Background())
+	g.Add("snapshot", func() error {
+		snapshotLoop(snapshotCtx, store, cfg.Snapshot, cfg.SnapshotInterval)
+		return nil
+	}, func(context.Context) error {
+		stopSnapshots()
+		return SaveSnapshot(store, cfg.Snapshot)
+	})
+
+	// updates are priced without logging every one of them, and without
+	// asking the registry for every reading
+	streamer := NewStreamer(NewInvoiceAggregator(store, newVehicleCache(vehicles, streamLookupTTL), tariff, rates, rules, taxes), cfg.StreamBuffer)
+	svc = NewStreamMiddleware(streamer, NewLogMiddleware(svc))
+	local := svc
+	var cluster *Cluster
+	if len(cfg.Nodes) > 0 {
+		cluster = NewCluster(cfg.Self, cfg.ClusterToken, cfg.Nodes, store)
+		svc = NewShardMiddleware(cluster, svc)
+		http.HandleFunc("/admin/nodes", handleNodes(cluster))
+		http.HandleFunc("/admin/transfer", handleTransfer(cluster, store))
+		transferCtx, stopTransfers := context.WithCancel(context.Background())
+		g.Add("transfers", func() error {
+			cluster.Run(transferCtx, cfg.TransferRetry)
+			return nil
+		}, func(context.Context) error {
+			stopTransfers()
+			return nil
+		})
+	}
+	http.HandleFunc("/admin/snapshot", handleSnapshot(store, cfg.Snapshot))
+
+	invoiceStore, err := NewFileInvoiceStore(cfg.Invoices)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ledgerStore, err := NewFileLedgerStore(cfg.Ledger)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var notifier LowBalanceNotifier = LogNotifier{}
+	if cfg.LowBalanceHook != "" {
+		notifier = WebhookNotifier{URL: cfg.LowBalanceHook}
+	}
+	invoices := NewInvoiceService(svc, invoiceStore, cfg.InvoicePrefix, cfg.PaymentTerm, taxes)
+	ledger := NewLedgerService(ledgerStore, invoices, notifier)
+	invoices = NewInvoiceLogMiddleware(NewLedgerMiddleware(ledger, invoices))
+	sharded := invoices
+	if cluster != nil {
+		sharded = NewInvoiceShardMiddleware(cluster, invoices)
+	}
+	http.HandleFunc("POST /invoices", forwarded(cluster, handleCreateInvoice(sharded), handleCreateInvoice(invoices)))
+	http.HandleFunc("GET /invoices", handleListInvoices(invoices))
+	http.HandleFunc("GET /invoices/{file}", handleGetInvoiceDocument(invoices))
+	http.HandleFunc("GET /exports/{file}", handleExport(invoices))
+	http.HandleFunc("GET /ledger/{account}", handleGetBalance(ledger))
+	http.HandleFunc("PUT /ledger/{account}", handleSetAccount(ledger))
+	http.HandleFunc("GET /ledger/{account}/entries", handleGetEntries(ledger))
+	http.HandleFunc("POST /ledger/{account}/topups", handleTopUp(ledger))
+	http.HandleFunc("POST /ledger/{account}/payments", handlePayment(ledger))
+	http.HandleFunc("POST /invoices/{number}/{action}", handleInvoiceAction(invoices))
+
+	analytics := NewFleetAnalytics(store, vehicles, tariff, rules, taxes, zones)
+	if cluster != nil {
+		nodeAnalytics := handleNodeAnalytics(cluster, analytics)
+		http.HandleFunc("GET /admin/analytics/obus", nodeAnalytics)
+		http.HandleFunc("GET /admin/analytics/totals/{group}", nodeAnalytics)
+		http.HandleFunc("GET /admin/analytics/active", nodeAnalytics)
+		analytics = NewClusterAnalytics(cluster, analytics)
+	}
+	http.HandleFunc("GET /analytics/obus", handleOBUTotals(analytics))
+	http.HandleFunc("GET /analytics/top/{by}", handleTopOBUs(analytics))
+	http.HandleFunc("GET /analytics/totals/{group}", handleGroupTotals(analytics))
+	http.HandleFunc("GET /analytics/active", handleActiveVehicles(analytics))
+
+	if cfg.BillingPeriod != "" {
+		period, err := ParseBillingPeriod(cfg.BillingPeriod)
+		if err != nil {
+			log.Fatal(err)
+		}
+		var obus ActiveOBULister
+		if !cfg.NoRegistry {
+			obus = registry.NewClient(cfg.Registry)
+		}
+		billing := NewBillingScheduler(period, cfg.BillingDelay, cfg.BillingLookback, store, obus, invoices)
+		billingCtx, stopBilling := context.WithCancel(context.Background())
+		g.Add("billing", func() error {
+			billing.Start(billingCtx)
+			return nil
+		}, func(context.Context) error {
+			stopBilling()
+			return nil
+		})
+		http.HandleFunc("POST /admin/billing", handleBillingRun(billing))
+	}
+	checks := health.New()
+	checks.Add("snapshot", health.Writable(filepath.Dir(cfg.Snapshot)))
+	checks.Add("invoices", health.Writable(filepath.Dir(cfg.Invoices)))
+	checks.Add("ledger", health.Writable(filepath.Dir(cfg.Ledger)))
+	checks.Register(http.DefaultServeMux)
+	http.HandleFunc("GET /stream", handleStream(streamer, cluster))
+	http.HandleFunc("GET /stream/ws", handleStreamWS(streamer))
+	if cluster != nil {
+		relayCtx, stopRelays := context.WithCancel(context.Background())
+		g.Add("stream relay", func() error {
+			cluster.RelayStreams(relayCtx, streamer, streamRelayRetry)
+			return nil
+		}, func(context.Context) error {
+			stopRelays()
+			return nil
+		})
+	}
+	g.AddHTTPServer(makeHTTPTransport(cfg.ListenAddr, cluster, svc, local))
+	// the streams being served only end once the streamer is closed
+	g.Add("stream", streamer.Start, streamer.Close)
+	if err := g.Run(); err != nil {
+		log.Fatal(err)
+	}
 }
 
-func makeHTTPTransport(listenAddr string, svc Aggregator) {
+// makeHTTPTransport serves svc, except for requests another cluster node
+// forwarded to us, which go straight to local. A nil cluster runs a single
+// node, svc and local are the same.
+func makeHTTPTransport(listenAddr string, cluster *Cluster, svc, local Aggregator) *http.Server {
 	fmt.Println("HTTP Transport running on port", listenAddr)
-	http.HandleFunc("/aggregate", handleAggregate(svc))
-	http.HandleFunc("/invoice", handleGetInvoice(svc))
-	http.ListenAndServe(listenAddr, nil)
+	http.HandleFunc("/aggregate", forwarded(cluster, handleAggregate(svc), handleAggregate(local)))
+	http.HandleFunc("/trip", forwarded(cluster, handleAggregateTrip(svc), handleAggregateTrip(local)))
+	http.HandleFunc("/invoice", forwarded(cluster, handleGetInvoice(svc), handleGetInvoice(local)))
+	return &http.Server{Addr: listenAddr}
+}
+
+// forwarded only trusts the forwarded header of cluster nodes, anyone else
+// setting it is routed like any client.
+func forwarded(cluster *Cluster, next, local http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(client.ForwardedHeader) != "" && cluster != nil && cluster.fromPeer(r) {
+			local(w, r)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func handleSnapshot(store Snapshotter, path string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			WriteJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+			return
+		}
+		if err := SaveSnapshot(store, path); err != nil {
+			WriteJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		WriteJSON(w, http.StatusOK, map[string]string{"snapshot": path})
+	}
 }
 
 func handleGetInvoice(svc Aggregator) http.HandlerFunc {
@@ -43,7 +227,17 @@ func handleGetInvoice(svc Aggregator) http.HandlerFunc {
 			return
 		}
 
-		invoice, err := svc.CalculateInvoice(obuID)
+		var invoice *types.Invoice
+		if r.URL.Query().Has("from") || r.URL.Query().Has("to") {
+			from, to, perr := parsePeriod(r)
+			if perr != nil {
+				WriteJSON(w, http.StatusBadRequest, map[string]string{"error": perr.Error()})
+				return
+			}
+			invoice, err = svc.CalculatePeriodInvoice(obuID, from, to)
+		} else {
+			invoice, err = svc.CalculateInvoice(obuID)
+		}
 		if err != nil {
 			WriteJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
 			return
@@ -53,6 +247,23 @@ func handleGetInvoice(svc Aggregator) http.HandlerFunc {
 	}
 }
 
+// parsePeriod reads the RFC3339 ?from= and ?to= of a billing period, both
+// midnight UTC.
+func parsePeriod(r *http.Request) (time.Time, time.Time, error) {
+	from, err := time.Parse(time.RFC3339, r.URL.Query().Get("from"))
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid from: %w", err)
+	}
+	to, err := time.Parse(time.RFC3339, r.URL.Query().Get("to"))
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid to: %w", err)
+	}
+	if !to.After(from) {
+		return time.Time{}, time.Time{}, fmt.Errorf("period ends before it starts")
+	}
+	return from, to, wholeDays(from, to)
+}
+
 func handleAggregate(svc Aggregator) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var distance types.Distance
@@ -67,6 +278,20 @@ func handleAggregate(svc Aggregator) http.HandlerFunc {
 	}
 }
 
+func handleAggregateTrip(svc Aggregator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var trip types.Trip
+		if err := json.NewDecoder(r.Body).Decode(&trip); err != nil {
+			WriteJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		if err := svc.AggregateTrip(trip); err != nil {
+			WriteJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+	}
+}
+
 func WriteJSON(w http.ResponseWriter, status int, v any) error {
 	w.WriteHeader(status)
 	w.Header().Add("Content-Type", "application/json")
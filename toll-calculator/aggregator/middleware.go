@@ -4,6 +4,8 @@ import (
 	"time"
 
 	"github.com/sirupsen/logrus"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/geo"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/money"
 	"github.com/tunangoo/full-time-go-dev/toll-calculator/types"
 )
 
@@ -29,11 +31,25 @@ func (l *LoggingMiddleware) AggregateDistance(distance types.Distance) (err erro
 	return
 }
 
+func (l *LoggingMiddleware) AggregateTrip(trip types.Trip) (err error) {
+	defer func(start time.Time) {
+		logrus.WithFields(logrus.Fields{
+			"took":     time.Since(start),
+			"err":      err,
+			"obuID":    trip.OBUID,
+			"distance": trip.Distance,
+			"func":     "AggregateTrip",
+		}).Info("Aggregate Trip")
+	}(time.Now())
+	err = l.next.AggregateTrip(trip)
+	return
+}
+
 func (l *LoggingMiddleware) CalculateInvoice(obuID int) (inv *types.Invoice, err error) {
 	defer func(start time.Time) {
 		var (
-			distance float64
-			amount   float64
+			distance geo.Distance
+			amount   money.Amount
 		)
 
 		if inv != nil {
@@ -51,3 +67,101 @@ func (l *LoggingMiddleware) CalculateInvoice(obuID int) (inv *types.Invoice, err
 	inv, err = l.next.CalculateInvoice(obuID)
 	return
 }
+
+func (l *LoggingMiddleware) CalculatePeriodInvoice(obuID int, from, to time.Time) (inv *types.Invoice, err error) {
+	defer func(start time.Time) {
+		var (
+			distance geo.Distance
+			amount   money.Amount
+		)
+
+		if inv != nil {
+			distance = inv.TotalDistance
+			amount = inv.TotalAmount
+		}
+		logrus.WithFields(logrus.Fields{
+			"took":          time.Since(start),
+			"err":           err,
+			"obuID":         obuID,
+			"from":          from,
+			"to":            to,
+			"totalDistance": distance,
+			"totalAmount":   amount,
+		}).Info("CalculatePeriodInvoice")
+	}(time.Now())
+	inv, err = l.next.CalculatePeriodInvoice(obuID, from, to)
+	return
+}
+
+type InvoiceLoggingMiddleware struct {
+	next Invoicer
+}
+
+func NewInvoiceLogMiddleware(next Invoicer) Invoicer {
+	return &InvoiceLoggingMiddleware{
+		next: next,
+	}
+}
+
+func (l *InvoiceLoggingMiddleware) CreateInvoice(obuID int, from, to time.Time) (doc *types.InvoiceDocument, err error) {
+	defer func(start time.Time) {
+		fields := logrus.Fields{
+			"took":  time.Since(start),
+			"err":   err,
+			"obuID": obuID,
+			"from":  from,
+			"to":    to,
+			"func":  "CreateInvoice",
+		}
+		if doc != nil {
+			fields["number"] = doc.Number
+			fields["totalAmount"] = doc.TotalAmount
+			fields["totalGross"] = doc.TotalGross
+			fields["currency"] = doc.Currency
+		}
+		logrus.WithFields(fields).Info("Create Invoice")
+	}(time.Now())
+	doc, err = l.next.CreateInvoice(obuID, from, to)
+	return
+}
+
+func (l *InvoiceLoggingMiddleware) CreateAdjustment(number string) (*types.InvoiceDocument, error) {
+	return l.logTransition("CreateAdjustment", number, l.next.CreateAdjustment)
+}
+
+func (l *InvoiceLoggingMiddleware) IssueInvoice(number string) (*types.InvoiceDocument, error) {
+	return l.logTransition("IssueInvoice", number, l.next.IssueInvoice)
+}
+
+func (l *InvoiceLoggingMiddleware) PayInvoice(number string) (*types.InvoiceDocument, error) {
+	return l.logTransition("PayInvoice", number, l.next.PayInvoice)
+}
+
+func (l *InvoiceLoggingMiddleware) VoidInvoice(number string) (*types.InvoiceDocument, error) {
+	return l.logTransition("VoidInvoice", number, l.next.VoidInvoice)
+}
+
+func (l *InvoiceLoggingMiddleware) logTransition(name, number string, fn func(string) (*types.InvoiceDocument, error)) (doc *types.InvoiceDocument, err error) {
+	defer func(start time.Time) {
+		logrus.WithFields(logrus.Fields{
+			"took":   time.Since(start),
+			"err":    err,
+			"number": number,
+			"func":   name,
+		}).Info("Invoice Transition")
+	}(time.Now())
+	doc, err = fn(number)
+	return
+}
+
+func (l *InvoiceLoggingMiddleware) GetInvoice(number string) (*types.InvoiceDocument, error) {
+	return l.next.GetInvoice(number)
+}
+
+func (l *InvoiceLoggingMiddleware) ListInvoices(obuID int) ([]types.InvoiceDocument, error) {
+	return l.next.ListInvoices(obuID)
+}
+
+func (l *InvoiceLoggingMiddleware) ListPeriodInvoices(from, to time.Time) ([]types.InvoiceDocument, error) {
+	return l.next.ListPeriodInvoices(from, to)
+}
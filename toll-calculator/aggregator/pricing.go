@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/geo"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/money"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/types"
+)
+
+// PricingRules lower what invoices charge for road usage. They are applied
+// in order, each to what the rules before it left of the charge.
+type PricingRules []types.PricingRule
+
+// LoadPricingRules reads a JSON array of pricing rules, an empty path has
+// none.
+func LoadPricingRules(path string) (PricingRules, error) {
+	if path == "" {
+		return nil, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules PricingRules
+	if err := json.Unmarshal(b, &rules); err != nil {
+		return nil, fmt.Errorf("pricing rules %s: %w", path, err)
+	}
+	for _, rule := range rules {
+		if err := validatePricingRule(rule); err != nil {
+			return nil, fmt.Errorf("pricing rules %s: %s: %w", path, rule.Name, err)
+		}
+	}
+	return rules, nil
+}
+
+func validatePricingRule(rule types.PricingRule) error {
+	if rule.Name == "" {
+		return errors.New("missing name")
+	}
+	if rule.MinTrips < 0 || rule.MinDistance < 0 {
+		return errors.New("minimums must not be negative")
+	}
+	switch rule.Kind {
+	case types.PricingExempt:
+	case types.PricingDiscount:
+		if rule.Rate <= 0 || rule.Rate > money.Rate(1_000_000) {
+			return errors.New("rate must be above 0 and at most 1")
+		}
+	case types.PricingCap:
+		if rule.Cap < 0 {
+			return errors.New("cap must not be negative")
+		}
+	default:
+		return fmt.Errorf("unknown kind %q", rule.Kind)
+	}
+	return nil
+}
+
+// usage is what the rules look at: the road usage of an invoice and what
+// it costs before any rule.
+type usage struct {
+	class    types.VehicleClass
+	trips    int
+	distance geo.Distance
+	charge   money.Amount
+	// what the rules left of the charge in the same calendar month before
+	// the period of the invoice, it counts towards monthly caps
+	earlier money.Amount
+	// converts caps to the currency of the invoice, nil if it is the
+	// tariff's
+	exchange *types.ExchangeRate
+}
+
+// apply returns a discount for every rule that lowered the charge.
+func (r PricingRules) apply(u usage) []types.InvoiceDiscount {
+	var (
+		discounts []types.InvoiceDiscount
+		left      = u.charge
+	)
+	for _, rule := range r {
+		if left <= 0 {
+			break
+		}
+		if !r.covers(rule, u) {
+			continue
+		}
+		var off money.Amount
+		switch rule.Kind {
+		case types.PricingExempt:
+			off = left
+		case types.PricingDiscount:
+			off = rule.Rate.Of(left)
+		case types.PricingCap:
+			limit := rule.Cap
+			if u.exchange != nil {
+				limit = u.exchange.Rate.Of(limit)
+			}
+			off = min(left, max(0, u.earlier+left-limit))
+		}
+		if off == 0 {
+			continue
+		}
+		left -= off
+		discounts = append(discounts, types.InvoiceDiscount{
+			PricingRule: rule,
+			Amount:      -off,
+		})
+	}
+	return discounts
+}
+
+// charged is what the rules leave of the charge of u.
+func (r PricingRules) charged(u usage) money.Amount {
+	return u.charge + totalDiscount(r.apply(u))
+}
+
+func (r PricingRules) covers(rule types.PricingRule, u usage) bool {
+	if len(rule.Classes) > 0 && !slices.Contains(rule.Classes, u.class) {
+		return false
+	}
+	return u.trips >= rule.MinTrips && u.distance >= rule.MinDistance
+}
+
+func totalDiscount(discounts []types.InvoiceDiscount) money.Amount {
+	var total money.Amount
+	for _, d := range discounts {
+		total += d.Amount
+	}
+	return total
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/money"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/types"
+)
+
+var (
+	exemptRule = types.PricingRule{Name: "Emergency vehicles", Kind: types.PricingExempt, Classes: []types.VehicleClass{types.VehicleClassEmergency}}
+	discount   = types.PricingRule{Name: "Frequent user", Kind: types.PricingDiscount, MinTrips: 40, Rate: 100_000}
+	monthlyCap = types.PricingRule{Name: "Monthly cap", Kind: types.PricingCap, Classes: []types.VehicleClass{types.VehicleClassCar}, Cap: 15000}
+)
+
+func TestPricingRulesApply(t *testing.T) {
+	car := usage{class: types.VehicleClassCar, trips: 40, distance: 100_000, charge: 8000}
+	tests := []struct {
+		name  string
+		rules PricingRules
+		u     usage
+		want  []money.Amount
+	}{
+		{
+			name:  "under the cap",
+			rules: PricingRules{monthlyCap},
+			u:     car,
+		},
+		{
+			name:  "earlier in the month counts towards the cap",
+			rules: PricingRules{monthlyCap},
+			u:     usage{class: types.VehicleClassCar, charge: 8000, earlier: 10000},
+			want:  []money.Amount{-3000},
+		},
+		{
+			name:  "capped earlier in the month",
+			rules: PricingRules{monthlyCap},
+			u:     usage{class: types.VehicleClassCar, charge: 8000, earlier: 16000},
+			want:  []money.Amount{-8000},
+		},
+		{
+			name:  "cap in the currency of the invoice",
+			rules: PricingRules{monthlyCap},
+			u: usage{class: types.VehicleClassCar, charge: 8000, earlier: 25000,
+				exchange: &types.ExchangeRate{From: "EUR", To: "XXX", Rate: 2_000_000}},
+			want: []money.Amount{-3000},
+		},
+		{
+			name:  "exempt",
+			rules: PricingRules{exemptRule, discount},
+			u:     usage{class: types.VehicleClassEmergency, trips: 40, charge: 8000},
+			want:  []money.Amount{-8000},
+		},
+		{
+			name:  "exempt only its classes",
+			rules: PricingRules{exemptRule},
+			u:     car,
+		},
+		{
+			name:  "below the minimum trips",
+			rules: PricingRules{discount},
+			u:     usage{class: types.VehicleClassCar, trips: 39, charge: 8000},
+		},
+		{
+			name:  "discount before the cap",
+			rules: PricingRules{discount, monthlyCap},
+			u:     usage{class: types.VehicleClassCar, trips: 40, charge: 20000},
+			// 10% of 200.00, then capped from 180.00
+			want: []money.Amount{-2000, -3000},
+		},
+		{
+			name:  "cap before the discount",
+			rules: PricingRules{monthlyCap, discount},
+			u:     usage{class: types.VehicleClassCar, trips: 40, charge: 20000},
+			// capped from 200.00, then 10% of 150.00
+			want: []money.Amount{-5000, -1500},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.rules.apply(tt.u)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got discounts %+v, want amounts %v", got, tt.want)
+			}
+			for i, d := range got {
+				if d.Amount != tt.want[i] {
+					t.Errorf("discount %d %s = %s, want %s", i, d.Name, d.Amount, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+// TestCapCountsDiscountedCharges checks that monthly caps count what was
+// charged earlier in the month after discounts, not the distance.
+func TestCapCountsDiscountedCharges(t *testing.T) {
+	var (
+		tariff = &Tariff{Currency: "EUR", Prices: defaultPrices}
+		rules  = PricingRules{
+			{Name: "Half price", Kind: types.PricingDiscount, Rate: 500_000},
+			{Name: "Monthly cap", Kind: types.PricingCap, Cap: 15000},
+		}
+		day = time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC)
+	)
+	tests := []struct {
+		name    string
+		earlier float64
+		want    []money.Amount
+	}{
+		// 126.00 half price earlier, 63.00 of 126.00 now
+		{name: "under the cap", earlier: 40, want: []money.Amount{-6300}},
+		// 94.50 earlier, the cap takes 7.50 of the 63.00 now
+		{name: "over the cap", earlier: 60, want: []money.Amount{-6300, -750}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := NewMemoryStore()
+			store.Insert(types.Distance{OBUID: 1, Value: tt.earlier, Unix: day.AddDate(0, 0, -10).UnixNano()})
+			store.Insert(types.Distance{OBUID: 1, Value: 40, Unix: day.Add(8 * time.Hour).UnixNano()})
+			agg := &InvoiceAggregator{store: store, tariff: tariff, rules: rules}
+			inv, err := agg.CalculatePeriodInvoice(1, day, day.AddDate(0, 0, 1))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(inv.Discounts) != len(tt.want) {
+				t.Fatalf("got discounts %+v, want amounts %v", inv.Discounts, tt.want)
+			}
+			for i, d := range inv.Discounts {
+				if d.Amount != tt.want[i] {
+					t.Errorf("discount %d %s = %s, want %s", i, d.Name, d.Amount, tt.want[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package render
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// TestPDFXref checks that the cross-reference table points at every
+// object, which is what readers use to find them.
+func TestPDFXref(t *testing.T) {
+	lines := make([]string, 2*linesPerPage+1)
+	for i := range lines {
+		lines[i] = fmt.Sprintf("line %d (with parentheses) \\ and ünïcode ✓", i)
+	}
+	lines[0] = "# Invoice"
+	var buf bytes.Buffer
+	if err := writePDF(&buf, strings.Join(lines, "\n")); err != nil {
+		t.Fatal(err)
+	}
+	pdf := buf.Bytes()
+
+	m := regexp.MustCompile(`startxref\n(\d+)\n%%EOF\n$`).FindSubmatch(pdf)
+	if m == nil {
+		t.Fatal("no startxref at the end")
+	}
+	xref, _ := strconv.Atoi(string(m[1]))
+	if !bytes.HasPrefix(pdf[xref:], []byte("xref\n")) {
+		t.Fatalf("startxref %d doesn't point at the xref table", xref)
+	}
+	table := strings.Split(string(pdf[xref:]), "\n")
+	var size int
+	fmt.Sscanf(table[1], "0 %d", &size)
+	// catalog, pages, two fonts, then a page and its content per page
+	if want := 4 + 2*3 + 1; size != want {
+		t.Fatalf("xref has %d entries, want %d", size, want)
+	}
+	for i := 1; i < size; i++ {
+		entry := table[2+i]
+		if len(entry) != 19 {
+			t.Errorf("xref entry %q is not 20 bytes with its newline", entry)
+		}
+		off, _ := strconv.Atoi(entry[:10])
+		if want := fmt.Sprintf("%d 0 obj\n", i); !bytes.HasPrefix(pdf[off:], []byte(want)) {
+			t.Errorf("xref entry %d points at %q", i, pdf[off:off+10])
+		}
+	}
+}
@@ -0,0 +1,136 @@
+// Package render turns invoice documents into what customers and finance
+// get to see: PDF invoices, and CSV and JSON exports.
+package render
+
+import (
+	"bytes"
+	"embed"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"strconv"
+	"text/template"
+	"time"
+
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/types"
+)
+
+//go:embed templates
+var templates embed.FS
+
+var invoiceTemplate = template.Must(template.New("invoice.tmpl").Funcs(template.FuncMap{
+	"date": func(t time.Time) string { return t.UTC().Format("2006-01-02") },
+	// periods end exclusive, people read them inclusive
+	"lastDay": func(t time.Time) time.Time { return t.Add(-time.Nanosecond) },
+}).ParseFS(templates, "templates/invoice.tmpl"))
+
+// PDF renders the invoice from templates/invoice.tmpl.
+func PDF(w io.Writer, doc types.InvoiceDocument) error {
+	var text bytes.Buffer
+	if err := invoiceTemplate.Execute(&text, doc); err != nil {
+		return err
+	}
+	return writePDF(w, text.String())
+}
+
+// LineItem is an invoice line flattened for export.
+type LineItem struct {
+	Number string `json:"number"`
+	OBUID  int    `json:"obuID"`
+	Line   int    `json:"line"`
+	types.InvoiceLine
+}
+
+func LineItems(docs []types.InvoiceDocument) []LineItem {
+	items := []LineItem{}
+	for _, doc := range docs {
+		for i, line := range doc.Lines {
+			items = append(items, LineItem{
+				Number:      doc.Number,
+				OBUID:       doc.OBUID,
+				Line:        i + 1,
+				InvoiceLine: line,
+			})
+		}
+	}
+	return items
+}
+
+func JSON(w io.Writer, v any) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func InvoicesCSV(w io.Writer, docs []types.InvoiceDocument) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{
+		"number", "status", "adjusts", "obuID", "accountID", "plate", "vehicleClass",
+		"periodStart", "periodEnd", "createdAt", "issuedAt", "dueAt", "paidAt", "voidedAt",
+		"currency", "totalDistance", "totalAmount", "totalTax", "totalGross",
+	})
+	for _, doc := range docs {
+		cw.Write([]string{
+			doc.Number,
+			string(doc.Status),
+			doc.Adjusts,
+			strconv.Itoa(doc.OBUID),
+			doc.AccountID,
+			doc.Plate,
+			string(doc.VehicleClass),
+			csvTime(&doc.PeriodStart),
+			csvTime(&doc.PeriodEnd),
+			csvTime(&doc.CreatedAt),
+			csvTime(doc.IssuedAt),
+			csvTime(doc.DueAt),
+			csvTime(doc.PaidAt),
+			csvTime(doc.VoidedAt),
+			doc.Currency,
+			doc.TotalDistance.String(),
+			doc.TotalAmount.String(),
+			doc.TotalTax.String(),
+			doc.TotalGross.String(),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func LinesCSV(w io.Writer, docs []types.InvoiceDocument) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{
+		"number", "obuID", "line", "description", "distance", "unitPrice", "amount",
+		"tripStart", "tripEnd",
+	})
+	for _, item := range LineItems(docs) {
+		var tripStart, tripEnd string
+		if trip := item.Trip; trip != nil {
+			start, end := time.Unix(0, trip.StartUnix), time.Unix(0, trip.EndUnix)
+			tripStart, tripEnd = csvTime(&start), csvTime(&end)
+		}
+		distance, unitPrice := item.Distance.String(), item.UnitPrice.String()
+		if item.Tax != nil || item.Discount != nil {
+			distance, unitPrice = "", ""
+		}
+		cw.Write([]string{
+			item.Number,
+			strconv.Itoa(item.OBUID),
+			strconv.Itoa(item.Line),
+			item.Description,
+			distance,
+			unitPrice,
+			item.Amount.String(),
+			tripStart,
+			tripEnd,
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func csvTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
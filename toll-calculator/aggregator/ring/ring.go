@@ -0,0 +1,75 @@
+package ring
+
+import (
+	"hash/crc32"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+const defaultReplicas = 128
+
+// Ring is a consistent hash ring mapping OBU IDs to aggregator nodes. Each
+// node is placed on the ring several times so ownership spreads evenly and
+// only about 1/n of the OBUs move when a node is added or removed.
+type Ring struct {
+	mu       sync.RWMutex
+	replicas int
+	hashes   []uint32
+	owners   map[uint32]string
+	nodes    []string
+}
+
+func New(nodes ...string) *Ring {
+	r := &Ring{
+		replicas: defaultReplicas,
+	}
+	r.Set(nodes)
+	return r
+}
+
+// Set replaces the members of the ring.
+func (r *Ring) Set(nodes []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.nodes = slices.Clone(nodes)
+	slices.Sort(r.nodes)
+	r.nodes = slices.Compact(r.nodes)
+	r.hashes = r.hashes[:0]
+	r.owners = make(map[uint32]string, len(r.nodes)*r.replicas)
+	for _, node := range r.nodes {
+		for i := 0; i < r.replicas; i++ {
+			h := hash(node + "#" + strconv.Itoa(i))
+			r.hashes = append(r.hashes, h)
+			r.owners[h] = node
+		}
+	}
+	slices.Sort(r.hashes)
+}
+
+func (r *Ring) Nodes() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return slices.Clone(r.nodes)
+}
+
+// Get returns the node owning obuID, or "" if the ring is empty.
+func (r *Ring) Get(obuID int) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if len(r.hashes) == 0 {
+		return ""
+	}
+	h := hash(strconv.Itoa(obuID))
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.owners[r.hashes[i]]
+}
+
+func hash(key string) uint32 {
+	return crc32.ChecksumIEEE([]byte(key))
+}
@@ -0,0 +1,59 @@
+package ring
+
+import "testing"
+
+func TestGetEmpty(t *testing.T) {
+	if got := New().Get(1); got != "" {
+		t.Errorf("Get on an empty ring = %q, want \"\"", got)
+	}
+}
+
+func TestNodes(t *testing.T) {
+	r := New("b", "a", "b")
+	got := r.Nodes()
+	if len(got) != 2 || got[0] != "a" || got[1] != "b" {
+		t.Errorf("Nodes() = %v, want [a b]", got)
+	}
+}
+
+// TestSetMovesFewOBUs checks that a node joining only takes OBUs over from
+// the others, and a node leaving only hands over the OBUs it owned.
+func TestSetMovesFewOBUs(t *testing.T) {
+	const obus = 10_000
+	r := New("a", "b", "c")
+	before := make([]string, obus)
+	counts := make(map[string]int)
+	for id := range before {
+		before[id] = r.Get(id)
+		counts[before[id]]++
+	}
+	for _, node := range []string{"a", "b", "c"} {
+		// perfectly even is 1/3
+		if counts[node] < obus/5 {
+			t.Errorf("node %s owns %d of %d OBUs", node, counts[node], obus)
+		}
+	}
+
+	r.Set([]string{"a", "b", "c", "d"})
+	moved := 0
+	for id, owner := range before {
+		got := r.Get(id)
+		if got == owner {
+			continue
+		}
+		moved++
+		if got != "d" {
+			t.Fatalf("OBU %d moved from %s to %s, not to the new node", id, owner, got)
+		}
+	}
+	if moved == 0 || moved > obus/2 {
+		t.Errorf("%d of %d OBUs moved to the new node", moved, obus)
+	}
+
+	r.Set([]string{"a", "c"})
+	for id, owner := range before {
+		if owner != "b" && r.Get(id) != owner {
+			t.Fatalf("OBU %d of %s moved to %s when b left", id, owner, r.Get(id))
+		}
+	}
+}
@@ -2,29 +2,76 @@ package main
 
 import (
 	"fmt"
+	"time"
 
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/geo"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/money"
 	"github.com/tunangoo/full-time-go-dev/toll-calculator/types"
 )
 
-const basePrice = 3.15
-
 type Aggregator interface {
 	AggregateDistance(types.Distance) error
+	AggregateTrip(types.Trip) error
 	CalculateInvoice(int) (*types.Invoice, error)
+	// CalculatePeriodInvoice only covers the UTC days in [from, to).
+	CalculatePeriodInvoice(int, time.Time, time.Time) (*types.Invoice, error)
 }
 
 type Storer interface {
 	Insert(types.Distance) error
 	Get(int) (float64, error)
+	GetRange(int, time.Time, time.Time) (float64, error)
+	InsertTrip(types.Trip) error
+	GetTrips(int) ([]types.Trip, error)
+	IDs() ([]int, error)
+	// Take removes the OBU from the store and returns its state.
+	Take(int) (types.OBUState, error)
+	// Merge adds the state to whatever the store holds for the OBU. A state
+	// with a transfer ID the store merged before is ignored.
+	Merge(types.OBUState) error
+	// Stash keeps the state of an OBU that couldn't be handed over to its
+	// owner yet, with the rest of the store. Unstash returns and removes
+	// every stashed state.
+	Stash(types.OBUState) error
+	Unstash() ([]types.OBUState, error)
+	// TotalsByOBU sums the distance of the UTC days starting in [from, to)
+	// and counts the trips starting in it, for every OBU in the store. It
+	// leaves pricing to the caller.
+	TotalsByOBU(time.Time, time.Time) ([]types.OBUTotal, error)
+	// TotalsByDay returns the distance of every OBU on every UTC day
+	// starting in [from, to) it drove on, ordered by day and OBU.
+	TotalsByDay(time.Time, time.Time) ([]types.DayTotal, error)
+	// TripsBetween returns the trips of all OBUs starting in [from, to).
+	TripsBetween(time.Time, time.Time) ([]types.Trip, error)
+}
+
+// VehicleLookup tells which vehicle and account an OBU belongs to.
+type VehicleLookup interface {
+	LookupOBU(int, time.Time) (*types.OBURecord, error)
 }
 
 type InvoiceAggregator struct {
 	store Storer
+	// nil invoices every OBU at the car price
+	vehicles VehicleLookup
+	tariff   *Tariff
+	// convert the tariff to the currency of accounts billed in another one
+	rates ExchangeRates
+	rules PricingRules
+	// nil doesn't tax
+	taxes *Taxes
+	// prices every account in the tariff's currency, for fleet totals
+	inTariffCurrency bool
 }
 
-func NewInvoiceAggregator(store Storer) Aggregator {
+func NewInvoiceAggregator(store Storer, vehicles VehicleLookup, tariff *Tariff, rates ExchangeRates, rules PricingRules, taxes *Taxes) Aggregator {
 	return &InvoiceAggregator{
-		store: store,
+		store:    store,
+		vehicles: vehicles,
+		tariff:   tariff,
+		rates:    rates,
+		rules:    rules,
+		taxes:    taxes,
 	}
 }
 
@@ -33,16 +80,161 @@ func (i *InvoiceAggregator) AggregateDistance(distance types.Distance) error {
 	return i.store.Insert(distance)
 }
 
+func (i *InvoiceAggregator) AggregateTrip(trip types.Trip) error {
+	return i.store.InsertTrip(trip)
+}
+
+// CalculateInvoice refuses OBUs the vehicle registry doesn't know about.
+// The invoice covers everything the OBU drove, monthly caps treat it as a
+// single month.
 func (i *InvoiceAggregator) CalculateInvoice(obuID int) (*types.Invoice, error) {
 	dist, err := i.store.Get(obuID)
 	if err != nil {
 		return nil, err
 	}
+	trips, err := i.store.GetTrips(obuID)
+	if err != nil {
+		return nil, err
+	}
+	inv, _, err := i.calculate(obuID, time.Now(), dist, trips, 0, 0)
+	return inv, err
+}
+
+func (i *InvoiceAggregator) CalculatePeriodInvoice(obuID int, from, to time.Time) (*types.Invoice, error) {
+	inv, _, err := i.calculatePeriod(obuID, from, to)
+	return inv, err
+}
+
+// calculatePeriod is CalculatePeriodInvoice, with the lines of the invoice.
+func (i *InvoiceAggregator) calculatePeriod(obuID int, from, to time.Time) (*types.Invoice, []pricedLine, error) {
+	dist, err := i.store.GetRange(obuID, from, to)
+	if err != nil {
+		return nil, nil, err
+	}
+	trips, err := i.store.GetTrips(obuID)
+	if err != nil {
+		return nil, nil, err
+	}
+	// what the OBU drove earlier in the month counts towards monthly caps,
+	// periods longer than a month are capped as the month they start in
+	var (
+		earlier      float64
+		earlierTrips int
+	)
+	if month := BillingPeriodMonthly.start(from); month.Before(from) {
+		if earlier, err = i.store.GetRange(obuID, month, from); err != nil {
+			return nil, nil, err
+		}
+		earlierTrips = len(tripsIn(trips, month, from))
+	}
+	// the vehicle the OBU was in when the period ended pays for it
+	inv, lines, err := i.calculate(obuID, to.Add(-time.Nanosecond), dist, tripsIn(trips, from, to), earlier, earlierTrips)
+	if err != nil {
+		return nil, nil, err
+	}
+	inv.PeriodStart = &from
+	inv.PeriodEnd = &to
+	return inv, lines, nil
+}
+
+// tripsIn returns the trips that started in [from, to).
+func tripsIn(trips []types.Trip, from, to time.Time) []types.Trip {
+	var in []types.Trip
+	for _, trip := range trips {
+		if tripStartsIn(trip, from, to) {
+			in = append(in, trip)
+		}
+	}
+	return in
+}
+
+// calculate prices dist, of which trips are a part, and applies the pricing
+// rules and taxes. earlier is the distance driven in the month before dist,
+// over earlierTrips trips. The lines of the invoice come first, one per
+// trip in the order of trips.
+func (i *InvoiceAggregator) calculate(obuID int, at time.Time, dist float64, trips []types.Trip, earlier float64, earlierTrips int) (*types.Invoice, []pricedLine, error) {
+	price, rec, err := i.tariff.unitPrice(i.vehicles, obuID, at)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	inv := &types.Invoice{
-		OBUID:         obuID,
-		TotalDistance: dist,
-		TotalAmount:   basePrice * dist,
+		OBUID:    obuID,
+		Currency: i.tariff.Currency,
+	}
+	if rec != nil {
+		inv.AccountID = rec.Account.ID
+		inv.Plate = rec.Vehicle.Plate
+		inv.VehicleClass = rec.Vehicle.Class
+		inv.Country = rec.Account.Country
+		// the price is converted, not the amounts, so every line still
+		// is its distance times the unit price
+		if to := rec.Account.Currency; !i.inTariffCurrency && to != "" && to != inv.Currency {
+			rate, err := i.rates.rate(inv.Currency, to)
+			if err != nil {
+				return nil, nil, err
+			}
+			inv.ExchangeRate = &types.ExchangeRate{From: inv.Currency, To: to, Rate: rate}
+			inv.Currency = to
+			price = rate.Convert(price)
+		}
+	}
+	inv.UnitPrice = price
+
+	// every trip is a line item rounded on its own, the distance outside
+	// of trips is the last one
+	var lines []taxable
+	for _, trip := range trips {
+		billed := geo.FromKm(trip.Distance)
+		amount := price.Charge(billed)
+		inv.Trips = append(inv.Trips, types.InvoiceTrip{
+			Trip:   trip,
+			Amount: amount,
+		})
+		inv.TotalDistance += billed
+		inv.TotalAmount += amount
+		lines = append(lines, taxable{amount: amount, located: true, lat: trip.StartLat, long: trip.StartLong})
+	}
+	if rest := geo.FromKm(dist) - inv.TotalDistance; rest > 0 {
+		amount := price.Charge(rest)
+		inv.TotalDistance += rest
+		inv.TotalAmount += amount
+		lines = append(lines, taxable{amount: amount})
 	}
 
-	return inv, nil
+	// caps count what the rules left of the earlier charge, not the
+	// distance, what a discount took off earlier was never charged
+	var charged money.Amount
+	if billed := geo.FromKm(earlier); billed > 0 {
+		charged = i.rules.charged(usage{
+			class:    inv.VehicleClass,
+			trips:    earlierTrips,
+			distance: billed,
+			charge:   price.Charge(billed),
+			exchange: inv.ExchangeRate,
+		})
+	}
+	inv.Discounts = i.rules.apply(usage{
+		class:    inv.VehicleClass,
+		trips:    len(trips),
+		distance: inv.TotalDistance,
+		charge:   inv.TotalAmount,
+		earlier:  charged,
+		exchange: inv.ExchangeRate,
+	})
+	// discounts are spread over the lines, so they lower the taxes of the
+	// zones the lines were driven in as well as those of the country
+	discount := totalDiscount(inv.Discounts)
+	inv.TotalAmount += discount
+	lines = lower(discount, lines)
+
+	inv.Taxes = i.taxes.apply(inv.Country, lines)
+	inv.TotalTax = totalTax(inv.Taxes)
+	inv.TotalGross = inv.TotalAmount + inv.TotalTax
+
+	priced := make([]pricedLine, len(lines))
+	for j, tax := range i.taxes.shares(inv.Country, lines, inv.Taxes) {
+		priced[j] = pricedLine{taxable: lines[j], tax: tax}
+	}
+	return inv, priced, nil
 }
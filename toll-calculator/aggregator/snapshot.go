@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+type Snapshotter interface {
+	Snapshot(io.Writer) error
+	Restore(io.Reader) error
+}
+
+// SaveSnapshot writes the snapshot next to path first and renames it into
+// place, so a crash halfway through never leaves a truncated snapshot behind.
+func SaveSnapshot(s Snapshotter, path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if err := s.Snapshot(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// LoadSnapshot restores s from path. A missing snapshot is not an error,
+// the store simply starts empty.
+func LoadSnapshot(s Snapshotter, path string) error {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return s.Restore(f)
+}
+
+func snapshotLoop(ctx context.Context, s Snapshotter, path string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := SaveSnapshot(s, path); err != nil {
+				logrus.Errorf("snapshot error %s", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
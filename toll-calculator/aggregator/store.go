@@ -1,21 +1,85 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
 
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/geo"
 	"github.com/tunangoo/full-time-go-dev/toll-calculator/types"
 )
 
 type MemoryStore struct {
+	mu   sync.RWMutex
 	data map[int]float64
+	// distance per OBU per UTC day, keyed by the unix seconds of midnight
+	days  map[int]map[int64]float64
+	trips map[int][]types.Trip
+	// the transfer IDs of the states merged into the store
+	merged map[string]bool
+	stash  []types.OBUState
+}
+
+// memorySnapshot is the on-disk representation of a MemoryStore.
+type memorySnapshot struct {
+	Data   map[int]float64           `json:"data"`
+	Days   map[int]map[int64]float64 `json:"days"`
+	Trips  map[int][]types.Trip      `json:"trips"`
+	Merged map[string]bool           `json:"merged,omitempty"`
+	Stash  []types.OBUState          `json:"stash,omitempty"`
+}
+
+// wholeDays checks that [from, to) starts and ends at midnight UTC. The
+// store keeps distance per UTC day, it can't tell what of a day was driven
+// before a time within it.
+func wholeDays(from, to time.Time) error {
+	if !from.Equal(time.Unix(dayOf(from), 0)) {
+		return errors.New("from must be midnight UTC, distance is kept per day")
+	}
+	if !to.Equal(time.Unix(dayOf(to), 0)) {
+		return errors.New("to must be midnight UTC, distance is kept per day")
+	}
+	return nil
+}
+
+func dayOf(t time.Time) int64 {
+	return t.UTC().Truncate(24 * time.Hour).Unix()
 }
 
 func (m *MemoryStore) Insert(d types.Distance) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	m.data[d.OBUID] += d.Value
+	if m.days[d.OBUID] == nil {
+		m.days[d.OBUID] = make(map[int64]float64)
+	}
+	m.days[d.OBUID][dayOf(time.Unix(0, d.Unix))] += d.Value
 	return nil
 }
 
+// GetRange sums the distance of the UTC days starting in [from, to).
+func (m *MemoryStore) GetRange(id int, from, to time.Time) (float64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if _, ok := m.data[id]; !ok {
+		return 0.0, fmt.Errorf("could not find distance for obu id %d", id)
+	}
+	var dist float64
+	for day, v := range m.days[id] {
+		if day >= from.Unix() && day < to.Unix() {
+			dist += v
+		}
+	}
+	return dist, nil
+}
+
 func (m *MemoryStore) Get(id int) (float64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 	dist, ok := m.data[id]
 	if !ok {
 		return 0.0, fmt.Errorf("could not find distance for obu id %d", id)
@@ -23,8 +87,208 @@ func (m *MemoryStore) Get(id int) (float64, error) {
 	return dist, nil
 }
 
+func (m *MemoryStore) InsertTrip(t types.Trip) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.trips[t.OBUID] = append(m.trips[t.OBUID], t)
+	return nil
+}
+
+func (m *MemoryStore) GetTrips(id int) ([]types.Trip, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	// hand out a copy, appends would otherwise race with the caller
+	return append([]types.Trip(nil), m.trips[id]...), nil
+}
+
+func (m *MemoryStore) IDs() ([]int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	ids := make([]int, 0, len(m.data))
+	for id := range m.data {
+		ids = append(ids, id)
+	}
+	for id := range m.trips {
+		if _, ok := m.data[id]; !ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+func (m *MemoryStore) Take(id int) (types.OBUState, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	state := types.OBUState{
+		OBUID:    id,
+		Distance: m.data[id],
+		Days:     m.days[id],
+		Trips:    m.trips[id],
+	}
+	delete(m.data, id)
+	delete(m.days, id)
+	delete(m.trips, id)
+	return state, nil
+}
+
+func (m *MemoryStore) Merge(state types.OBUState) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if state.TransferID != "" {
+		if m.merged[state.TransferID] {
+			return nil
+		}
+		m.merged[state.TransferID] = true
+	}
+	m.data[state.OBUID] += state.Distance
+	if len(state.Days) > 0 && m.days[state.OBUID] == nil {
+		m.days[state.OBUID] = make(map[int64]float64)
+	}
+	for day, v := range state.Days {
+		m.days[state.OBUID][day] += v
+	}
+	if len(state.Trips) > 0 {
+		m.trips[state.OBUID] = append(m.trips[state.OBUID], state.Trips...)
+	}
+	return nil
+}
+
+func (m *MemoryStore) Stash(state types.OBUState) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stash = append(m.stash, state)
+	return nil
+}
+
+func (m *MemoryStore) Unstash() ([]types.OBUState, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	states := m.stash
+	m.stash = nil
+	return states, nil
+}
+
+func (m *MemoryStore) Snapshot(w io.Writer) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return json.NewEncoder(w).Encode(memorySnapshot{
+		Data:   m.data,
+		Days:   m.days,
+		Trips:  m.trips,
+		Merged: m.merged,
+		Stash:  m.stash,
+	})
+}
+
+func (m *MemoryStore) Restore(r io.Reader) error {
+	var snap memorySnapshot
+	if err := json.NewDecoder(r).Decode(&snap); err != nil {
+		return err
+	}
+	if snap.Data == nil {
+		snap.Data = make(map[int]float64)
+	}
+	if snap.Days == nil {
+		snap.Days = make(map[int]map[int64]float64)
+	}
+	if snap.Trips == nil {
+		snap.Trips = make(map[int][]types.Trip)
+	}
+	if snap.Merged == nil {
+		snap.Merged = make(map[string]bool)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.data = snap.Data
+	m.days = snap.Days
+	m.trips = snap.Trips
+	m.merged = snap.Merged
+	m.stash = snap.Stash
+	return nil
+}
+
 func NewMemoryStore() *MemoryStore {
 	return &MemoryStore{
-		data: make(map[int]float64),
+		data:   make(map[int]float64),
+		days:   make(map[int]map[int64]float64),
+		trips:  make(map[int][]types.Trip),
+		merged: make(map[string]bool),
+	}
+}
+
+func (m *MemoryStore) TotalsByOBU(from, to time.Time) ([]types.OBUTotal, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	totals := make(map[int]*types.OBUTotal)
+	total := func(id int) *types.OBUTotal {
+		if totals[id] == nil {
+			totals[id] = &types.OBUTotal{OBUID: id}
+		}
+		return totals[id]
+	}
+	for id := range m.data {
+		var km float64
+		for day, v := range m.days[id] {
+			if day >= from.Unix() && day < to.Unix() {
+				km += v
+			}
+		}
+		total(id).Distance = geo.FromKm(km)
+	}
+	for id, trips := range m.trips {
+		t := total(id)
+		for _, trip := range trips {
+			if tripStartsIn(trip, from, to) {
+				t.Trips++
+			}
+		}
+	}
+
+	res := make([]types.OBUTotal, 0, len(totals))
+	for _, t := range totals {
+		res = append(res, *t)
 	}
+	sort.Slice(res, func(i, j int) bool { return res[i].OBUID < res[j].OBUID })
+	return res, nil
+}
+
+func (m *MemoryStore) TotalsByDay(from, to time.Time) ([]types.DayTotal, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var res []types.DayTotal
+	for id, days := range m.days {
+		for day, v := range days {
+			if day >= from.Unix() && day < to.Unix() {
+				res = append(res, types.DayTotal{Day: time.Unix(day, 0).UTC(), OBUID: id, Distance: v})
+			}
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if !res[i].Day.Equal(res[j].Day) {
+			return res[i].Day.Before(res[j].Day)
+		}
+		return res[i].OBUID < res[j].OBUID
+	})
+	return res, nil
+}
+
+func (m *MemoryStore) TripsBetween(from, to time.Time) ([]types.Trip, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var res []types.Trip
+	for _, trips := range m.trips {
+		for _, trip := range trips {
+			if tripStartsIn(trip, from, to) {
+				res = append(res, trip)
+			}
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].StartUnix < res[j].StartUnix })
+	return res, nil
+}
+
+func tripStartsIn(trip types.Trip, from, to time.Time) bool {
+	start := time.Unix(0, trip.StartUnix)
+	return !start.Before(from) && start.Before(to)
 }
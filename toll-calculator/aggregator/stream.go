@@ -0,0 +1,452 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/aggregator/client"
+	registry "github.com/tunangoo/full-time-go-dev/toll-calculator/registry/client"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/types"
+)
+
+var ErrStreamClosed = errors.New("stream closed")
+
+// how often an idle event stream is written to, so proxies keep it open
+const streamHeartbeat = 15 * time.Second
+
+// how long live updates price an OBU by the vehicle it was registered to,
+// or leave it unpriced if it wasn't, before asking the registry again. An
+// OBU that can't be priced is logged once as often.
+const streamLookupTTL = time.Minute
+
+// how long a node waits to stream the updates of a peer again after that
+// stream failed
+const streamRelayRetry = 5 * time.Second
+
+// StreamFilter picks the updates a subscriber gets, an empty filter gets
+// all of them.
+type StreamFilter struct {
+	OBUs    map[int]struct{}
+	Account string
+	// only the updates of the OBUs this node owns, not those relayed from
+	// the other nodes of the cluster, which stream them themselves
+	Local bool
+}
+
+func (f StreamFilter) match(u types.InvoiceUpdate, relayed bool) bool {
+	if f.Local && relayed {
+		return false
+	}
+	if len(f.OBUs) > 0 {
+		if _, ok := f.OBUs[u.Distance.OBUID]; !ok {
+			return false
+		}
+	}
+	return f.Account == "" || (u.Invoice != nil && u.Invoice.AccountID == f.Account)
+}
+
+type Subscription struct {
+	c      chan types.InvoiceUpdate
+	filter StreamFilter
+	// updates dropped since the last one delivered, guarded by the
+	// streamer's mu
+	dropped int
+}
+
+// Updates is closed once the subscription ends.
+func (s *Subscription) Updates() <-chan types.InvoiceUpdate {
+	return s.c
+}
+
+// Streamer pushes an update to every subscriber each time distance is
+// aggregated. Ingestion never waits for it: distance is queued and turned
+// into updates by a single goroutine, every subscriber has a buffer of its
+// own, and whatever doesn't fit in the queue or a buffer is dropped. In a
+// cluster the updates of the other nodes are relayed to the subscribers
+// too, see Cluster.RelayStreams.
+type Streamer struct {
+	mu     sync.Mutex
+	subs   map[*Subscription]struct{}
+	closed bool
+	// the account of every OBU an update was priced for, it matches the
+	// distance dropped from the queue to account filters
+	accounts map[int]string
+	// prices the running invoice of an update
+	invoices Aggregator
+	buffer   int
+	in       chan types.Distance
+	done     chan struct{}
+	// when the pricing error of an OBU was last logged, only touched by
+	// fanOut
+	logged map[int]time.Time
+}
+
+// NewStreamer returns a streamer that lets subscribers fall buffer updates
+// behind.
+func NewStreamer(invoices Aggregator, buffer int) *Streamer {
+	return &Streamer{
+		subs:     make(map[*Subscription]struct{}),
+		accounts: make(map[int]string),
+		invoices: invoices,
+		buffer:   buffer,
+		in:       make(chan types.Distance, 1024),
+		done:     make(chan struct{}),
+		logged:   make(map[int]time.Time),
+	}
+}
+
+func (s *Streamer) Subscribe(filter StreamFilter) (*Subscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, ErrStreamClosed
+	}
+	sub := &Subscription{
+		c:      make(chan types.InvoiceUpdate, s.buffer),
+		filter: filter,
+	}
+	s.subs[sub] = struct{}{}
+	return sub, nil
+}
+
+func (s *Streamer) Unsubscribe(sub *Subscription) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.subs[sub]; ok {
+		delete(s.subs, sub)
+		close(sub.c)
+	}
+}
+
+// Publish queues distance for the subscribers, it never blocks.
+func (s *Streamer) Publish(distance types.Distance) {
+	select {
+	case s.in <- distance:
+	default:
+		// the subscribers fall behind either way, better here than in
+		// ingestion. They are told with their next update.
+		s.drop(distance)
+	}
+}
+
+// drop counts distance as dropped for every subscriber it was for. Filters
+// by account only count the OBUs whose account is known from an earlier
+// update.
+func (s *Streamer) drop(distance types.Distance) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	update := types.InvoiceUpdate{Distance: distance}
+	if account, ok := s.accounts[distance.OBUID]; ok {
+		update.Invoice = &types.Invoice{AccountID: account}
+	}
+	for sub := range s.subs {
+		if sub.filter.match(update, false) {
+			sub.dropped++
+		}
+	}
+}
+
+// Start turns queued distance into updates until Close is called.
+func (s *Streamer) Start() error {
+	for {
+		select {
+		case distance := <-s.in:
+			s.fanOut(distance)
+		case <-s.done:
+			return nil
+		}
+	}
+}
+
+func (s *Streamer) fanOut(distance types.Distance) {
+	s.mu.Lock()
+	idle := len(s.subs) == 0
+	s.mu.Unlock()
+	if idle {
+		return
+	}
+
+	update := types.InvoiceUpdate{Distance: distance}
+	inv, err := s.invoices.CalculateInvoice(distance.OBUID)
+	if err != nil {
+		if last, ok := s.logged[distance.OBUID]; !ok || time.Since(last) >= streamLookupTTL {
+			logrus.WithField("obuID", distance.OBUID).Errorf("stream invoice error %s", err)
+			s.logged[distance.OBUID] = time.Now()
+		}
+	} else {
+		delete(s.logged, distance.OBUID)
+		inv.Trips = nil
+		update.Invoice = inv
+	}
+	s.deliver(update, false)
+}
+
+// Relay hands an update another node of the cluster priced to the
+// subscribers.
+func (s *Streamer) Relay(update types.InvoiceUpdate) {
+	s.deliver(update, true)
+}
+
+// deliver sends update to every subscriber it is for, the updates the
+// subscriber or a relayed update missed are counted in it.
+func (s *Streamer) deliver(update types.InvoiceUpdate, relayed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if update.Invoice != nil {
+		s.accounts[update.Distance.OBUID] = update.Invoice.AccountID
+	}
+	for sub := range s.subs {
+		if !sub.filter.match(update, relayed) {
+			continue
+		}
+		u := update
+		u.Dropped += sub.dropped
+		select {
+		case sub.c <- u:
+			sub.dropped = 0
+		default:
+			sub.dropped++
+		}
+	}
+}
+
+// Close ends every subscription, so the streams being served return.
+func (s *Streamer) Close(context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	for sub := range s.subs {
+		delete(s.subs, sub)
+		close(sub.c)
+	}
+	close(s.done)
+	return nil
+}
+
+// vehicleCache remembers the vehicles it looked up for ttl, and the OBUs
+// the registry doesn't know, live updates don't ask the registry for every
+// reading. Invoices are never priced with it, a vehicle may have changed
+// class since.
+type vehicleCache struct {
+	next VehicleLookup
+	ttl  time.Duration
+
+	mu   sync.Mutex
+	recs map[int]cachedRecord
+}
+
+type cachedRecord struct {
+	rec *types.OBURecord
+	// the OBU isn't registered if set
+	err     error
+	fetched time.Time
+}
+
+// newVehicleCache caches the lookups of next, a nil next stays nil.
+func newVehicleCache(next VehicleLookup, ttl time.Duration) VehicleLookup {
+	if next == nil {
+		return nil
+	}
+	return &vehicleCache{
+		next: next,
+		ttl:  ttl,
+		recs: make(map[int]cachedRecord),
+	}
+}
+
+func (c *vehicleCache) LookupOBU(obuID int, at time.Time) (*types.OBURecord, error) {
+	c.mu.Lock()
+	cached, ok := c.recs[obuID]
+	c.mu.Unlock()
+	if ok && time.Since(cached.fetched) < c.ttl {
+		if cached.err != nil {
+			return nil, cached.err
+		}
+		if cached.rec.Registration.ActiveAt(at) {
+			return cached.rec, nil
+		}
+	}
+	rec, err := c.next.LookupOBU(obuID, at)
+	if errors.Is(err, registry.ErrUnknownOBU) {
+		c.mu.Lock()
+		c.recs[obuID] = cachedRecord{err: err, fetched: time.Now()}
+		c.mu.Unlock()
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.recs[obuID] = cachedRecord{rec: rec, fetched: time.Now()}
+	c.mu.Unlock()
+	return rec, nil
+}
+
+// StreamMiddleware publishes the distance that was aggregated.
+type StreamMiddleware struct {
+	next     Aggregator
+	streamer *Streamer
+}
+
+func NewStreamMiddleware(streamer *Streamer, next Aggregator) Aggregator {
+	return &StreamMiddleware{
+		next:     next,
+		streamer: streamer,
+	}
+}
+
+func (m *StreamMiddleware) AggregateDistance(distance types.Distance) error {
+	if err := m.next.AggregateDistance(distance); err != nil {
+		return err
+	}
+	m.streamer.Publish(distance)
+	return nil
+}
+
+func (m *StreamMiddleware) AggregateTrip(trip types.Trip) error {
+	return m.next.AggregateTrip(trip)
+}
+
+func (m *StreamMiddleware) CalculateInvoice(obuID int) (*types.Invoice, error) {
+	return m.next.CalculateInvoice(obuID)
+}
+
+func (m *StreamMiddleware) CalculatePeriodInvoice(obuID int, from, to time.Time) (*types.Invoice, error) {
+	return m.next.CalculatePeriodInvoice(obuID, from, to)
+}
+
+// parseStreamFilter reads ?obu=, a comma separated list of OBU IDs, and
+// ?account=.
+func parseStreamFilter(r *http.Request) (StreamFilter, error) {
+	filter := StreamFilter{Account: r.URL.Query().Get("account")}
+	if obus := r.URL.Query().Get("obu"); obus != "" {
+		filter.OBUs = make(map[int]struct{})
+		for _, s := range strings.Split(obus, ",") {
+			id, err := strconv.Atoi(strings.TrimSpace(s))
+			if err != nil {
+				return StreamFilter{}, fmt.Errorf("invalid OBU ID %q", s)
+			}
+			filter.OBUs[id] = struct{}{}
+		}
+	}
+	return filter, nil
+}
+
+// handleStream serves updates as server-sent events. The other nodes of a
+// cluster only get the updates this node priced.
+func handleStream(s *Streamer, cluster *Cluster) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		filter, err := parseStreamFilter(r)
+		filter.Local = r.Header.Get(client.ForwardedHeader) != "" && cluster != nil && cluster.fromPeer(r)
+		if err != nil {
+			WriteJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			WriteJSON(w, http.StatusInternalServerError, map[string]string{"error": "streaming unsupported"})
+			return
+		}
+		sub, err := s.Subscribe(filter)
+		if err != nil {
+			WriteJSON(w, http.StatusServiceUnavailable, map[string]string{"error": err.Error()})
+			return
+		}
+		defer s.Unsubscribe(sub)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		heartbeat := time.NewTicker(streamHeartbeat)
+		defer heartbeat.Stop()
+		for {
+			select {
+			case u, ok := <-sub.Updates():
+				if !ok {
+					return
+				}
+				b, err := json.Marshal(u)
+				if err != nil {
+					continue
+				}
+				if _, err := fmt.Fprintf(w, "event: update\ndata: %s\n\n", b); err != nil {
+					return
+				}
+			case <-heartbeat.C:
+				if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+					return
+				}
+			case <-r.Context().Done():
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+var streamUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// handleStreamWS serves updates as JSON text frames.
+func handleStreamWS(s *Streamer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		filter, err := parseStreamFilter(r)
+		if err != nil {
+			WriteJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		sub, err := s.Subscribe(filter)
+		if err != nil {
+			WriteJSON(w, http.StatusServiceUnavailable, map[string]string{"error": err.Error()})
+			return
+		}
+		defer s.Unsubscribe(sub)
+		conn, err := streamUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		// the subscriber only ever sends a close frame, reading is what
+		// notices it
+		gone := make(chan struct{})
+		go func() {
+			defer close(gone)
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}()
+		for {
+			select {
+			case u, ok := <-sub.Updates():
+				if !ok {
+					msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "aggregator shutting down")
+					conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+					return
+				}
+				if err := conn.WriteJSON(u); err != nil {
+					return
+				}
+			case <-gone:
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/money"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/types"
+)
+
+// defaultPrices are the prices per kilometre of an aggregator without a
+// tariff file.
+var defaultPrices = map[types.VehicleClass]money.Price{
+	types.VehicleClassMotorcycle: money.MustParsePrice("1.575"),
+	types.VehicleClassCar:        money.MustParsePrice("3.15"),
+	types.VehicleClassBus:        money.MustParsePrice("6.30"),
+	types.VehicleClassTruck:      money.MustParsePrice("9.45"),
+	types.VehicleClassEmergency:  money.MustParsePrice("3.15"),
+}
+
+// Tariff is what driving a kilometre costs by the class of the vehicle, in
+// the currency of the tariff and before tax.
+type Tariff struct {
+	Currency string
+	Prices   map[types.VehicleClass]money.Price
+}
+
+// LoadTariff reads the prices of the tariff from a JSON object of vehicle
+// classes and prices, an empty path has the default prices. Every tariff
+// needs a car price, OBUs are priced as cars without a vehicle registry.
+func LoadTariff(path, currency string) (*Tariff, error) {
+	t := &Tariff{Currency: currency, Prices: defaultPrices}
+	if path == "" {
+		return t, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	t.Prices = nil
+	if err := json.Unmarshal(b, &t.Prices); err != nil {
+		return nil, fmt.Errorf("tariff %s: %w", path, err)
+	}
+	if _, ok := t.Prices[types.VehicleClassCar]; !ok {
+		return nil, fmt.Errorf("tariff %s: no price for vehicle class %q", path, types.VehicleClassCar)
+	}
+	return t, nil
+}
+
+// unitPrice is the price per kilometre of the OBU at, and the vehicle it
+// was installed in then. A nil vehicles prices every OBU as a car and
+// returns no record.
+func (t *Tariff) unitPrice(vehicles VehicleLookup, obuID int, at time.Time) (money.Price, *types.OBURecord, error) {
+	if vehicles == nil {
+		return t.Prices[types.VehicleClassCar], nil, nil
+	}
+	rec, err := vehicles.LookupOBU(obuID, at)
+	if err != nil {
+		return 0, nil, err
+	}
+	price, err := t.classPrice(rec)
+	if err != nil {
+		return 0, nil, err
+	}
+	return price, rec, nil
+}
+
+// classPrice is the price per kilometre of the vehicle of rec.
+func (t *Tariff) classPrice(rec *types.OBURecord) (money.Price, error) {
+	price, ok := t.Prices[rec.Vehicle.Class]
+	if !ok {
+		return 0, fmt.Errorf("no price for vehicle class %q", rec.Vehicle.Class)
+	}
+	return price, nil
+}
+
+// ExchangeRates are keyed by the pair of currencies they convert, "EUR/USD"
+// is how many USD a EUR is.
+type ExchangeRates map[string]money.Rate
+
+// LoadExchangeRates reads a JSON object of exchange rates, an empty path
+// has none.
+func LoadExchangeRates(path string) (ExchangeRates, error) {
+	if path == "" {
+		return nil, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rates ExchangeRates
+	if err := json.Unmarshal(b, &rates); err != nil {
+		return nil, fmt.Errorf("exchange rates %s: %w", path, err)
+	}
+	for pair, rate := range rates {
+		if rate <= 0 {
+			return nil, fmt.Errorf("exchange rates %s: %s must be positive", path, pair)
+		}
+	}
+	return rates, nil
+}
+
+// rate only uses the rate of the pair as given, inverting the rate of the
+// other direction wouldn't be exact.
+func (r ExchangeRates) rate(from, to string) (money.Rate, error) {
+	rate, ok := r[from+"/"+to]
+	if !ok {
+		return 0, fmt.Errorf("no exchange rate %s/%s", from, to)
+	}
+	return rate, nil
+}
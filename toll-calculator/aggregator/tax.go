@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/money"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/types"
+)
+
+// Taxes are the tax rules of every jurisdiction invoices can be taxed in.
+// A line can be taxed by several rules, the tax of the account's country
+// and the tax of the zone a trip started in. A nil *Taxes taxes nothing.
+type Taxes struct {
+	rules []types.TaxRule
+	zones []Zone
+}
+
+// LoadTaxes reads a JSON array of tax rules, an empty path has none. Rules
+// name either a country or one of zones.
+func LoadTaxes(path string, zones []Zone) (*Taxes, error) {
+	if path == "" {
+		return nil, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules []types.TaxRule
+	if err := json.Unmarshal(b, &rules); err != nil {
+		return nil, fmt.Errorf("taxes %s: %w", path, err)
+	}
+	for _, rule := range rules {
+		if err := validateTaxRule(rule, zones); err != nil {
+			return nil, fmt.Errorf("taxes %s: %s: %w", path, rule.Name, err)
+		}
+	}
+	return &Taxes{rules: rules, zones: zones}, nil
+}
+
+func validateTaxRule(rule types.TaxRule, zones []Zone) error {
+	if rule.Name == "" {
+		return errors.New("missing name")
+	}
+	if (rule.Country == "") == (rule.Zone == "") {
+		return errors.New("needs either a country or a zone")
+	}
+	if rule.Rate < 0 {
+		return errors.New("rate must not be negative")
+	}
+	if rule.Zone == "" || rule.Zone == ZoneOther {
+		return nil
+	}
+	for _, z := range zones {
+		if z.Name == rule.Zone {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown zone %q", rule.Zone)
+}
+
+// taxable is the amount of an invoice line before tax and where it was
+// driven, if that is known.
+type taxable struct {
+	amount    money.Amount
+	located   bool
+	lat, long float64
+}
+
+// spread spreads amount, what the discounts of an invoice take off, over
+// its lines pro rata, every share keeping the position of its line so it
+// lowers the taxes the line pays.
+func spread(amount money.Amount, lines []taxable) []taxable {
+	if amount == 0 {
+		return nil
+	}
+	weights := make([]money.Amount, len(lines))
+	var total money.Amount
+	for i, line := range lines {
+		weights[i] = line.amount
+		total += line.amount
+	}
+	if total == 0 {
+		return []taxable{{amount: amount}}
+	}
+	shares := make([]taxable, len(lines))
+	for i, share := range money.Allocate(amount, weights) {
+		shares[i] = lines[i]
+		shares[i].amount = share
+	}
+	return shares
+}
+
+// lower lowers every line by its share of amount, see spread.
+func lower(amount money.Amount, lines []taxable) []taxable {
+	shares := spread(amount, lines)
+	if len(shares) != len(lines) {
+		return append(lines, shares...)
+	}
+	for i := range lines {
+		lines[i].amount += shares[i].amount
+	}
+	return lines
+}
+
+// pricedLine is what an invoice line charges after discounts, and its
+// share of the taxes of the invoice.
+type pricedLine struct {
+	taxable
+	tax money.Amount
+}
+
+// apply taxes the lines of an invoice of an account of country. Every rule
+// covering any of the lines is a tax line, rounded on its own.
+func (t *Taxes) apply(country string, lines []taxable) []types.InvoiceTax {
+	if t == nil {
+		return nil
+	}
+	var taxes []types.InvoiceTax
+	for _, rule := range t.rules {
+		var (
+			base    money.Amount
+			covered bool
+		)
+		for _, line := range lines {
+			if t.covers(rule, country, line) {
+				base += line.amount
+				covered = true
+			}
+		}
+		if covered {
+			taxes = append(taxes, types.InvoiceTax{
+				TaxRule: rule,
+				Base:    base,
+				Amount:  rule.Rate.Of(base),
+			})
+		}
+	}
+	return taxes
+}
+
+// shares splits the taxes of an invoice of an account of country over the
+// lines they cover pro rata, so the taxes of the lines add up to those of
+// the invoice.
+func (t *Taxes) shares(country string, lines []taxable, taxes []types.InvoiceTax) []money.Amount {
+	res := make([]money.Amount, len(lines))
+	for _, tax := range taxes {
+		if tax.Amount == 0 || tax.Base == 0 {
+			continue
+		}
+		weights := make([]money.Amount, len(lines))
+		for i, line := range lines {
+			if t.covers(tax.TaxRule, country, line) {
+				weights[i] = line.amount
+			}
+		}
+		for i, share := range money.Allocate(tax.Amount, weights) {
+			res[i] += share
+		}
+	}
+	return res
+}
+
+// covers tells whether rule taxes line. Road usage outside of trips has no
+// position and is only taxed by country.
+func (t *Taxes) covers(rule types.TaxRule, country string, line taxable) bool {
+	if rule.Country != "" {
+		return rule.Country == country
+	}
+	return line.located && zoneOf(t.zones, line.lat, line.long) == rule.Zone
+}
+
+func totalTax(taxes []types.InvoiceTax) money.Amount {
+	var total money.Amount
+	for _, tax := range taxes {
+		total += tax.Amount
+	}
+	return total
+}
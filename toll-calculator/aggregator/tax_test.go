@@ -0,0 +1,193 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/money"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/types"
+)
+
+var testZones = []Zone{{Name: "center", MinLat: 52.3, MinLong: 4.8, MaxLat: 52.4, MaxLong: 4.95}}
+
+func testTaxes() *Taxes {
+	return &Taxes{
+		rules: []types.TaxRule{
+			{Name: "VAT", Country: "NL", Rate: 210_000},
+			{Name: "City levy", Zone: "center", Rate: 50_000},
+			{Name: "Road levy", Zone: ZoneOther, Rate: 10_000},
+		},
+		zones: testZones,
+	}
+}
+
+func TestTaxesApply(t *testing.T) {
+	var (
+		center  = taxable{amount: 1000, located: true, lat: 52.35, long: 4.9}
+		outside = taxable{amount: 500, located: true, lat: 51.9, long: 4.5}
+		between = taxable{amount: 300}
+	)
+	tests := []struct {
+		name    string
+		country string
+		lines   []taxable
+		want    map[string][2]money.Amount
+	}{
+		{
+			name:    "every rule",
+			country: "NL",
+			lines:   []taxable{center, outside, between},
+			want: map[string][2]money.Amount{
+				"VAT":       {1800, 378},
+				"City levy": {1000, 50},
+				"Road levy": {500, 5},
+			},
+		},
+		{
+			name:    "other country",
+			country: "DE",
+			lines:   []taxable{center, between},
+			want:    map[string][2]money.Amount{"City levy": {1000, 50}},
+		},
+		{
+			name:    "unlocated lines are only taxed by country",
+			country: "NL",
+			lines:   []taxable{between},
+			want:    map[string][2]money.Amount{"VAT": {300, 63}},
+		},
+		{
+			name:    "each tax line is rounded",
+			country: "NL",
+			lines:   []taxable{{amount: 3, located: true, lat: 52.35, long: 4.9}},
+			// 0.63 and 0.15
+			want: map[string][2]money.Amount{"VAT": {3, 1}, "City levy": {3, 0}},
+		},
+		{
+			name:    "no lines",
+			country: "NL",
+			want:    map[string][2]money.Amount{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			taxes := testTaxes().apply(tt.country, tt.lines)
+			if len(taxes) != len(tt.want) {
+				t.Fatalf("got %d tax lines %+v, want %d", len(taxes), taxes, len(tt.want))
+			}
+			for _, tax := range taxes {
+				want, ok := tt.want[tax.Name]
+				if !ok {
+					t.Errorf("unexpected tax line %s", tax.Name)
+					continue
+				}
+				if tax.Base != want[0] || tax.Amount != want[1] {
+					t.Errorf("%s: base %s tax %s, want base %s tax %s", tax.Name, tax.Base, tax.Amount, want[0], want[1])
+				}
+			}
+		})
+	}
+}
+
+func TestNilTaxes(t *testing.T) {
+	var taxes *Taxes
+	if got := taxes.apply("NL", []taxable{{amount: 1000}}); got != nil {
+		t.Errorf("nil taxes applied %+v", got)
+	}
+}
+
+func TestSpread(t *testing.T) {
+	lines := []taxable{
+		{amount: 3150, located: true, lat: 52.35, long: 4.9},
+		{amount: 1575},
+		{amount: 1},
+	}
+	tests := []struct {
+		amount money.Amount
+		want   []money.Amount
+	}{
+		{-4726, []money.Amount{-3150, -1575, -1}},
+		{-473, []money.Amount{-315, -158, 0}},
+		{473, []money.Amount{315, 158, 0}},
+		{-1, []money.Amount{-1, 0, 0}},
+	}
+	for _, tt := range tests {
+		shares := spread(tt.amount, lines)
+		if len(shares) != len(tt.want) {
+			t.Fatalf("spread(%s) = %+v, want amounts %v", tt.amount, shares, tt.want)
+		}
+		for i, share := range shares {
+			if share.amount != tt.want[i] {
+				t.Errorf("spread(%s) line %d = %s, want %s", tt.amount, i, share.amount, tt.want[i])
+			}
+			if share.located != lines[i].located || share.lat != lines[i].lat || share.long != lines[i].long {
+				t.Errorf("spread(%s) line %d lost its position", tt.amount, i)
+			}
+		}
+	}
+	if shares := spread(-100, nil); len(shares) != 1 || shares[0].amount != -100 || shares[0].located {
+		t.Errorf("spread over no charge = %+v, want one unlocated line", shares)
+	}
+}
+
+type emergencyLookup struct{}
+
+func (emergencyLookup) LookupOBU(obuID int, _ time.Time) (*types.OBURecord, error) {
+	return &types.OBURecord{
+		Vehicle: types.Vehicle{Plate: "AB-123-C", Class: types.VehicleClassEmergency},
+		Account: types.Account{ID: "acc", Country: "NL"},
+	}, nil
+}
+
+// TestDiscountsLowerZoneTaxes checks that discounts lower the taxes of the
+// zones the lines they lower were driven in, not only those of countries.
+func TestDiscountsLowerZoneTaxes(t *testing.T) {
+	var (
+		tariff = &Tariff{Currency: "EUR", Prices: defaultPrices}
+		// 10 km in the center, 5 km outside of trips
+		trips = []types.Trip{{OBUID: 1, StartLat: 52.35, StartLong: 4.9, Distance: 10}}
+		at    = time.Date(2026, 10, 19, 8, 0, 0, 0, time.UTC)
+	)
+	tests := []struct {
+		name  string
+		rules PricingRules
+		want  map[string][2]money.Amount
+	}{
+		{
+			name:  "exempt",
+			rules: PricingRules{exemptRule},
+			want: map[string][2]money.Amount{
+				"VAT":       {0, 0},
+				"City levy": {0, 0},
+			},
+		},
+		{
+			name:  "discount",
+			rules: PricingRules{{Name: "Discount", Kind: types.PricingDiscount, Rate: 100_000}},
+			// 47.25 less 4.73, of which 3.15 on the trip
+			want: map[string][2]money.Amount{
+				"VAT":       {4252, 893},
+				"City levy": {2835, 142},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			agg := &InvoiceAggregator{vehicles: emergencyLookup{}, tariff: tariff, rules: tt.rules, taxes: testTaxes()}
+			inv, _, err := agg.calculate(1, at, 15, trips, 0, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(inv.Taxes) != len(tt.want) {
+				t.Fatalf("got tax lines %+v, want %d", inv.Taxes, len(tt.want))
+			}
+			for _, tax := range inv.Taxes {
+				if want := tt.want[tax.Name]; tax.Base != want[0] || tax.Amount != want[1] {
+					t.Errorf("%s: base %s tax %s, want base %s tax %s", tax.Name, tax.Base, tax.Amount, want[0], want[1])
+				}
+			}
+			if inv.TotalGross != inv.TotalAmount+inv.TotalTax {
+				t.Errorf("gross %s is not net %s + tax %s", inv.TotalGross, inv.TotalAmount, inv.TotalTax)
+			}
+		})
+	}
+}
@@ -0,0 +1,221 @@
+package archive
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/types"
+)
+
+// Segments are partitioned per hour (UTC) of the reading timestamp and laid
+// out as <dir>/2006-01-02/15.ndjson.gz. Every time the hour is opened again
+// it gets a new segment, 15.1.ndjson.gz, 15.2.ndjson.gz and so on, rather
+// than appending to the old one: a writer that crashed never terminated
+// its gzip stream, and anything appended after it couldn't be read back.
+const segmentLayout = "2006-01-02/15"
+
+const (
+	// a segment nothing was written to for this long is closed on Flush,
+	// late readings of its hour open a new one
+	segmentIdle = 10 * time.Minute
+	// at most this many segments are open, a new one closes the one
+	// written to least recently
+	maxSegments = 8
+)
+
+func segmentPath(dir string, t time.Time, seq int) string {
+	name := t.UTC().Format(segmentLayout)
+	if seq > 0 {
+		name += fmt.Sprintf(".%d", seq)
+	}
+	return filepath.Join(dir, name+".ndjson.gz")
+}
+
+type segment struct {
+	file *os.File
+	gz   *gzip.Writer
+	enc  *json.Encoder
+	// when the segment was last written to
+	last time.Time
+}
+
+func (s *segment) close() error {
+	return errors.Join(s.gz.Close(), s.file.Close())
+}
+
+// Writer keeps a segment open for every hour it was written to recently,
+// so readings arriving late or out of order go to the segment of their
+// hour. What is written is only on disk once Flush or Close returned.
+type Writer struct {
+	mu  sync.Mutex
+	dir string
+	// the open segments by the path of the first segment of their hour
+	segments map[string]*segment
+}
+
+func NewWriter(dir string) *Writer {
+	return &Writer{
+		dir:      dir,
+		segments: make(map[string]*segment),
+	}
+}
+
+func (w *Writer) Write(data types.OBUdata) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	t := time.Unix(0, data.Unix)
+	hour := segmentPath(w.dir, t, 0)
+	s, ok := w.segments[hour]
+	if !ok {
+		if len(w.segments) >= maxSegments {
+			if err := w.closeOldest(); err != nil {
+				return err
+			}
+		}
+		var err error
+		if s, err = w.open(t); err != nil {
+			return err
+		}
+		w.segments[hour] = s
+	}
+	if err := s.enc.Encode(data); err != nil {
+		// what follows a failed write can't be trusted to read back, the
+		// next reading of the hour gets a new segment
+		delete(w.segments, hour)
+		return errors.Join(err, s.close())
+	}
+	s.last = time.Now()
+	return nil
+}
+
+// Flush writes what was buffered to disk and closes the segments that were
+// idle for a while.
+func (w *Writer) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var errs []error
+	for hour, s := range w.segments {
+		if time.Since(s.last) > segmentIdle {
+			delete(w.segments, hour)
+			errs = append(errs, s.close())
+			continue
+		}
+		if err := s.gz.Flush(); err != nil {
+			delete(w.segments, hour)
+			errs = append(errs, err, s.close())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var errs []error
+	for hour, s := range w.segments {
+		delete(w.segments, hour)
+		errs = append(errs, s.close())
+	}
+	return errors.Join(errs...)
+}
+
+func (w *Writer) closeOldest() error {
+	var oldest string
+	for hour, s := range w.segments {
+		if oldest == "" || s.last.Before(w.segments[oldest].last) {
+			oldest = hour
+		}
+	}
+	s := w.segments[oldest]
+	delete(w.segments, oldest)
+	return s.close()
+}
+
+// open creates the next segment of the hour of t.
+func (w *Writer) open(t time.Time) (*segment, error) {
+	if err := os.MkdirAll(filepath.Dir(segmentPath(w.dir, t, 0)), 0o755); err != nil {
+		return nil, err
+	}
+	var (
+		f   *os.File
+		err error
+	)
+	for seq := 0; ; seq++ {
+		f, err = os.OpenFile(segmentPath(w.dir, t, seq), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+		if !errors.Is(err, os.ErrExist) {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	gz := gzip.NewWriter(f)
+	return &segment{file: f, gz: gz, enc: json.NewEncoder(gz)}, nil
+}
+
+// Read streams every archived reading with a timestamp in [from, to) to fn,
+// segment by segment in chronological order.
+func Read(dir string, from, to time.Time, fn func(types.OBUdata) error) error {
+	for t := from.UTC().Truncate(time.Hour); t.Before(to); t = t.Add(time.Hour) {
+		// the segments of an hour are numbered without gaps
+		for seq := 0; ; seq++ {
+			f, err := os.Open(segmentPath(dir, t, seq))
+			if errors.Is(err, os.ErrNotExist) {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			err = readSegment(f, from, to, fn)
+			f.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func readSegment(f *os.File, from, to time.Time, fn func(types.OBUdata) error) error {
+	path := f.Name()
+
+	gz, err := gzip.NewReader(bufio.NewReader(f))
+	if err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF) {
+		// the writer crashed before it wrote anything
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("segment %s: %w", path, err)
+	}
+	defer gz.Close()
+
+	dec := json.NewDecoder(gz)
+	for {
+		var data types.OBUdata
+		err := dec.Decode(&data)
+		if err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF) {
+			// a segment cut short by a crash still yields what was flushed
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("segment %s: %w", path, err)
+		}
+		if data.Unix < from.UnixNano() || data.Unix >= to.UnixNano() {
+			continue
+		}
+		if err := fn(data); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package archive
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/types"
+)
+
+// crash drops the writer the way a killed process does: what was flushed
+// is on disk, the gzip stream is never terminated.
+func crash(t *testing.T, w *Writer) {
+	t.Helper()
+	for _, s := range w.segments {
+		if err := s.file.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func readAll(t *testing.T, dir string, from, to time.Time) []types.OBUdata {
+	t.Helper()
+	var got []types.OBUdata
+	err := Read(dir, from, to, func(data types.OBUdata) error {
+		got = append(got, data)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestReopenAfterCrash(t *testing.T) {
+	var (
+		dir  = t.TempDir()
+		hour = time.Date(2026, 10, 19, 14, 0, 0, 0, time.UTC)
+	)
+	reading := func(obuID int, at time.Duration) types.OBUdata {
+		return types.OBUdata{OBUID: obuID, Lat: 52.37, Long: 4.89, Unix: hour.Add(at).UnixNano()}
+	}
+
+	w := NewWriter(dir)
+	for i := range 3 {
+		if err := w.Write(reading(1, time.Duration(i)*time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	crash(t, w)
+
+	// a writer that crashed before writing anything leaves an empty segment
+	w = NewWriter(dir)
+	s, err := w.open(hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.segments["empty"] = s
+	crash(t, w)
+
+	w = NewWriter(dir)
+	for i := range 2 {
+		if err := w.Write(reading(2, time.Duration(10+i)*time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"14.ndjson.gz", "14.1.ndjson.gz", "14.2.ndjson.gz"} {
+		if _, err := os.Stat(filepath.Join(dir, "2026-10-19", name)); err != nil {
+			t.Errorf("segment %s: %s", name, err)
+		}
+	}
+
+	got := readAll(t, dir, hour, hour.Add(time.Hour))
+	if len(got) != 5 {
+		t.Fatalf("read %d readings, want 5: %+v", len(got), got)
+	}
+	for i, want := range []int{1, 1, 1, 2, 2} {
+		if got[i].OBUID != want {
+			t.Errorf("reading %d is of OBU %d, want %d", i, got[i].OBUID, want)
+		}
+	}
+
+	// the range still filters within the segments
+	if got := readAll(t, dir, hour.Add(time.Minute), hour.Add(11*time.Minute)); len(got) != 3 {
+		t.Errorf("read %d readings in range, want 3", len(got))
+	}
+}
+
+func TestInterleavedHours(t *testing.T) {
+	var (
+		dir  = t.TempDir()
+		hour = time.Date(2026, 10, 19, 14, 0, 0, 0, time.UTC)
+		w    = NewWriter(dir)
+	)
+	// live readings of 15:00 mixed with a batch upload of 14:00
+	for i := range 10 {
+		at := hour.Add(time.Hour + time.Duration(i)*time.Minute)
+		if i%2 == 1 {
+			at = hour.Add(time.Duration(i) * time.Minute)
+		}
+		if err := w.Write(types.OBUdata{OBUID: i, Unix: at.UnixNano()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	segments, err := filepath.Glob(filepath.Join(dir, "2026-10-19", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 2 {
+		t.Fatalf("wrote segments %v, want one per hour", segments)
+	}
+	got := readAll(t, dir, hour, hour.Add(2*time.Hour))
+	for i, want := range []int{1, 3, 5, 7, 9, 0, 2, 4, 6, 8} {
+		if i >= len(got) || got[i].OBUID != want {
+			t.Fatalf("read OBUs %+v, want %v", got, []int{1, 3, 5, 7, 9, 0, 2, 4, 6, 8})
+		}
+	}
+}
+
+func TestTooManyHours(t *testing.T) {
+	var (
+		dir  = t.TempDir()
+		hour = time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC)
+		w    = NewWriter(dir)
+	)
+	for i := range maxSegments + 1 {
+		if err := w.Write(types.OBUdata{OBUID: i, Unix: hour.Add(time.Duration(i) * time.Hour).UnixNano()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(w.segments) != maxSegments {
+		t.Errorf("%d segments open, want %d", len(w.segments), maxSegments)
+	}
+	// the first hour was closed, it is reopened as a new segment
+	if err := w.Write(types.OBUdata{OBUID: 100, Unix: hour.UnixNano()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "2026-10-19", "00.1.ndjson.gz")); err != nil {
+		t.Error(err)
+	}
+	if got := readAll(t, dir, hour, hour.Add(time.Hour)); len(got) != 2 {
+		t.Errorf("read %d readings of the first hour, want 2", len(got))
+	}
+}
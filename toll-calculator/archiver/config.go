@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/config"
+)
+
+type Config struct {
+	Kafka           config.Kafka  `yaml:"kafka"`
+	SchemaRegistry  string        `yaml:"schemaRegistry" usage:"the schema registry file"`
+	ListenAddr      string        `yaml:"listenAddr" usage:"the listen address of the health endpoints"`
+	Dir             string        `yaml:"dir" usage:"the directory the segment files are written to"`
+	FlushInterval   time.Duration `yaml:"flushInterval" usage:"how often the segments are flushed to disk and the offsets of what they hold committed"`
+	ShutdownTimeout time.Duration `yaml:"shutdownTimeout" usage:"how long the service gets to stop on SIGTERM"`
+}
+
+func NewConfig() *Config {
+	return &Config{
+		Kafka: config.Kafka{
+			Brokers: "localhost",
+			Topic:   "obuData",
+			GroupID: "archiver",
+		},
+		SchemaRegistry:  "./schemas/registry.json",
+		ListenAddr:      ":3002",
+		Dir:             "./data/archive",
+		FlushInterval:   5 * time.Second,
+		ShutdownTimeout: 10 * time.Second,
+	}
+}
+
+func (c *Config) Validate() error {
+	if err := c.Kafka.Validate(); err != nil {
+		return err
+	}
+	if c.Kafka.GroupID == "" {
+		return errors.New("kafka.groupID is required")
+	}
+	if c.ListenAddr == "" {
+		return errors.New("listenAddr is required")
+	}
+	if c.Dir == "" {
+		return errors.New("dir is required")
+	}
+	if c.FlushInterval <= 0 {
+		return errors.New("flushInterval must be positive")
+	}
+	if c.ShutdownTimeout <= 0 {
+		return errors.New("shutdownTimeout must be positive")
+	}
+	return nil
+}
+
+// VerifyConfig is the configuration of the verify subcommand.
+type VerifyConfig struct {
+	Dir        string `yaml:"dir" usage:"the archive directory"`
+	From       string `yaml:"from" usage:"start of the range (RFC3339), inclusive"`
+	To         string `yaml:"to" usage:"end of the range (RFC3339), exclusive"`
+	Secret     string `yaml:"secret" secret:"true" usage:"the device secret HMAC signatures are keyed with"`
+	PublicKeys string `yaml:"publicKeys" usage:"JSON object of OBU ID to base64 Ed25519 public key"`
+}
+
+func NewVerifyConfig() *VerifyConfig {
+	return &VerifyConfig{
+		Dir: "./data/archive",
+	}
+}
+
+func (c *VerifyConfig) Validate() error {
+	if c.From == "" || c.To == "" {
+		return errors.New("from and to are required")
+	}
+	return nil
+}
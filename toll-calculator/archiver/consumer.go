@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/sirupsen/logrus"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/archive"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/config"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/schema"
+)
+
+type KafkaConsumer struct {
+	consumer  *kafka.Consumer
+	topic     string
+	isRunning atomic.Bool
+	// closed once the read loop finished the message it was on
+	done     chan struct{}
+	registry *schema.Registry
+	writer   *archive.Writer
+	// how often the archive is flushed and the offsets of what it holds
+	// committed
+	flushInterval time.Duration
+}
+
+func NewKafkaConsumer(cfg config.Kafka, registry *schema.Registry, w *archive.Writer, flushInterval time.Duration) (*KafkaConsumer, error) {
+	c, err := kafka.NewConsumer(&kafka.ConfigMap{
+		"bootstrap.servers": cfg.Brokers,
+		"group.id":          cfg.GroupID,
+		"auto.offset.reset": "earliest",
+		// offsets are stored once a reading was archived, and committed
+		// once the archive was flushed, so a restart doesn't skip what
+		// was still buffered
+		"enable.auto.offset.store": false,
+		"enable.auto.commit":       false,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.SubscribeTopics([]string{cfg.Topic}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &KafkaConsumer{
+		consumer: c,
+		topic:    cfg.Topic,
+		done:     make(chan struct{}),
+		registry: registry,
+		writer:   w,
+
+		flushInterval: flushInterval,
+	}, nil
+}
+
+// Start consumes until Stop is called.
+func (c *KafkaConsumer) Start() error {
+	logrus.Info("kafka archiver started")
+	c.isRunning.Store(true)
+	defer close(c.done)
+	c.readMessageLoop()
+	return nil
+}
+
+// Stop lets the reading in flight be archived, flushes the archive, commits
+// the offsets and leaves the consumer group.
+func (c *KafkaConsumer) Stop(ctx context.Context) error {
+	c.isRunning.Store(false)
+	select {
+	case <-c.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	c.flush()
+	return c.consumer.Close()
+}
+
+func (c *KafkaConsumer) readMessageLoop() {
+	lastFlush := time.Now()
+	for c.isRunning.Load() {
+		if time.Since(lastFlush) >= c.flushInterval {
+			c.flush()
+			lastFlush = time.Now()
+		}
+		msg, err := c.consumer.ReadMessage(time.Second)
+		if err != nil {
+			if kerr, ok := err.(kafka.Error); !ok || !kerr.IsTimeout() {
+				logrus.Errorf("Kafka consume error %s", err)
+			}
+			continue
+		}
+		if err := c.handleMessage(msg); err != nil {
+			// the segment the reading went to is closed, with what it had
+			// buffered since the last commit
+			logrus.Errorf("archive write error %s, reading again from the last commit", err)
+			c.rewind()
+			time.Sleep(time.Second)
+			continue
+		}
+		if _, err := c.consumer.StoreMessage(msg); err != nil {
+			logrus.Errorf("kafka offset store error %s", err)
+		}
+	}
+}
+
+// handleMessage fails if the reading couldn't be archived. Readings that
+// can't be decoded are skipped, reading them again wouldn't help.
+func (c *KafkaConsumer) handleMessage(msg *kafka.Message) error {
+	data, _, err := schema.Decode(c.registry, msg.Value)
+	if err != nil {
+		logrus.Errorf("schema decode error %s", err)
+		return nil
+	}
+	if data.Unix == 0 {
+		data.Unix = msg.Timestamp.UnixNano()
+	}
+	return c.writer.Write(data)
+}
+
+// flush flushes the archive and commits the offsets of what it holds. If
+// the flush fails, what was buffered since the last commit is read again.
+func (c *KafkaConsumer) flush() {
+	if err := c.writer.Flush(); err != nil {
+		logrus.Errorf("archive flush error %s, reading again from the last commit", err)
+		c.rewind()
+		return
+	}
+	if _, err := c.consumer.Commit(); err != nil {
+		// nothing was consumed since the last commit
+		if kerr, ok := err.(kafka.Error); !ok || kerr.Code() != kafka.ErrNoOffset {
+			logrus.Errorf("kafka commit error %s", err)
+		}
+	}
+}
+
+// rewind seeks every assigned partition back to its committed offset.
+func (c *KafkaConsumer) rewind() {
+	assigned, err := c.consumer.Assignment()
+	if err != nil {
+		logrus.Errorf("kafka assignment error %s", err)
+		return
+	}
+	committed, err := c.consumer.Committed(assigned, 5000)
+	if err != nil {
+		logrus.Errorf("kafka committed offsets error %s", err)
+		return
+	}
+	for i, tp := range committed {
+		// never committed, start over like a new consumer group would
+		if tp.Offset < 0 {
+			committed[i].Offset = kafka.OffsetBeginning
+		}
+		if err := c.consumer.Seek(committed[i], 0); err != nil {
+			logrus.Errorf("kafka seek error %s", err)
+		}
+	}
+	if _, err := c.consumer.StoreOffsets(committed); err != nil {
+		logrus.Errorf("kafka offset store error %s", err)
+	}
+}
+
+// Ready checks that the brokers answer and the consumer was assigned
+// partitions of the topic.
+func (c *KafkaConsumer) Ready(ctx context.Context) error {
+	timeout := 5 * time.Second
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+	if _, err := c.consumer.GetMetadata(&c.topic, false, int(timeout.Milliseconds())); err != nil {
+		return err
+	}
+	assigned, err := c.consumer.Assignment()
+	if err != nil {
+		return err
+	}
+	if len(assigned) == 0 {
+		return errors.New("no partitions assigned")
+	}
+	return nil
+}
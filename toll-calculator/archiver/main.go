@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/archive"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/config"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/health"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/run"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/schema"
+)
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		if err := runVerify(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	cfg := NewConfig()
+	config.MustLoad("archiver", cfg)
+
+	registry, err := schema.LoadRegistry(cfg.SchemaRegistry)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	w := archive.NewWriter(cfg.Dir)
+	kafkaConsumer, err := NewKafkaConsumer(cfg.Kafka, registry, w, cfg.FlushInterval)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	checks := health.New()
+	checks.Add("kafka", kafkaConsumer.Ready)
+	checks.Add("archive", health.Writable(cfg.Dir))
+	checks.Register(http.DefaultServeMux)
+
+	g := run.New(cfg.ShutdownTimeout)
+	g.AddStop("archive writer", func(context.Context) error {
+		return w.Close()
+	})
+	g.Add("kafka consumer", kafkaConsumer.Start, kafkaConsumer.Stop)
+	g.AddHTTPServer(&http.Server{Addr: cfg.ListenAddr})
+	if err := g.Run(); err != nil {
+		log.Fatal(err)
+	}
+}
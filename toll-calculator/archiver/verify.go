@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/archive"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/config"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/device"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/types"
+)
+
+// runVerify re-verifies the signatures of an archived range of readings and
+// prints every reading that fails.
+func runVerify(args []string) error {
+	cfg := NewVerifyConfig()
+	if err := config.Load("archiver", cfg, args); err != nil {
+		return err
+	}
+	from, err := time.Parse(time.RFC3339, cfg.From)
+	if err != nil {
+		return err
+	}
+	to, err := time.Parse(time.RFC3339, cfg.To)
+	if err != nil {
+		return err
+	}
+	publicKeys, err := device.LoadPublicKeys(cfg.PublicKeys)
+	if err != nil {
+		return err
+	}
+
+	var (
+		verifier                 = device.NewVerifier([]byte(cfg.Secret), publicKeys)
+		valid, unsigned, invalid int
+	)
+	err = archive.Read(cfg.Dir, from, to, func(data types.OBUdata) error {
+		err := verifier.Verify(data)
+		switch {
+		case err == nil:
+			valid++
+		case errors.Is(err, device.ErrUnsigned):
+			unsigned++
+		default:
+			invalid++
+			fmt.Printf("obu %d at %s: %s\n", data.OBUID, time.Unix(0, data.Unix).UTC().Format(time.RFC3339Nano), err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("valid %d, unsigned %d, invalid %d\n", valid, unsigned, invalid)
+	return nil
+}
@@ -0,0 +1,327 @@
+// Package config loads the configuration of a toll-calculator service from,
+// in increasing order of precedence, the defaults the service sets, an
+// optional YAML file, environment variables and command line flags.
+//
+// A configuration is a struct, every exported field is a setting. The yaml
+// tag names the setting in the YAML file, the environment variable is the
+// service name and the yaml name in upper snake case, listenAddr of the
+// aggregator is AGGREGATOR_LISTEN_ADDR, a run of capitals is one word, so
+// groupID is GROUP_ID. The flag is the yaml name in lower case unless the
+// flag tag says otherwise, usage is its help text. Nested structs group
+// settings, their names are joined with "." for flags and "_" for
+// environment variables. Fields tagged secret:"true" are masked when the
+// configuration is printed, they are strings, or slices or maps of them.
+//
+// The YAML file is given with -config or <SERVICE>_CONFIG.
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Validator is implemented by configurations that can be wrong.
+type Validator interface {
+	Validate() error
+}
+
+// MustLoad loads cfg from the command line of the process and prints the
+// effective configuration. It exits if that fails.
+func MustLoad(service string, cfg any) {
+	err := Load(service, cfg, os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		log.Fatalf("%s config: %s", service, err)
+	}
+	fmt.Fprintf(os.Stderr, "%s config:\n", service)
+	if err := Print(os.Stderr, cfg); err != nil {
+		log.Fatalf("%s config: %s", service, err)
+	}
+}
+
+// Load loads the configuration into cfg, a pointer to a struct holding the
+// defaults, and validates it.
+func Load(service string, cfg any, args []string) error {
+	root := reflect.ValueOf(cfg)
+	if root.Kind() != reflect.Pointer || root.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("config must be a pointer to a struct, not %T", cfg)
+	}
+	prefix := strings.ToUpper(service) + "_"
+
+	var settings []setting
+	collect(root.Elem(), "", "", &settings)
+
+	fs := flag.NewFlagSet(service, flag.ContinueOnError)
+	path := fs.String("config", os.Getenv(prefix+"CONFIG"), "the YAML file to load the configuration from")
+	for _, s := range settings {
+		fs.Var(s, s.flag, s.usage)
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	// flags win over the file and the environment, remember them to set
+	// them again once those are loaded
+	given := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		given[f.Name] = f.Value.String()
+	})
+
+	if *path != "" {
+		b, err := os.ReadFile(*path)
+		if err != nil {
+			return err
+		}
+		if err := yaml.Unmarshal(b, cfg); err != nil {
+			return fmt.Errorf("%s: %w", *path, err)
+		}
+	}
+	for _, s := range settings {
+		if v, ok := os.LookupEnv(prefix + s.env); ok {
+			if err := s.Set(v); err != nil {
+				return fmt.Errorf("%s%s: %w", prefix, s.env, err)
+			}
+		}
+	}
+	for name, v := range given {
+		if name != "config" {
+			fs.Set(name, v)
+		}
+	}
+
+	if v, ok := cfg.(Validator); ok {
+		return v.Validate()
+	}
+	return nil
+}
+
+// Print writes cfg as YAML, with secrets masked.
+func Print(w io.Writer, cfg any) error {
+	v := reflect.New(reflect.TypeOf(cfg).Elem())
+	v.Elem().Set(reflect.ValueOf(cfg).Elem())
+	if err := mask(v.Elem()); err != nil {
+		return err
+	}
+	b, err := yaml.Marshal(v.Interface())
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// mask masks the secrets of v, a copy of the configuration. Slices and maps
+// are still shared with the configuration, they are replaced rather than
+// masked in place.
+func mask(v reflect.Value) error {
+	for i := 0; i < v.NumField(); i++ {
+		field, f := v.Type().Field(i), v.Field(i)
+		switch {
+		case !field.IsExported():
+		case f.Kind() == reflect.Struct:
+			if err := mask(f); err != nil {
+				return err
+			}
+		case field.Tag.Get("secret") == "true":
+			m, err := masked(f)
+			if err != nil {
+				return fmt.Errorf("%s: %w", field.Name, err)
+			}
+			f.Set(m)
+		}
+	}
+	return nil
+}
+
+// masked returns v with every non empty string in it replaced by "***".
+func masked(v reflect.Value) (reflect.Value, error) {
+	switch v.Kind() {
+	case reflect.String:
+		if v.String() == "" {
+			return v, nil
+		}
+		return reflect.ValueOf("***").Convert(v.Type()), nil
+	case reflect.Slice:
+		if v.IsNil() {
+			return v, nil
+		}
+		s := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			m, err := masked(v.Index(i))
+			if err != nil {
+				return v, err
+			}
+			s.Index(i).Set(m)
+		}
+		return s, nil
+	case reflect.Map:
+		if v.IsNil() {
+			return v, nil
+		}
+		mp := reflect.MakeMapWithSize(v.Type(), v.Len())
+		for it := v.MapRange(); it.Next(); {
+			m, err := masked(it.Value())
+			if err != nil {
+				return v, err
+			}
+			mp.SetMapIndex(it.Key(), m)
+		}
+		return mp, nil
+	}
+	return v, fmt.Errorf("secrets of type %s can't be masked", v.Type())
+}
+
+// setting is a single field of the configuration, it is the flag.Value of
+// its flag too.
+type setting struct {
+	v     reflect.Value
+	flag  string
+	env   string
+	usage string
+}
+
+func collect(v reflect.Value, flagPrefix, envPrefix string, settings *[]setting) {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		flagName := field.Tag.Get("flag")
+		if flagName == "" {
+			flagName = strings.ToLower(name)
+		}
+		flagName = flagPrefix + flagName
+		envName := envPrefix + envCase(name)
+
+		if field.Type.Kind() == reflect.Struct {
+			collect(v.Field(i), flagName+".", envName+"_", settings)
+			continue
+		}
+		*settings = append(*settings, setting{
+			v:     v.Field(i),
+			flag:  flagName,
+			env:   envName,
+			usage: field.Tag.Get("usage"),
+		})
+	}
+}
+
+// envCase turns listenAddr into LISTEN_ADDR. A run of capitals is a word of
+// its own, groupID is GROUP_ID and httpAPIAddr HTTP_API_ADDR: a capital
+// starts a word after a lower case letter or a digit, and within a run of
+// capitals the last one starts a word if a lower case letter follows it.
+// A lone s is the plural of the run, knownOBUs is KNOWN_OBUS.
+func envCase(name string) string {
+	var (
+		b     strings.Builder
+		runes = []rune(name)
+	)
+	lower := func(i int) bool {
+		return i < len(runes) && unicode.IsLower(runes[i])
+	}
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) {
+			plural := i+1 < len(runes) && runes[i+1] == 's' && !lower(i+2)
+			if !unicode.IsUpper(runes[i-1]) || lower(i+1) && !plural {
+				b.WriteByte('_')
+			}
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+func (s setting) Set(str string) error {
+	switch {
+	case s.v.Type() == durationType:
+		d, err := time.ParseDuration(str)
+		if err != nil {
+			return err
+		}
+		s.v.SetInt(int64(d))
+	case s.v.Kind() == reflect.String:
+		s.v.SetString(str)
+	case s.v.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(str)
+		if err != nil {
+			return err
+		}
+		s.v.SetBool(b)
+	case s.v.Kind() == reflect.Int:
+		n, err := strconv.Atoi(str)
+		if err != nil {
+			return err
+		}
+		s.v.SetInt(int64(n))
+	case s.v.Kind() == reflect.Float64:
+		f, err := strconv.ParseFloat(str, 64)
+		if err != nil {
+			return err
+		}
+		s.v.SetFloat(f)
+	case s.v.Kind() == reflect.Slice && s.v.Type().Elem().Kind() == reflect.String:
+		var list []string
+		if str != "" {
+			list = strings.Split(str, ",")
+		}
+		s.v.Set(reflect.ValueOf(list))
+	default:
+		return fmt.Errorf("settings of type %s are not supported", s.v.Type())
+	}
+	return nil
+}
+
+func (s setting) String() string {
+	if !s.v.IsValid() {
+		return ""
+	}
+	switch {
+	case s.v.Type() == durationType:
+		return time.Duration(s.v.Int()).String()
+	case s.v.Kind() == reflect.Slice:
+		return strings.Join(s.v.Interface().([]string), ",")
+	}
+	return fmt.Sprint(s.v.Interface())
+}
+
+// IsBoolFlag lets boolean settings be given as -flag instead of -flag=true.
+func (s setting) IsBoolFlag() bool {
+	return s.v.IsValid() && s.v.Kind() == reflect.Bool
+}
+
+// Kafka is the part of the configuration shared by every service talking
+// to kafka.
+type Kafka struct {
+	Brokers string `yaml:"brokers" usage:"the kafka bootstrap servers"`
+	Topic   string `yaml:"topic" usage:"the topic OBU readings are produced to"`
+	// empty for producers
+	GroupID string `yaml:"groupID,omitempty" flag:"group" usage:"the consumer group"`
+}
+
+func (k Kafka) Validate() error {
+	if k.Brokers == "" {
+		return errors.New("kafka.brokers is required")
+	}
+	if k.Topic == "" {
+		return errors.New("kafka.topic is required")
+	}
+	return nil
+}
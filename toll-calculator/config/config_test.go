@@ -0,0 +1,117 @@
+package config
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEnvCase(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"listenAddr", "LISTEN_ADDR"},
+		{"brokers", "BROKERS"},
+		{"groupID", "GROUP_ID"},
+		{"knownOBUs", "KNOWN_OBUS"},
+		{"knownOBUsFile", "KNOWN_OBUS_FILE"},
+		{"maxKeys", "MAX_KEYS"},
+		{"URLs", "URLS"},
+		{"httpAPIAddr", "HTTP_API_ADDR"},
+		{"OBUCount", "OBU_COUNT"},
+		{"lowBalanceWebhook", "LOW_BALANCE_WEBHOOK"},
+		{"tls12Only", "TLS12_ONLY"},
+		{"ID", "ID"},
+	}
+	for _, tt := range tests {
+		if got := envCase(tt.name); got != tt.want {
+			t.Errorf("envCase(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+type testConfig struct {
+	ListenAddr string        `yaml:"listenAddr"`
+	Timeout    time.Duration `yaml:"timeout"`
+	Retries    int           `yaml:"retries"`
+	Debug      bool          `yaml:"debug"`
+	Kafka      Kafka         `yaml:"kafka"`
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.yaml")
+	yaml := "listenAddr: :2000\ntimeout: 2s\nretries: 2\nkafka:\n  brokers: yaml:9092\n  groupID: yaml\n"
+	if err := os.WriteFile(path, []byte(yaml), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TEST_CONFIG", path)
+	t.Setenv("TEST_TIMEOUT", "3s")
+	t.Setenv("TEST_RETRIES", "3")
+	t.Setenv("TEST_KAFKA_GROUP_ID", "env")
+
+	cfg := &testConfig{ListenAddr: ":1000", Timeout: time.Second, Retries: 1, Kafka: Kafka{Topic: "default"}}
+	if err := Load("test", cfg, []string{"-retries", "4", "-debug"}); err != nil {
+		t.Fatal(err)
+	}
+	want := testConfig{
+		ListenAddr: ":2000",         // yaml over the default
+		Timeout:    3 * time.Second, // env over yaml
+		Retries:    4,               // flag over env
+		Debug:      true,            // flag over the default
+		Kafka: Kafka{
+			Brokers: "yaml:9092",
+			Topic:   "default",
+			GroupID: "env",
+		},
+	}
+	if *cfg != want {
+		t.Errorf("loaded %+v, want %+v", *cfg, want)
+	}
+}
+
+type secretConfig struct {
+	Token   string            `yaml:"token" secret:"true"`
+	Empty   string            `yaml:"empty" secret:"true"`
+	Keys    []string          `yaml:"keys" secret:"true"`
+	Peers   map[string]string `yaml:"peers" secret:"true"`
+	Visible string            `yaml:"visible"`
+}
+
+func TestPrintMasksSecrets(t *testing.T) {
+	cfg := &secretConfig{
+		Token:   "t0ken",
+		Keys:    []string{"k1", "k2"},
+		Peers:   map[string]string{"a": "p4ss"},
+		Visible: "shown",
+	}
+	var buf bytes.Buffer
+	if err := Print(&buf, cfg); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, secret := range []string{"t0ken", "k1", "k2", "p4ss"} {
+		if strings.Contains(out, secret) {
+			t.Errorf("printed secret %q:\n%s", secret, out)
+		}
+	}
+	if !strings.Contains(out, "shown") || !strings.Contains(out, "a: '***'") {
+		t.Errorf("printed\n%s", out)
+	}
+	// printing doesn't touch the configuration itself
+	if cfg.Token != "t0ken" || cfg.Keys[0] != "k1" || cfg.Peers["a"] != "p4ss" {
+		t.Errorf("secrets were masked in place: %+v", cfg)
+	}
+}
+
+func TestPrintRejectsUnmaskableSecrets(t *testing.T) {
+	cfg := &struct {
+		Port int `yaml:"port" secret:"true"`
+	}{Port: 42}
+	if err := Print(&bytes.Buffer{}, cfg); err == nil {
+		t.Error("printed a secret int")
+	}
+}
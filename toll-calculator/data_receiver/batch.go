@@ -0,0 +1,256 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/device"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/types"
+)
+
+const (
+	maxBatchBytes = 1 << 20
+	maxBatchSize  = 10000
+	// how many batch IDs are remembered to answer retried uploads
+	seenBatchesCap = 4096
+
+	RejectMissingTimestamp = "missing_timestamp"
+	RejectOBUMismatch      = "obu_mismatch"
+)
+
+// A Delivery produces the readings of a batch and tells which of them made
+// it to kafka.
+type Delivery interface {
+	DataProducer
+	// Wait waits for the readings produced so far and returns how many of
+	// them, in order, were delivered before the first that wasn't, and why
+	// that one wasn't.
+	Wait() (int, error)
+}
+
+// BatchReceiver accepts the readings store-and-forward OBUs buffered while
+// they were offline. Batches skip the per-OBU rate limit, they are history
+// and not a live flood.
+type BatchReceiver struct {
+	// newDelivery starts the delivery of a batch, chain wraps it in the
+	// middlewares batches go through
+	newDelivery func() Delivery
+	chain       func(DataProducer) DataProducer
+	rejects     *RejectCounter
+	secret      []byte
+
+	mu       sync.Mutex
+	seen     map[string]types.BatchReceipt
+	seenList []string
+	// held while a batch is produced, so a retry arriving meanwhile waits
+	// for its receipt
+	inFlight map[string]*batchLock
+}
+
+type batchLock struct {
+	sync.Mutex
+	waiting int
+}
+
+func NewBatchReceiver(secret []byte, newDelivery func() Delivery, chain func(DataProducer) DataProducer, rejects *RejectCounter) *BatchReceiver {
+	return &BatchReceiver{
+		newDelivery: newDelivery,
+		chain:       chain,
+		rejects:     rejects,
+		secret:      secret,
+		seen:        make(map[string]types.BatchReceipt),
+		inFlight:    make(map[string]*batchLock),
+	}
+}
+
+func (br *BatchReceiver) handleBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		WriteJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+
+	var body io.Reader = http.MaxBytesReader(w, r.Body, maxBatchBytes)
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			WriteJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		defer gz.Close()
+		body = io.LimitReader(gz, maxBatchBytes*16)
+	}
+
+	var batch types.Batch
+	if err := json.NewDecoder(body).Decode(&batch); err != nil {
+		WriteJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !device.VerifyToken(br.secret, batch.OBUID, token) {
+		WriteJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid device credentials"})
+		return
+	}
+	if batch.BatchID == "" || len(batch.Readings) > maxBatchSize {
+		WriteJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid batch"})
+		return
+	}
+
+	unlock := br.lock(batchKey(batch))
+	defer unlock()
+	receipt, ok := br.lookup(batch)
+	if ok && receipt.Error == "" {
+		receipt.Duplicate = true
+		WriteJSON(w, http.StatusOK, receipt)
+		return
+	}
+	if !ok {
+		receipt = types.BatchReceipt{
+			BatchID: batch.BatchID,
+			OBUID:   batch.OBUID,
+		}
+	}
+
+	// remembered either way, a retry of a batch that failed part way only
+	// produces what wasn't delivered yet
+	receipt = br.produce(batch, receipt)
+	br.remember(batch, receipt)
+	if receipt.Error != "" {
+		WriteJSON(w, http.StatusServiceUnavailable, receipt)
+		return
+	}
+	WriteJSON(w, http.StatusOK, receipt)
+}
+
+// produce sends the readings of batch in the order they were taken,
+// starting after the ones receipt has handled, and stops at the first
+// reading that fails to produce. A reading only counts as accepted once
+// kafka reported it delivered. OBUs only add readings to a batch they retry
+// that were taken later, so the readings handled before keep their place in
+// the order.
+func (br *BatchReceiver) produce(batch types.Batch, receipt types.BatchReceipt) types.BatchReceipt {
+	receipt.Error = ""
+	receipt.Rejected = slices.Clone(receipt.Rejected)
+
+	order := make([]int, len(batch.Readings))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return batch.Readings[order[a]].Unix < batch.Readings[order[b]].Unix
+	})
+
+	type handled struct {
+		index  int
+		reason string
+	}
+	var (
+		delivery = br.newDelivery()
+		prod     = br.chain(delivery)
+		steps    []handled
+		prodErr  error
+	)
+	for _, i := range order[min(receipt.Handled, len(order)):] {
+		data := batch.Readings[i]
+		reason := ""
+		switch {
+		case data.OBUID != batch.OBUID:
+			reason = RejectOBUMismatch
+		case data.Unix == 0:
+			reason = RejectMissingTimestamp
+		}
+		if reason == "" {
+			err := prod.ProduceData(data)
+			var rejectErr *RejectError
+			switch {
+			case errors.As(err, &rejectErr):
+				reason = rejectErr.Reason
+			case err != nil:
+				prodErr = err
+			}
+		}
+		if prodErr != nil {
+			break
+		}
+		steps = append(steps, handled{index: i, reason: reason})
+	}
+
+	delivered, err := delivery.Wait()
+	if err == nil {
+		err = prodErr
+	}
+	for _, step := range steps {
+		if step.reason != "" {
+			br.rejects.Inc(step.reason)
+			receipt.Rejected = append(receipt.Rejected, types.BatchRejection{Index: step.index, Reason: step.reason})
+			receipt.Handled++
+			continue
+		}
+		if delivered == 0 {
+			break
+		}
+		delivered--
+		receipt.Accepted++
+		receipt.Handled++
+	}
+	if err != nil {
+		logrus.Errorf("batch %s produce error %s", batch.BatchID, err)
+		receipt.Error = err.Error()
+	}
+	return receipt
+}
+
+// lock holds the lock of the batch key until the returned func is called.
+func (br *BatchReceiver) lock(key string) func() {
+	br.mu.Lock()
+	l, ok := br.inFlight[key]
+	if !ok {
+		l = &batchLock{}
+		br.inFlight[key] = l
+	}
+	l.waiting++
+	br.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		br.mu.Lock()
+		if l.waiting--; l.waiting == 0 {
+			delete(br.inFlight, key)
+		}
+		br.mu.Unlock()
+	}
+}
+
+func batchKey(batch types.Batch) string {
+	return batch.BatchID + "@" + strconv.Itoa(batch.OBUID)
+}
+
+func (br *BatchReceiver) lookup(batch types.Batch) (types.BatchReceipt, bool) {
+	br.mu.Lock()
+	defer br.mu.Unlock()
+	receipt, ok := br.seen[batchKey(batch)]
+	return receipt, ok
+}
+
+func (br *BatchReceiver) remember(batch types.Batch, receipt types.BatchReceipt) {
+	br.mu.Lock()
+	defer br.mu.Unlock()
+	key := batchKey(batch)
+	if _, ok := br.seen[key]; !ok {
+		br.seenList = append(br.seenList, key)
+	}
+	br.seen[key] = receipt
+	if len(br.seenList) > seenBatchesCap {
+		delete(br.seen, br.seenList[0])
+		br.seenList = br.seenList[1:]
+	}
+}
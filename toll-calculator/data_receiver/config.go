@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/config"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/device"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/schema"
+)
+
+type Config struct {
+	ListenAddr     string       `yaml:"listenAddr" usage:"the listen address of the websocket and HTTP server"`
+	Kafka          config.Kafka `yaml:"kafka"`
+	SchemaRegistry string       `yaml:"schemaRegistry" usage:"the schema registry file"`
+	// readings are always produced at the latest version the registry has
+	// for the encoding
+	WireEncoding string  `yaml:"wireEncoding" usage:"the encoding readings are produced to kafka with, json or protobuf"`
+	KnownOBUs    string  `yaml:"knownOBUs" usage:"JSON list of the OBU IDs to accept readings from, empty accepts any"`
+	RateLimit    float64 `yaml:"rateLimit" usage:"readings per second allowed per OBU"`
+	RateBurst    int     `yaml:"rateBurst" usage:"readings an OBU may send in a burst"`
+	// tell the device why a reading was dropped
+	ReportRejections bool `yaml:"reportRejections" usage:"report dropped readings back to the device"`
+	// OBU credentials are derived from it, see device.Token
+	DeviceSecret      string        `yaml:"deviceSecret" secret:"true" usage:"the secret OBU tokens and HMAC keys are derived from"`
+	Dev               bool          `yaml:"dev" usage:"fall back to the development device secret if deviceSecret is empty"`
+	DevicePublicKeys  string        `yaml:"devicePublicKeys" usage:"JSON object of OBU ID to base64 Ed25519 public key, empty if no OBU signs with Ed25519"`
+	RequireSignatures bool          `yaml:"requireSignatures" usage:"reject readings that carry no signature"`
+	MQTTBroker        string        `yaml:"mqttBroker" usage:"the MQTT broker to take readings from next to the websocket, empty disables MQTT ingestion"`
+	MQTTClientID      string        `yaml:"mqttClientID" usage:"the client ID of the receiver at the MQTT broker, unique per receiver, empty is one from the hostname and a random suffix"`
+	ShutdownTimeout   time.Duration `yaml:"shutdownTimeout" usage:"how long the service gets to stop on SIGTERM"`
+}
+
+func NewConfig() *Config {
+	return &Config{
+		ListenAddr: ":30000",
+		Kafka: config.Kafka{
+			Brokers: "localhost",
+			Topic:   "obuData",
+		},
+		SchemaRegistry:   "./schemas/registry.json",
+		WireEncoding:     string(schema.EncodingJSON),
+		RateLimit:        1.0,
+		RateBurst:        5,
+		ReportRejections: true,
+		MQTTBroker:       "tcp://localhost:1883",
+		ShutdownTimeout:  10 * time.Second,
+	}
+}
+
+func (c *Config) Validate() error {
+	if c.ListenAddr == "" {
+		return errors.New("listenAddr is required")
+	}
+	if err := c.Kafka.Validate(); err != nil {
+		return err
+	}
+	switch schema.Encoding(c.WireEncoding) {
+	case schema.EncodingJSON, schema.EncodingProtobuf:
+	default:
+		return fmt.Errorf("unknown wire encoding %q", c.WireEncoding)
+	}
+	if c.RateLimit <= 0 || c.RateBurst < 1 {
+		return errors.New("rateLimit must be positive and rateBurst at least 1")
+	}
+	if c.DeviceSecret == "" && !c.Dev {
+		return errors.New("deviceSecret is required, start with -dev to use the development secret")
+	}
+	if c.ShutdownTimeout <= 0 {
+		return errors.New("shutdownTimeout must be positive")
+	}
+	return nil
+}
+
+// deviceSecret is the configured secret, or the development one in dev mode.
+func (c *Config) deviceSecret() []byte {
+	if c.DeviceSecret == "" {
+		return []byte(device.DevSecret)
+	}
+	return []byte(c.DeviceSecret)
+}
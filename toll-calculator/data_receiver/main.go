@@ -1,51 +1,141 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"sync"
 
 	"github.com/gorilla/websocket"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/config"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/device"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/health"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/run"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/schema"
 	"github.com/tunangoo/full-time-go-dev/toll-calculator/types"
 )
 
+// the server's preference comes first, an OBU asking for nothing gets JSON
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
+	Subprotocols:    []string{schema.SubprotocolProtobuf, schema.SubprotocolJSON},
+}
+
+// frameDecoders decode a websocket frame by negotiated subprotocol.
+var frameDecoders = map[string]func([]byte, *types.OBUdata) error{
+	"":                         decodeJSONFrame,
+	schema.SubprotocolJSON:     decodeJSONFrame,
+	schema.SubprotocolProtobuf: schema.UnmarshalOBUData,
+}
+
+func decodeJSONFrame(b []byte, data *types.OBUdata) error {
+	return json.Unmarshal(b, data)
 }
 
 type DataReceiver struct {
-	msgch chan types.OBUdata
-	conn  *websocket.Conn
-	prod  DataProducer
+	msgch   chan types.OBUdata
+	prod    DataProducer
+	batches *BatchReceiver
+	rejects *RejectCounter
+	kafka   *KafkaProducer
+	// tell the device why a reading was dropped
+	reportRejections bool
+
+	mu      sync.Mutex
+	conns   map[*websocket.Conn]struct{}
+	closing bool
+	loops   sync.WaitGroup
 }
 
-func NewDataReceiver() (*DataReceiver, error) {
-	var (
-		p          DataProducer
-		err        error
-		kafkaTopic = "obuData"
-	)
+// rejection is sent back to the device for every dropped reading.
+type rejection struct {
+	OBUID  int    `json:"obuID"`
+	Reason string `json:"reason"`
+}
+
+func NewDataReceiver(cfg *Config) (*DataReceiver, error) {
+	var p DataProducer
 
-	p, err = NewKafkaProducer(kafkaTopic)
+	registry, err := schema.LoadRegistry(cfg.SchemaRegistry)
+	if err != nil {
+		return nil, err
+	}
+	s, err := registry.Latest(schema.SubjectOBUData, schema.Encoding(cfg.WireEncoding))
 	if err != nil {
 		return nil, err
 	}
 
-	p = NewLogMiddleware(p)
+	kafka, err := NewKafkaProducer(cfg.Kafka.Brokers, cfg.Kafka.Topic, s)
+	if err != nil {
+		return nil, err
+	}
+
+	known, err := LoadKnownOBUs(cfg.KnownOBUs)
+	if err != nil {
+		return nil, err
+	}
+
+	publicKeys, err := device.LoadPublicKeys(cfg.DevicePublicKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		rejects  = NewRejectCounter()
+		verifier = device.NewVerifier(cfg.deviceSecret(), publicKeys)
+		logged   = NewLogMiddleware(kafka)
+	)
+	p = NewRateLimitMiddleware(cfg.RateLimit, cfg.RateBurst, logged)
+	p = NewSignatureMiddleware(verifier, cfg.RequireSignatures, p)
+	p = NewValidationMiddleware(known, p)
+
+	batchChain := func(delivery DataProducer) DataProducer {
+		return NewValidationMiddleware(known, NewSignatureMiddleware(verifier, cfg.RequireSignatures, NewLogMiddleware(delivery)))
+	}
 	return &DataReceiver{
-		msgch: make(chan types.OBUdata, 128),
-		prod:  p,
+		msgch:   make(chan types.OBUdata, 128),
+		prod:    p,
+		batches: NewBatchReceiver(cfg.deviceSecret(), kafka.NewDelivery, batchChain, rejects),
+		rejects: rejects,
+		kafka:   kafka,
+		conns:   make(map[*websocket.Conn]struct{}),
+
+		reportRejections: cfg.ReportRejections,
 	}, nil
 }
 
 func main() {
-	recv, err := NewDataReceiver()
+	cfg := NewConfig()
+	config.MustLoad("receiver", cfg)
+
+	recv, err := NewDataReceiver(cfg)
 	if err != nil {
 		log.Fatal(err)
 	}
+	// stopped bottom up: no new readings come in before the producer is
+	// flushed
+	g := run.New(cfg.ShutdownTimeout)
+	checks := health.New()
+	g.AddStop("kafka producer", recv.kafka.Close)
+	checks.Add("kafka", recv.kafka.Ping)
+	if cfg.MQTTBroker != "" {
+		mqttRecv := NewMQTTReceiver(cfg.MQTTBroker, cfg.MQTTClientID, recv)
+		g.AddStop("mqtt", mqttRecv.Close)
+		checks.Add("mqtt", mqttRecv.Ready)
+	}
+	checks.Register(http.DefaultServeMux)
 	http.HandleFunc("/ws", recv.handleWS)
-	http.ListenAndServe(":30000", nil)
+	http.HandleFunc("/batch", recv.batches.handleBatch)
+	http.HandleFunc("/rejections", recv.handleRejections)
+	g.AddHTTPServer(&http.Server{Addr: cfg.ListenAddr})
+	g.AddStop("websocket", recv.closeConns)
+	if err := g.Run(); err != nil {
+		log.Fatal(err)
+	}
 }
 
 func (dr *DataReceiver) produceData(data types.OBUdata) error {
@@ -53,25 +143,112 @@ func (dr *DataReceiver) produceData(data types.OBUdata) error {
 }
 
 func (dr *DataReceiver) handleWS(w http.ResponseWriter, r *http.Request) {
+	dr.mu.Lock()
+	defer dr.mu.Unlock()
+	if dr.closing {
+		WriteJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "shutting down"})
+		return
+	}
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Fatal(err)
+		fmt.Println("upgrade error: ", err)
+		return
 	}
-	dr.conn = conn
 
-	go dr.wsReceiverLoop()
+	dr.conns[conn] = struct{}{}
+	dr.loops.Add(1)
+	go dr.wsReceiverLoop(conn)
 }
 
-func (dr *DataReceiver) wsReceiverLoop() {
-	fmt.Println("New OBU Client Connected")
+// closeConns sends every connected OBU a close frame and waits for the
+// readings they sent before it to be ingested. Connections that don't
+// close in time are dropped.
+func (dr *DataReceiver) closeConns(ctx context.Context) error {
+	dr.mu.Lock()
+	dr.closing = true
+	deadline, _ := ctx.Deadline()
+	msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "receiver shutting down")
+	for conn := range dr.conns {
+		conn.WriteControl(websocket.CloseMessage, msg, deadline)
+	}
+	dr.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		dr.loops.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		dr.mu.Lock()
+		defer dr.mu.Unlock()
+		for conn := range dr.conns {
+			conn.Close()
+		}
+		return fmt.Errorf("dropped %d websocket connections", len(dr.conns))
+	}
+}
+
+func (dr *DataReceiver) handleRejections(w http.ResponseWriter, r *http.Request) {
+	WriteJSON(w, http.StatusOK, dr.rejects.Counts())
+}
+
+// wsReceiverLoop reads readings in the format negotiated on connect.
+// Rejections are always reported back as JSON text frames.
+func (dr *DataReceiver) wsReceiverLoop(conn *websocket.Conn) {
+	fmt.Println("New OBU Client Connected", conn.Subprotocol())
+	defer func() {
+		conn.Close()
+		dr.mu.Lock()
+		delete(dr.conns, conn)
+		dr.mu.Unlock()
+		dr.loops.Done()
+	}()
+	decode := frameDecoders[conn.Subprotocol()]
 	for {
-		var data types.OBUdata
-		if err := dr.conn.ReadJSON(&data); err != nil {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
 			fmt.Println("read error: ", err)
+			return
+		}
+		var (
+			data   types.OBUdata
+			reason string
+		)
+		if err := decode(msg, &data); err != nil {
+			reason = RejectMalformed
+			dr.rejects.Inc(reason)
+		} else {
+			reason = dr.ingest(data)
+		}
+		if reason == "" || !dr.reportRejections {
 			continue
 		}
-		if err := dr.produceData(data); err != nil {
-			fmt.Println("kafka produce error", err)
+		if err := conn.WriteJSON(rejection{OBUID: data.OBUID, Reason: reason}); err != nil {
+			fmt.Println("write error: ", err)
 		}
 	}
 }
+
+// ingest runs a reading through the producer chain, whatever transport it
+// came in on. It returns why the reading was rejected, or "" if it wasn't.
+func (dr *DataReceiver) ingest(data types.OBUdata) string {
+	err := dr.produceData(data)
+	var rejectErr *RejectError
+	switch {
+	case errors.As(err, &rejectErr):
+		dr.rejects.Inc(rejectErr.Reason)
+		return rejectErr.Reason
+	case err != nil:
+		fmt.Println("kafka produce error", err)
+	}
+	return ""
+}
+
+func WriteJSON(w http.ResponseWriter, status int, v any) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/sirupsen/logrus"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/types"
+)
+
+// Every OBU publishes its readings to obu/<obuID>/data and, when rejections
+// are reported, gets them back on obu/<obuID>/rejections.
+const (
+	mqttDataTopic      = "obu/+/data"
+	mqttRejectionTopic = "obu/%d/rejections"
+)
+
+type MQTTReceiver struct {
+	client mqtt.Client
+	recv   *DataReceiver
+}
+
+// NewMQTTReceiver connects to broker as clientID in the background and keeps
+// retrying, the websocket receiver doesn't have to wait for the broker to be
+// up. An empty clientID is one of defaultMQTTClientID.
+func NewMQTTReceiver(broker, clientID string, recv *DataReceiver) *MQTTReceiver {
+	if clientID == "" {
+		clientID = defaultMQTTClientID()
+	}
+	m := &MQTTReceiver{
+		recv: recv,
+	}
+	opts := mqtt.NewClientOptions().
+		AddBroker(broker).
+		SetClientID(clientID).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(5 * time.Second).
+		SetAutoReconnect(true).
+		SetOnConnectHandler(m.subscribe)
+	m.client = mqtt.NewClient(opts)
+	m.client.Connect()
+	return m
+}
+
+// defaultMQTTClientID is unique to the receiver: a broker disconnects a
+// client when another connects with its ID, receivers sharing one would
+// keep taking the connection from each other.
+func defaultMQTTClientID() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	if host, err := os.Hostname(); err == nil && host != "" {
+		return fmt.Sprintf("data_receiver-%s-%x", host, b)
+	}
+	return fmt.Sprintf("data_receiver-%x", b)
+}
+
+// Close disconnects from the broker, giving the readings being handled
+// until ctx is done to make it into kafka.
+func (m *MQTTReceiver) Close(ctx context.Context) error {
+	quiesce := time.Second
+	if deadline, ok := ctx.Deadline(); ok {
+		quiesce = min(quiesce, max(time.Until(deadline), 0))
+	}
+	m.client.Disconnect(uint(quiesce.Milliseconds()))
+	return nil
+}
+
+// Ready checks that the receiver is connected to the broker.
+func (m *MQTTReceiver) Ready(context.Context) error {
+	if !m.client.IsConnectionOpen() {
+		return errors.New("not connected to the broker")
+	}
+	return nil
+}
+
+// subscribe runs on every (re)connect, the broker forgets subscriptions of
+// clean sessions.
+func (m *MQTTReceiver) subscribe(client mqtt.Client) {
+	token := client.Subscribe(mqttDataTopic, 1, m.handleMessage)
+	token.Wait()
+	if err := token.Error(); err != nil {
+		logrus.Errorf("mqtt subscribe error %s", err)
+		return
+	}
+	logrus.WithField("topic", mqttDataTopic).Info("mqtt receiver subscribed")
+}
+
+func (m *MQTTReceiver) handleMessage(_ mqtt.Client, msg mqtt.Message) {
+	obuID, err := topicOBUID(msg.Topic())
+	if err != nil {
+		m.recv.rejects.Inc(RejectInvalidOBUID)
+		return
+	}
+
+	var (
+		data   types.OBUdata
+		reason string
+	)
+	switch err := json.Unmarshal(msg.Payload(), &data); {
+	case err != nil:
+		reason = RejectMalformed
+		m.recv.rejects.Inc(reason)
+	case data.OBUID != 0 && data.OBUID != obuID:
+		reason = RejectTopicMismatch
+		m.recv.rejects.Inc(reason)
+	default:
+		data.OBUID = obuID
+		reason = m.recv.ingest(data)
+	}
+	if reason == "" || !m.recv.reportRejections {
+		return
+	}
+
+	b, err := json.Marshal(rejection{OBUID: obuID, Reason: reason})
+	if err != nil {
+		return
+	}
+	m.client.Publish(fmt.Sprintf(mqttRejectionTopic, obuID), 0, false, b)
+}
+
+func topicOBUID(topic string) (int, error) {
+	parts := strings.Split(topic, "/")
+	if len(parts) != 3 {
+		return 0, fmt.Errorf("unexpected topic %s", topic)
+	}
+	return strconv.Atoi(parts[1])
+}
@@ -1,9 +1,14 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"fmt"
+	"strconv"
+	"time"
 
 	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/sirupsen/logrus"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/schema"
 	"github.com/tunangoo/full-time-go-dev/toll-calculator/types"
 )
 
@@ -14,23 +19,20 @@ type DataProducer interface {
 type KafkaProducer struct {
 	producer *kafka.Producer
 	topic    string
+	schema   schema.Schema
 }
 
-func NewKafkaProducer(topic string) (DataProducer, error) {
-	p, err := kafka.NewProducer(&kafka.ConfigMap{"bootstrap.servers": "localhost"})
+func NewKafkaProducer(brokers, topic string, s schema.Schema) (*KafkaProducer, error) {
+	p, err := kafka.NewProducer(&kafka.ConfigMap{"bootstrap.servers": brokers})
 	if err != nil {
 		return nil, err
 	}
 
+	// the reports of live readings, nobody waits for them
 	go func() {
 		for e := range p.Events() {
-			switch ev := e.(type) {
-			case *kafka.Message:
-				if ev.TopicPartition.Error != nil {
-					//fmt.Printf("Delivery failed: %v\n", ev.TopicPartition)
-				} else {
-					//fmt.Printf("Delivered message to %v\n", ev.TopicPartition)
-				}
+			if ev, ok := e.(*kafka.Message); ok && ev.TopicPartition.Error != nil {
+				logrus.Errorf("kafka delivery error %s, a reading is lost", ev.TopicPartition.Error)
 			}
 		}
 	}()
@@ -38,17 +40,94 @@ func NewKafkaProducer(topic string) (DataProducer, error) {
 	return &KafkaProducer{
 		producer: p,
 		topic:    topic,
+		schema:   s,
 	}, nil
 }
 
 func (p *KafkaProducer) ProduceData(data types.OBUdata) error {
-	b, err := json.Marshal(data)
+	return p.produce(data, nil)
+}
+
+// produce queues data, its delivery report is sent on delivered, or on the
+// events channel if that is nil.
+func (p *KafkaProducer) produce(data types.OBUdata, delivered chan kafka.Event) error {
+	b, err := schema.Encode(p.schema, data)
 	if err != nil {
 		return err
 	}
 
+	// keyed by OBU so all readings of an OBU land on one partition and are
+	// consumed in the order they were produced
 	return p.producer.Produce(&kafka.Message{
 		TopicPartition: kafka.TopicPartition{Topic: &p.topic, Partition: kafka.PartitionAny},
+		Key:            []byte(strconv.Itoa(data.OBUID)),
 		Value:          b,
-	}, nil)
+	}, delivered)
+}
+
+// NewDelivery returns a Delivery producing to p.
+func (p *KafkaProducer) NewDelivery() Delivery {
+	return &kafkaDelivery{producer: p}
+}
+
+type kafkaDelivery struct {
+	producer *KafkaProducer
+	reports  []chan kafka.Event
+}
+
+func (d *kafkaDelivery) ProduceData(data types.OBUdata) error {
+	delivered := make(chan kafka.Event, 1)
+	if err := d.producer.produce(data, delivered); err != nil {
+		return err
+	}
+	d.reports = append(d.reports, delivered)
+	return nil
+}
+
+func (d *kafkaDelivery) Wait() (int, error) {
+	for i, delivered := range d.reports {
+		// the readings of an OBU go to one partition, the ones after a
+		// reading that failed are not trusted either
+		if msg, ok := (<-delivered).(*kafka.Message); ok && msg.TopicPartition.Error != nil {
+			for _, rest := range d.reports[i+1:] {
+				<-rest
+			}
+			d.reports = nil
+			return i, msg.TopicPartition.Error
+		}
+	}
+	n := len(d.reports)
+	d.reports = nil
+	return n, nil
+}
+
+// Close waits for the readings still queued to be delivered and closes the
+// producer, giving up on them once ctx is done.
+func (p *KafkaProducer) Close(ctx context.Context) error {
+	defer p.producer.Close()
+	for {
+		n := p.producer.Flush(100)
+		if n == 0 {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return fmt.Errorf("%d readings were not delivered", n)
+		}
+	}
+}
+
+// Ping checks that the brokers answer and know the topic.
+func (p *KafkaProducer) Ping(ctx context.Context) error {
+	timeout := 5 * time.Second
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+	md, err := p.producer.GetMetadata(&p.topic, false, int(timeout.Milliseconds()))
+	if err != nil {
+		return err
+	}
+	if t, ok := md.Topics[p.topic]; !ok || t.Error.Code() != kafka.ErrNoError {
+		return fmt.Errorf("topic %s is not available", p.topic)
+	}
+	return nil
 }
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/types"
+)
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimitMiddleware gives every OBU its own token bucket, refilled at
+// rate tokens per second up to burst.
+type RateLimitMiddleware struct {
+	next      DataProducer
+	mu        sync.Mutex
+	rate      float64
+	burst     float64
+	buckets   map[int]*tokenBucket
+	lastSweep time.Time
+}
+
+func NewRateLimitMiddleware(rate float64, burst int, next DataProducer) *RateLimitMiddleware {
+	return &RateLimitMiddleware{
+		next:      next,
+		rate:      rate,
+		burst:     float64(burst),
+		buckets:   make(map[int]*tokenBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+func (l *RateLimitMiddleware) ProduceData(data types.OBUdata) error {
+	if !l.allow(data.OBUID, time.Now()) {
+		return &RejectError{Reason: RejectRateLimited}
+	}
+	return l.next.ProduceData(data)
+}
+
+func (l *RateLimitMiddleware) allow(obuID int, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(now)
+	b, ok := l.buckets[obuID]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[obuID] = b
+	}
+	b.tokens = min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// sweep drops the buckets that had time to refill completely, a new bucket
+// starts full anyway.
+func (l *RateLimitMiddleware) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+	for id, b := range l.buckets {
+		if now.Sub(b.last) > full {
+			delete(l.buckets, id)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimitBurstAndRefill(t *testing.T) {
+	var (
+		l   = NewRateLimitMiddleware(2, 3, nil)
+		now = time.Date(2026, 10, 19, 8, 0, 0, 0, time.UTC)
+	)
+	for i := 0; i < 3; i++ {
+		if !l.allow(1, now) {
+			t.Fatalf("reading %d of the burst was limited", i+1)
+		}
+	}
+	if l.allow(1, now) {
+		t.Fatal("a reading past the burst was allowed")
+	}
+	// other OBUs have their own bucket
+	if !l.allow(2, now) {
+		t.Fatal("another OBU was limited")
+	}
+	// 2 tokens per second
+	now = now.Add(500 * time.Millisecond)
+	if !l.allow(1, now) {
+		t.Fatal("a reading after a refill was limited")
+	}
+	if l.allow(1, now) {
+		t.Fatal("a reading past the refill was allowed")
+	}
+	// refills stop at the burst
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		if !l.allow(1, now) {
+			t.Fatalf("reading %d of the refilled burst was limited", i+1)
+		}
+	}
+	if l.allow(1, now) {
+		t.Fatal("the bucket refilled past the burst")
+	}
+}
+
+func TestRateLimitSweep(t *testing.T) {
+	var (
+		l   = NewRateLimitMiddleware(2, 3, nil)
+		now = l.lastSweep
+	)
+	l.allow(1, now)
+	l.allow(2, now.Add(59*time.Second))
+	l.allow(3, now.Add(time.Minute))
+	// only OBU 1 had the 1.5s to refill by the sweep a minute in
+	if _, ok := l.buckets[1]; ok {
+		t.Error("the full bucket of OBU 1 was kept")
+	}
+	if _, ok := l.buckets[2]; !ok {
+		t.Error("the bucket of OBU 2 was dropped before it refilled")
+	}
+}
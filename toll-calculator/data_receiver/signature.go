@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/device"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/types"
+)
+
+type SignatureMiddleware struct {
+	next     DataProducer
+	verifier *device.Verifier
+	// reject readings without a signature instead of passing them on
+	required bool
+}
+
+func NewSignatureMiddleware(verifier *device.Verifier, required bool, next DataProducer) *SignatureMiddleware {
+	return &SignatureMiddleware{
+		next:     next,
+		verifier: verifier,
+		required: required,
+	}
+}
+
+// ProduceData passes signed readings on with their signature, so it can be
+// verified again from kafka or the archive.
+func (s *SignatureMiddleware) ProduceData(data types.OBUdata) error {
+	err := s.verifier.Verify(data)
+	switch {
+	case errors.Is(err, device.ErrUnsigned):
+		if s.required {
+			return &RejectError{Reason: RejectUnsigned}
+		}
+	case err != nil:
+		return &RejectError{Reason: RejectBadSignature}
+	}
+	return s.next.ProduceData(data)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"os"
+	"sync"
+
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/types"
+)
+
+const (
+	RejectMalformed      = "malformed"
+	RejectInvalidOBUID   = "invalid_obu_id"
+	RejectUnknownOBU     = "unknown_obu"
+	RejectLatOutOfRange  = "lat_out_of_range"
+	RejectLongOutOfRange = "long_out_of_range"
+	RejectRateLimited    = "rate_limited"
+	RejectTopicMismatch  = "topic_mismatch"
+	RejectUnsigned       = "unsigned"
+	RejectBadSignature   = "bad_signature"
+)
+
+// RejectError is returned by the producer chain for readings that are
+// dropped on purpose, as opposed to readings that failed to produce.
+type RejectError struct {
+	Reason string
+}
+
+func (e *RejectError) Error() string {
+	return "reading rejected: " + e.Reason
+}
+
+type ValidationMiddleware struct {
+	next DataProducer
+	// nil accepts every OBU ID
+	known map[int]struct{}
+}
+
+func NewValidationMiddleware(known map[int]struct{}, next DataProducer) *ValidationMiddleware {
+	return &ValidationMiddleware{
+		next:  next,
+		known: known,
+	}
+}
+
+func (v *ValidationMiddleware) ProduceData(data types.OBUdata) error {
+	if reason := v.validate(data); reason != "" {
+		return &RejectError{Reason: reason}
+	}
+	return v.next.ProduceData(data)
+}
+
+func (v *ValidationMiddleware) validate(data types.OBUdata) string {
+	if data.OBUID <= 0 {
+		return RejectInvalidOBUID
+	}
+	if v.known != nil {
+		if _, ok := v.known[data.OBUID]; !ok {
+			return RejectUnknownOBU
+		}
+	}
+	if math.IsNaN(data.Lat) || data.Lat < -90 || data.Lat > 90 {
+		return RejectLatOutOfRange
+	}
+	if math.IsNaN(data.Long) || data.Long < -180 || data.Long > 180 {
+		return RejectLongOutOfRange
+	}
+	return ""
+}
+
+// LoadKnownOBUs reads a JSON array of OBU IDs. An empty path disables the
+// known OBU check.
+func LoadKnownOBUs(path string) (map[int]struct{}, error) {
+	if path == "" {
+		return nil, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var ids []int
+	if err := json.Unmarshal(b, &ids); err != nil {
+		return nil, err
+	}
+	known := make(map[int]struct{}, len(ids))
+	for _, id := range ids {
+		known[id] = struct{}{}
+	}
+	return known, nil
+}
+
+// RejectCounter counts rejected readings by reason.
+type RejectCounter struct {
+	mu     sync.Mutex
+	counts map[string]uint64
+}
+
+func NewRejectCounter() *RejectCounter {
+	return &RejectCounter{
+		counts: make(map[string]uint64),
+	}
+}
+
+func (c *RejectCounter) Inc(reason string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counts[reason]++
+}
+
+func (c *RejectCounter) Counts() map[string]uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	counts := make(map[string]uint64, len(c.counts))
+	for reason, n := range c.counts {
+		counts[reason] = n
+	}
+	return counts
+}
@@ -0,0 +1,118 @@
+package device
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/types"
+)
+
+const (
+	// keyed with the device token, see Token
+	SigHMACSHA256 = "hmac-sha256"
+	// keyed with a key pair provisioned on the device
+	SigEd25519 = "ed25519"
+)
+
+var (
+	ErrUnsigned     = errors.New("reading is not signed")
+	ErrBadSignature = errors.New("reading signature does not verify")
+)
+
+// SigningPayload is what a signature covers: OBU ID, lat, long and unix as
+// big endian 64 bit values. It doesn't depend on the wire format, a reading
+// verifies the same whether it arrived as JSON or protobuf or was archived.
+func SigningPayload(data types.OBUdata) []byte {
+	b := make([]byte, 32)
+	binary.BigEndian.PutUint64(b[0:], uint64(data.OBUID))
+	binary.BigEndian.PutUint64(b[8:], math.Float64bits(data.Lat))
+	binary.BigEndian.PutUint64(b[16:], math.Float64bits(data.Long))
+	binary.BigEndian.PutUint64(b[24:], uint64(data.Unix))
+	return b
+}
+
+func SignHMAC(secret []byte, data *types.OBUdata) {
+	mac := hmac.New(sha256.New, []byte(Token(secret, data.OBUID)))
+	mac.Write(SigningPayload(*data))
+	data.SigAlg = SigHMACSHA256
+	data.Signature = mac.Sum(nil)
+}
+
+func SignEd25519(key ed25519.PrivateKey, data *types.OBUdata) {
+	data.SigAlg = SigEd25519
+	data.Signature = ed25519.Sign(key, SigningPayload(*data))
+}
+
+type Verifier struct {
+	secret     []byte
+	publicKeys map[int]ed25519.PublicKey
+}
+
+func NewVerifier(secret []byte, publicKeys map[int]ed25519.PublicKey) *Verifier {
+	return &Verifier{
+		secret:     secret,
+		publicKeys: publicKeys,
+	}
+}
+
+// Verify returns ErrUnsigned for readings without a signature and
+// ErrBadSignature for readings that were tampered with.
+func (v *Verifier) Verify(data types.OBUdata) error {
+	switch data.SigAlg {
+	case "":
+		return ErrUnsigned
+	case SigHMACSHA256:
+		mac := hmac.New(sha256.New, []byte(Token(v.secret, data.OBUID)))
+		mac.Write(SigningPayload(data))
+		if !hmac.Equal(mac.Sum(nil), data.Signature) {
+			return ErrBadSignature
+		}
+	case SigEd25519:
+		key, ok := v.publicKeys[data.OBUID]
+		if !ok {
+			return fmt.Errorf("no public key for obu id %d", data.OBUID)
+		}
+		if !ed25519.Verify(key, SigningPayload(data), data.Signature) {
+			return ErrBadSignature
+		}
+	default:
+		return fmt.Errorf("unknown signature algorithm %q", data.SigAlg)
+	}
+	return nil
+}
+
+// LoadPublicKeys reads the Ed25519 public keys of devices from a JSON
+// object of OBU ID to base64 key. An empty path loads none.
+func LoadPublicKeys(path string) (map[int]ed25519.PublicKey, error) {
+	keys := make(map[int]ed25519.PublicKey)
+	if path == "" {
+		return keys, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string][]byte
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, err
+	}
+	for id, key := range raw {
+		obuID, err := strconv.Atoi(id)
+		if err != nil {
+			return nil, fmt.Errorf("public keys %s: %w", path, err)
+		}
+		if len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("public keys %s: bad key size for obu id %d", path, obuID)
+		}
+		keys[obuID] = ed25519.PublicKey(key)
+	}
+	return keys, nil
+}
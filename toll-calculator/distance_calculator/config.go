@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/config"
+)
+
+type Config struct {
+	Kafka          config.Kafka `yaml:"kafka"`
+	SchemaRegistry string       `yaml:"schemaRegistry" usage:"the schema registry file"`
+	ListenAddr     string       `yaml:"listenAddr" usage:"the listen address of the health endpoints"`
+	// OBUs are routed to the aggregator node owning them
+	Aggregators     []string      `yaml:"aggregators" usage:"comma separated endpoints of the aggregator nodes"`
+	DeadLetterTopic string        `yaml:"deadLetterTopic" usage:"the topic distance and trips that fail to aggregate are produced to"`
+	Trip            TripConfig    `yaml:"trip"`
+	ShutdownTimeout time.Duration `yaml:"shutdownTimeout" usage:"how long the service gets to stop on SIGTERM"`
+}
+
+type TripConfig struct {
+	IgnitionGap       time.Duration `yaml:"ignitionGap" usage:"a silence longer than this means the engine was switched off"`
+	StationaryTimeout time.Duration `yaml:"stationaryTimeout" usage:"a trip ends when the OBU stood still for this long"`
+	MinMove           float64       `yaml:"minMove" usage:"the kilometres an OBU must move between readings to count as moving"`
+	ExpireInterval    time.Duration `yaml:"expireInterval" usage:"how often the trips of silent OBUs are closed"`
+}
+
+func NewConfig() *Config {
+	return &Config{
+		Kafka: config.Kafka{
+			Brokers: "localhost",
+			Topic:   "obuData",
+			GroupID: "myGroup",
+		},
+		SchemaRegistry:  "./schemas/registry.json",
+		ListenAddr:      ":3001",
+		Aggregators:     []string{"http://localhost:3000"},
+		DeadLetterTopic: "obuDataDLQ",
+		Trip: TripConfig{
+			IgnitionGap:       time.Minute * 5,
+			StationaryTimeout: time.Minute * 3,
+			MinMove:           0.01,
+			ExpireInterval:    time.Second * 30,
+		},
+		ShutdownTimeout: 10 * time.Second,
+	}
+}
+
+func (c *Config) Validate() error {
+	if err := c.Kafka.Validate(); err != nil {
+		return err
+	}
+	if c.Kafka.GroupID == "" {
+		return errors.New("kafka.groupID is required")
+	}
+	if c.ListenAddr == "" {
+		return errors.New("listenAddr is required")
+	}
+	if len(c.Aggregators) == 0 {
+		return errors.New("at least one aggregator is required")
+	}
+	if c.DeadLetterTopic == "" {
+		return errors.New("deadLetterTopic is required")
+	}
+	if c.Trip.IgnitionGap <= 0 || c.Trip.StationaryTimeout <= 0 || c.Trip.ExpireInterval <= 0 {
+		return errors.New("trip durations must be positive")
+	}
+	if c.ShutdownTimeout <= 0 {
+		return errors.New("shutdownTimeout must be positive")
+	}
+	return nil
+}
+
+// ReplayConfig is the configuration of the replay subcommand. It shares
+// the environment and the config file of the calculator.
+type ReplayConfig struct {
+	Archive     string     `yaml:"archive" usage:"the archive directory written by the archiver"`
+	From        string     `yaml:"from" usage:"start of the range (RFC3339), inclusive"`
+	To          string     `yaml:"to" usage:"end of the range (RFC3339), exclusive"`
+	Aggregators []string   `yaml:"aggregators" flag:"aggregator" usage:"comma separated aggregator nodes to replay into"`
+	Trip        TripConfig `yaml:"trip"`
+}
+
+func NewReplayConfig() *ReplayConfig {
+	defaults := NewConfig()
+	return &ReplayConfig{
+		Archive:     "./data/archive",
+		Aggregators: defaults.Aggregators,
+		Trip:        defaults.Trip,
+	}
+}
+
+func (c *ReplayConfig) Validate() error {
+	if c.From == "" || c.To == "" {
+		return errors.New("from and to are required")
+	}
+	if len(c.Aggregators) == 0 {
+		return errors.New("at least one aggregator is required")
+	}
+	return nil
+}
@@ -1,77 +1,227 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
 	"github.com/sirupsen/logrus"
 	"github.com/tunangoo/full-time-go-dev/toll-calculator/aggregator/client"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/config"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/schema"
 	"github.com/tunangoo/full-time-go-dev/toll-calculator/types"
 )
 
 // This can also be called Kafka Transport
 type KafkaConsumer struct {
-	consumer    *kafka.Consumer
-	isRunning   bool
+	consumer  *kafka.Consumer
+	topic     string
+	isRunning atomic.Bool
+	// closed once the read loop finished the message it was on
+	done        chan struct{}
+	registry    *schema.Registry
 	calcService CalculatorServicer
-	aggClient   *client.Client
+	trips       TripDetector
+	// how often the trips of silent OBUs are closed
+	tripExpireInterval time.Duration
+	aggClient          client.Aggregator
+	deadLetters        DeadLetterQueue
+	// the message that could neither be aggregated nor dead lettered, it is
+	// read again and must not be measured again
+	failed *failedMessage
+
+	mu sync.Mutex
+	// trips that could neither be aggregated nor dead lettered, retried
+	// with the next expired trips
+	failedTrips []types.Trip
+}
+
+type failedMessage struct {
+	partition kafka.TopicPartition
+	distance  float64
+}
+
+func (f *failedMessage) is(msg *kafka.Message) bool {
+	return f != nil && f.partition.Partition == msg.TopicPartition.Partition && f.partition.Offset == msg.TopicPartition.Offset
 }
 
-func NewKafkaConsumer(topic string, svc CalculatorServicer, aggClient *client.Client) (*KafkaConsumer, error) {
+func NewKafkaConsumer(cfg config.Kafka, registry *schema.Registry, svc CalculatorServicer, trips TripDetector, tripExpireInterval time.Duration, aggClient client.Aggregator, deadLetters DeadLetterQueue) (*KafkaConsumer, error) {
 	c, err := kafka.NewConsumer(&kafka.ConfigMap{
-		"bootstrap.servers": "localhost",
-		"group.id":          "myGroup",
+		"bootstrap.servers": cfg.Brokers,
+		"group.id":          cfg.GroupID,
 		"auto.offset.reset": "earliest",
+		// offsets are stored once a message was handled, and committed
+		// from there, so a restart doesn't skip the message in flight
+		"enable.auto.offset.store": false,
 	})
 	if err != nil {
 		return nil, err
 	}
 
-	err = c.SubscribeTopics([]string{topic}, nil)
+	err = c.SubscribeTopics([]string{cfg.Topic}, nil)
 	if err != nil {
 		return nil, err
 	}
 
 	return &KafkaConsumer{
 		consumer:    c,
+		topic:       cfg.Topic,
+		done:        make(chan struct{}),
+		registry:    registry,
 		calcService: svc,
-		aggClient:   aggClient,
+		trips:       trips,
+
+		tripExpireInterval: tripExpireInterval,
+		aggClient:          aggClient,
+		deadLetters:        deadLetters,
 	}, nil
 }
 
-func (c *KafkaConsumer) Start() {
+// Start consumes until Stop is called.
+func (c *KafkaConsumer) Start() error {
 	logrus.Info("kafka transport started")
-	c.isRunning = true
+	c.isRunning.Store(true)
+	defer close(c.done)
+	go c.expireTripsLoop()
 	c.readMessageLoop()
+	return nil
+}
+
+// Stop lets the message in flight finish, commits the offsets and leaves
+// the consumer group.
+func (c *KafkaConsumer) Stop(ctx context.Context) error {
+	c.isRunning.Store(false)
+	select {
+	case <-c.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if _, err := c.consumer.Commit(); err != nil {
+		// nothing was consumed since the last commit
+		if kerr, ok := err.(kafka.Error); !ok || kerr.Code() != kafka.ErrNoOffset {
+			logrus.Errorf("kafka commit error %s", err)
+		}
+	}
+	return c.consumer.Close()
 }
 
 func (c *KafkaConsumer) readMessageLoop() {
-	for c.isRunning {
+	for c.isRunning.Load() {
 		// msg di bawah ini bentuknya byte guys
-		msg, err := c.consumer.ReadMessage(-1)
+		msg, err := c.consumer.ReadMessage(time.Second)
 		if err != nil {
-			logrus.Errorf("Kafka consume error %s", err)
+			if kerr, ok := err.(kafka.Error); !ok || !kerr.IsTimeout() {
+				logrus.Errorf("Kafka consume error %s", err)
+			}
 			continue
 		}
-		var data types.OBUdata
-		if err := json.Unmarshal(msg.Value, &data); err != nil {
-			logrus.Errorf("JSON serialization error %s", err)
+		if err := c.handleMessage(msg); err != nil {
+			// the offset isn't stored, the message is read again
+			logrus.Errorf("%s, retrying %s", err, msg.TopicPartition)
+			if err := c.consumer.Seek(msg.TopicPartition, 0); err != nil {
+				logrus.Errorf("kafka seek error %s", err)
+			}
+			time.Sleep(time.Second)
 			continue
 		}
-		distance, err := c.calcService.CalculateDistance(data)
-		if err != nil {
-			logrus.Errorf("Calculation error %s", err)
+		if _, err := c.consumer.StoreMessage(msg); err != nil {
+			logrus.Errorf("kafka offset store error %s", err)
 		}
-		req := types.Distance{
-			Value: distance,
-			Unix:  time.Now().UnixNano(),
-			OBUID: data.OBUID,
+	}
+}
+
+// handleMessage fails if the distance of the reading could neither be
+// aggregated nor dead lettered.
+func (c *KafkaConsumer) handleMessage(msg *kafka.Message) error {
+	data, _, err := schema.Decode(c.registry, msg.Value)
+	if err != nil {
+		logrus.Errorf("schema decode error %s", err)
+		return nil
+	}
+	if data.Unix == 0 {
+		data.Unix = time.Now().UnixNano()
+	}
+	var distance float64
+	// the calculator moved on to this reading already
+	if c.failed.is(msg) {
+		distance = c.failed.distance
+	} else if distance, err = c.calcService.CalculateDistance(data); err != nil {
+		logrus.Errorf("Calculation error %s", err)
+	}
+	req := types.Distance{
+		Value: distance,
+		Unix:  data.Unix,
+		OBUID: data.OBUID,
+	}
+
+	// the reading still counts towards its trip, its distance is
+	// aggregated once the dead letter is replayed
+	if err := c.aggClient.AggregateInvoice(req); err != nil {
+		logrus.Errorf("aggregate error %s", err)
+		if err := c.deadLetter(types.DeadLetter{Distance: &req, Error: err.Error()}); err != nil {
+			c.failed = &failedMessage{partition: msg.TopicPartition, distance: distance}
+			return fmt.Errorf("dead letter error %w", err)
 		}
+	}
+	c.failed = nil
+	c.aggregateTrips(c.trips.Observe(data, distance))
+	return nil
+}
 
-		if err := c.aggClient.AggregateInvoice(req); err != nil {
-			logrus.Errorf("aggregate error", err)
-			continue
+func (c *KafkaConsumer) expireTripsLoop() {
+	ticker := time.NewTicker(c.tripExpireInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			c.aggregateTrips(c.trips.Expire(now))
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *KafkaConsumer) aggregateTrips(trips []types.Trip) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	trips = append(c.failedTrips, trips...)
+	c.failedTrips = nil
+	for _, trip := range trips {
+		if err := c.aggClient.AggregateTrip(trip); err != nil {
+			logrus.Errorf("aggregate trip error %s", err)
+			if err := c.deadLetter(types.DeadLetter{Trip: &trip, Error: err.Error()}); err != nil {
+				logrus.Errorf("dead letter error %s, retrying the trip later", err)
+				c.failedTrips = append(c.failedTrips, trip)
+			}
 		}
 	}
 }
+
+func (c *KafkaConsumer) deadLetter(letter types.DeadLetter) error {
+	letter.FailedAt = time.Now()
+	return c.deadLetters.Add(letter)
+}
+
+// Ready checks that the brokers answer and the consumer was assigned
+// partitions of the topic.
+func (c *KafkaConsumer) Ready(ctx context.Context) error {
+	timeout := 5 * time.Second
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+	if _, err := c.consumer.GetMetadata(&c.topic, false, int(timeout.Milliseconds())); err != nil {
+		return err
+	}
+	assigned, err := c.consumer.Assignment()
+	if err != nil {
+		return err
+	}
+	if len(assigned) == 0 {
+		return errors.New("no partitions assigned")
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/types"
+)
+
+// DeadLetterQueue keeps what couldn't be aggregated for tollctl dlq replay.
+type DeadLetterQueue interface {
+	Add(types.DeadLetter) error
+}
+
+type KafkaDeadLetterQueue struct {
+	producer *kafka.Producer
+	topic    string
+}
+
+func NewKafkaDeadLetterQueue(brokers, topic string) (*KafkaDeadLetterQueue, error) {
+	p, err := kafka.NewProducer(&kafka.ConfigMap{"bootstrap.servers": brokers})
+	if err != nil {
+		return nil, err
+	}
+	return &KafkaDeadLetterQueue{
+		producer: p,
+		topic:    topic,
+	}, nil
+}
+
+// Add waits for the dead letter to be delivered, the offset of the reading
+// it came from is only stored once it was.
+func (q *KafkaDeadLetterQueue) Add(letter types.DeadLetter) error {
+	b, err := json.Marshal(letter)
+	if err != nil {
+		return err
+	}
+	obuID := 0
+	if letter.Distance != nil {
+		obuID = letter.Distance.OBUID
+	} else if letter.Trip != nil {
+		obuID = letter.Trip.OBUID
+	}
+	delivered := make(chan kafka.Event, 1)
+	err = q.producer.Produce(&kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &q.topic, Partition: kafka.PartitionAny},
+		Key:            []byte(strconv.Itoa(obuID)),
+		Value:          b,
+	}, delivered)
+	if err != nil {
+		return err
+	}
+	if msg, ok := (<-delivered).(*kafka.Message); ok && msg.TopicPartition.Error != nil {
+		return msg.TopicPartition.Error
+	}
+	return nil
+}
+
+// Close waits for the dead letters still queued to be delivered and closes
+// the producer, giving up on them once ctx is done.
+func (q *KafkaDeadLetterQueue) Close(ctx context.Context) error {
+	defer q.producer.Close()
+	for {
+		n := q.producer.Flush(100)
+		if n == 0 {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return fmt.Errorf("%d dead letters were not delivered", n)
+		}
+	}
+}
@@ -2,16 +2,27 @@ package main
 
 import (
 	"log"
+	"net/http"
+	"os"
 
 	"github.com/tunangoo/full-time-go-dev/toll-calculator/aggregator/client"
-)
-
-const (
-	kafkaTopic         = "obuData"
-	aggregatorEndpoint = "http://localhost:3000/aggregate"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/config"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/health"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/run"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/schema"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		if err := runReplay(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	cfg := NewConfig()
+	config.MustLoad("calculator", cfg)
+
 	var (
 		err error
 		svc CalculatorServicer
@@ -24,9 +35,34 @@ func main() {
 
 	svc = NewLogMiddleware(svc)
 
-	kafkaConsumer, err := NewKafkaConsumer(kafkaTopic, svc, client.NewClient(aggregatorEndpoint))
+	registry, err := schema.LoadRegistry(cfg.SchemaRegistry)
 	if err != nil {
 		log.Fatal(err)
 	}
-	kafkaConsumer.Start()
+
+	trips := NewGapTripDetector(cfg.Trip.IgnitionGap, cfg.Trip.StationaryTimeout, cfg.Trip.MinMove)
+
+	deadLetters, err := NewKafkaDeadLetterQueue(cfg.Kafka.Brokers, cfg.DeadLetterTopic)
+	if err != nil {
+		log.Fatal(err)
+	}
+	kafkaConsumer, err := NewKafkaConsumer(cfg.Kafka, registry, svc, trips, cfg.Trip.ExpireInterval, client.NewClusterClient(cfg.Aggregators...), deadLetters)
+	if err != nil {
+		log.Fatal(err)
+	}
+	checks := health.New()
+	checks.Add("kafka", kafkaConsumer.Ready)
+	for _, endpoint := range cfg.Aggregators {
+		checks.Add("aggregator "+endpoint, health.Ping(endpoint))
+	}
+	checks.Register(http.DefaultServeMux)
+
+	g := run.New(cfg.ShutdownTimeout)
+	// stopped after the consumer, whose last dead letters are delivered
+	g.AddStop("dead letter producer", deadLetters.Close)
+	g.Add("kafka consumer", kafkaConsumer.Start, kafkaConsumer.Stop)
+	g.AddHTTPServer(&http.Server{Addr: cfg.ListenAddr})
+	if err := g.Run(); err != nil {
+		log.Fatal(err)
+	}
 }
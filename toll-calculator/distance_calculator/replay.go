@@ -0,0 +1,77 @@
+package main
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/aggregator/client"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/archive"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/config"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/types"
+)
+
+// runReplay streams an archived range of readings through a fresh
+// CalculatorService and into the aggregator, the same way the kafka
+// transport does. Point it at an empty aggregator to rebuild its state.
+func runReplay(args []string) error {
+	cfg := NewReplayConfig()
+	if err := config.Load("calculator", cfg, args); err != nil {
+		return err
+	}
+	from, err := time.Parse(time.RFC3339, cfg.From)
+	if err != nil {
+		return err
+	}
+	to, err := time.Parse(time.RFC3339, cfg.To)
+	if err != nil {
+		return err
+	}
+
+	var svc CalculatorServicer
+	svc, err = NewCalculatorService()
+	if err != nil {
+		return err
+	}
+	var (
+		trips     = NewGapTripDetector(cfg.Trip.IgnitionGap, cfg.Trip.StationaryTimeout, cfg.Trip.MinMove)
+		aggClient = client.NewClusterClient(cfg.Aggregators...)
+		count     int
+	)
+
+	err = archive.Read(cfg.Archive, from, to, func(data types.OBUdata) error {
+		distance, err := svc.CalculateDistance(data)
+		if err != nil {
+			return err
+		}
+		if err := aggClient.AggregateInvoice(types.Distance{
+			Value: distance,
+			Unix:  data.Unix,
+			OBUID: data.OBUID,
+		}); err != nil {
+			return err
+		}
+		for _, trip := range trips.Observe(data, distance) {
+			if err := aggClient.AggregateTrip(trip); err != nil {
+				return err
+			}
+		}
+		count++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// the range is over, so every trip still open is closed at its last reading
+	for _, trip := range trips.Expire(to.Add(cfg.Trip.IgnitionGap + 1)) {
+		if err := aggClient.AggregateTrip(trip); err != nil {
+			return err
+		}
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"from":     from,
+		"to":       to,
+		"readings": count,
+	}).Info("replay finished")
+	return nil
+}
@@ -1,32 +1,31 @@
 package main
 
 import (
-	"math"
-
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/geo"
 	"github.com/tunangoo/full-time-go-dev/toll-calculator/types"
 )
 
 type CalculatorServicer interface {
+	// CalculateDistance returns the kilometres driven since the previous
+	// reading of the OBU.
 	CalculateDistance(types.OBUdata) (float64, error)
 }
 
 type CalculatorService struct {
-	prevPoint []float64
+	prevPoints map[int][]float64
 }
 
 func NewCalculatorService() (*CalculatorService, error) {
-	return &CalculatorService{}, nil
+	return &CalculatorService{
+		prevPoints: make(map[int][]float64),
+	}, nil
 }
 
 func (c *CalculatorService) CalculateDistance(data types.OBUdata) (float64, error) {
 	distance := 0.0
-	if len(c.prevPoint) > 0 {
-		distance = calculateDistance(c.prevPoint[0], c.prevPoint[1], data.Lat, data.Long)
+	if prev, ok := c.prevPoints[data.OBUID]; ok {
+		distance = geo.Kilometres(prev[0], prev[1], data.Lat, data.Long)
 	}
-	c.prevPoint = []float64{data.Lat, data.Long}
+	c.prevPoints[data.OBUID] = []float64{data.Lat, data.Long}
 	return distance, nil
 }
-
-func calculateDistance(x1, x2, y1, y2 float64) float64 {
-	return math.Sqrt(math.Pow(x2-x1, 2) + math.Pow(y2-y1, 2))
-}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/types"
+)
+
+type TripDetector interface {
+	// Observe feeds a reading and the distance travelled since the previous
+	// reading of the same OBU. It returns the trips that got closed by it.
+	Observe(types.OBUdata, float64) []types.Trip
+	// Expire closes the trips of OBUs that stopped reporting.
+	Expire(time.Time) []types.Trip
+}
+
+type tripState struct {
+	last types.OBUdata
+	trip *types.Trip
+}
+
+type GapTripDetector struct {
+	mu sync.Mutex
+	// a silence longer than ignitionGap means the engine was switched off
+	ignitionGap time.Duration
+	// a trip ends when the OBU moved less than minMove for stationaryTimeout
+	stationaryTimeout time.Duration
+	minMove           float64
+	obus              map[int]*tripState
+}
+
+func NewGapTripDetector(ignitionGap, stationaryTimeout time.Duration, minMove float64) *GapTripDetector {
+	return &GapTripDetector{
+		ignitionGap:       ignitionGap,
+		stationaryTimeout: stationaryTimeout,
+		minMove:           minMove,
+		obus:              make(map[int]*tripState),
+	}
+}
+
+func (d *GapTripDetector) Observe(data types.OBUdata, dist float64) []types.Trip {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	st, ok := d.obus[data.OBUID]
+	if !ok {
+		d.obus[data.OBUID] = &tripState{last: data}
+		return nil
+	}
+
+	var closed []types.Trip
+	switch {
+	case time.Duration(data.Unix-st.last.Unix) > d.ignitionGap:
+		closed = st.close()
+	case dist >= d.minMove:
+		if st.trip == nil {
+			st.trip = &types.Trip{
+				OBUID:     data.OBUID,
+				StartUnix: st.last.Unix,
+				StartLat:  st.last.Lat,
+				StartLong: st.last.Long,
+			}
+		}
+		st.trip.Distance += dist
+		st.trip.EndUnix = data.Unix
+		st.trip.EndLat = data.Lat
+		st.trip.EndLong = data.Long
+	case st.trip != nil && time.Duration(data.Unix-st.trip.EndUnix) >= d.stationaryTimeout:
+		closed = st.close()
+	}
+	st.last = data
+	return closed
+}
+
+func (d *GapTripDetector) Expire(now time.Time) []types.Trip {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var closed []types.Trip
+	for id, st := range d.obus {
+		silent := time.Duration(now.UnixNano()-st.last.Unix) > d.ignitionGap
+		if st.trip != nil && (silent || time.Duration(now.UnixNano()-st.trip.EndUnix) >= d.stationaryTimeout) {
+			closed = append(closed, st.close()...)
+		}
+		if silent {
+			delete(d.obus, id)
+		}
+	}
+	return closed
+}
+
+func (s *tripState) close() []types.Trip {
+	if s.trip == nil {
+		return nil
+	}
+	trip := *s.trip
+	s.trip = nil
+	return []types.Trip{trip}
+}
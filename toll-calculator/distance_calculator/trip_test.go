@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/types"
+)
+
+var tripStart = time.Date(2026, 10, 19, 8, 0, 0, 0, time.UTC)
+
+func reading(at time.Duration, lat float64) types.OBUdata {
+	return types.OBUdata{OBUID: 1, Lat: lat, Long: 4.89, Unix: tripStart.Add(at).UnixNano()}
+}
+
+func TestTripEndsStandingStill(t *testing.T) {
+	d := NewGapTripDetector(5*time.Minute, 3*time.Minute, 0.01)
+	steps := []struct {
+		data types.OBUdata
+		dist float64
+	}{
+		{reading(0, 52.30), 0},
+		{reading(10*time.Second, 52.31), 0.5},
+		{reading(20*time.Second, 52.32), 0.5},
+		{reading(time.Minute, 52.32), 0},
+		{reading(2*time.Minute, 52.32), 0},
+	}
+	for _, s := range steps {
+		if closed := d.Observe(s.data, s.dist); len(closed) > 0 {
+			t.Fatalf("trip closed at %d: %+v", s.data.Unix, closed)
+		}
+	}
+	closed := d.Observe(reading(20*time.Second+3*time.Minute, 52.32), 0)
+	if len(closed) != 1 {
+		t.Fatalf("got %d trips after standing still, want 1", len(closed))
+	}
+	trip := closed[0]
+	if trip.Distance != 1 || trip.StartUnix != reading(0, 0).Unix || trip.EndUnix != reading(20*time.Second, 0).Unix {
+		t.Errorf("trip = %+v, want 1 km from 0s to 20s", trip)
+	}
+	if trip.StartLat != 52.30 || trip.EndLat != 52.32 {
+		t.Errorf("trip from %v to %v, want from 52.30 to 52.32", trip.StartLat, trip.EndLat)
+	}
+}
+
+func TestTripEndsOnIgnitionGap(t *testing.T) {
+	d := NewGapTripDetector(5*time.Minute, 3*time.Minute, 0.01)
+	d.Observe(reading(0, 52.30), 0)
+	d.Observe(reading(10*time.Second, 52.31), 0.5)
+	// the distance across the gap is not part of the trip
+	closed := d.Observe(reading(10*time.Minute, 52.40), 7)
+	if len(closed) != 1 || closed[0].Distance != 0.5 {
+		t.Fatalf("got %+v after the ignition gap, want a trip of 0.5 km", closed)
+	}
+	if closed := d.Observe(reading(10*time.Minute+10*time.Second, 52.41), 0.5); len(closed) != 0 {
+		t.Errorf("the next trip closed right away: %+v", closed)
+	}
+}
+
+func TestExpireSilentOBU(t *testing.T) {
+	d := NewGapTripDetector(5*time.Minute, 3*time.Minute, 0.01)
+	d.Observe(reading(0, 52.30), 0)
+	d.Observe(reading(10*time.Second, 52.31), 0.5)
+	if closed := d.Expire(tripStart.Add(time.Minute)); len(closed) != 0 {
+		t.Fatalf("expired a trip that is still going: %+v", closed)
+	}
+	if closed := d.Expire(tripStart.Add(10 * time.Minute)); len(closed) != 1 {
+		t.Fatalf("got %d trips of the silent OBU, want 1", len(closed))
+	}
+	if _, ok := d.obus[1]; ok {
+		t.Error("the silent OBU is still tracked")
+	}
+}
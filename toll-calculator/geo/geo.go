@@ -0,0 +1,64 @@
+// Package geo measures how far OBUs drove. Distances are kilometres along
+// the great circle, billed in whole metres.
+package geo
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// the mean radius of the earth
+const earthRadiusKm = 6371.0088
+
+// Kilometres is the great circle distance between two coordinates, in
+// degrees.
+func Kilometres(lat1, long1, lat2, long2 float64) float64 {
+	var (
+		phi1 = lat1 * math.Pi / 180
+		phi2 = lat2 * math.Pi / 180
+		dPhi = (lat2 - lat1) * math.Pi / 180
+		dLam = (long2 - long1) * math.Pi / 180
+	)
+	a := math.Sin(dPhi/2)*math.Sin(dPhi/2) + math.Cos(phi1)*math.Cos(phi2)*math.Sin(dLam/2)*math.Sin(dLam/2)
+	return 2 * earthRadiusKm * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+// Distance is a billed distance in whole metres. In JSON it is kilometres
+// with three decimals.
+type Distance int64
+
+// FromKm rounds km to the nearest metre, halves away from zero.
+func FromKm(km float64) Distance {
+	return Distance(math.Round(km * 1000))
+}
+
+func (d Distance) Km() float64 {
+	return float64(d) / 1000
+}
+
+// String formats d as kilometres with three decimals.
+func (d Distance) String() string {
+	sign := ""
+	if d < 0 {
+		sign, d = "-", -d
+	}
+	return fmt.Sprintf("%s%d.%03d", sign, d/1000, d%1000)
+}
+
+func (d Distance) MarshalJSON() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// UnmarshalJSON reads kilometres, given as a number or a string, and rounds
+// them to the metre.
+func (d *Distance) UnmarshalJSON(b []byte) error {
+	s := strings.Trim(string(b), `"`)
+	km, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return fmt.Errorf("invalid distance %s", b)
+	}
+	*d = FromKm(km)
+	return nil
+}
@@ -0,0 +1,42 @@
+package geo
+
+import "testing"
+
+func TestDistanceString(t *testing.T) {
+	tests := []struct {
+		d    Distance
+		want string
+	}{
+		{0, "0.000"},
+		{1, "0.001"},
+		{999, "0.999"},
+		{1500, "1.500"},
+		{123_456, "123.456"},
+		{-1, "-0.001"},
+		{-1500, "-1.500"},
+		{-123_456, "-123.456"},
+	}
+	for _, tt := range tests {
+		if got := tt.d.String(); got != tt.want {
+			t.Errorf("Distance(%d).String() = %q, want %q", int64(tt.d), got, tt.want)
+		}
+	}
+}
+
+func TestFromKm(t *testing.T) {
+	tests := []struct {
+		km   float64
+		want Distance
+	}{
+		{1.5, 1500},
+		{0.0004, 0},
+		{0.0006, 1},
+		{-0.0006, -1},
+		{12.3456, 12_346},
+	}
+	for _, tt := range tests {
+		if got := FromKm(tt.km); got != tt.want {
+			t.Errorf("FromKm(%v) = %d, want %d", tt.km, got, tt.want)
+		}
+	}
+}
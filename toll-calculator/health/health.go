@@ -0,0 +1,167 @@
+// Package health serves the liveness and readiness probes of a service.
+// /healthz answers as long as the process serves HTTP, /readyz runs the
+// checks of the dependencies the service can't work without and fails if
+// any of them does.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	StatusOK   = "ok"
+	StatusFail = "fail"
+)
+
+// how long a single check may take, a probe shouldn't hang for longer
+// than an orchestrator waits for it
+const checkTimeout = 2 * time.Second
+
+// Check returns why a dependency is unusable, or nil if it is fine. It
+// should give up once ctx is done.
+type Check func(ctx context.Context) error
+
+// Result is the outcome of one check.
+type Result struct {
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+// Report is the body of /readyz.
+type Report struct {
+	Status string            `json:"status"`
+	Checks map[string]Result `json:"checks"`
+}
+
+type namedCheck struct {
+	name  string
+	check Check
+}
+
+type Checker struct {
+	checks []namedCheck
+}
+
+func New() *Checker {
+	return &Checker{}
+}
+
+// Add adds a readiness check, checks run concurrently.
+func (c *Checker) Add(name string, check Check) {
+	c.checks = append(c.checks, namedCheck{name: name, check: check})
+}
+
+// Register serves /healthz and /readyz on mux.
+func (c *Checker) Register(mux *http.ServeMux) {
+	mux.HandleFunc("GET /healthz", c.handleHealthz)
+	mux.HandleFunc("GET /readyz", c.handleReadyz)
+}
+
+// Run runs all checks.
+func (c *Checker) Run(ctx context.Context) Report {
+	var (
+		mu     sync.Mutex
+		wg     sync.WaitGroup
+		report = Report{Status: StatusOK, Checks: make(map[string]Result, len(c.checks))}
+	)
+	for _, nc := range c.checks {
+		wg.Add(1)
+		go func(nc namedCheck) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+			defer cancel()
+			start := time.Now()
+			err := run(ctx, nc.check)
+			res := Result{Status: StatusOK, Duration: time.Since(start).String()}
+			if err != nil {
+				res.Status, res.Error = StatusFail, err.Error()
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			report.Checks[nc.name] = res
+			if err != nil {
+				report.Status = StatusFail
+			}
+		}(nc)
+	}
+	wg.Wait()
+	return report
+}
+
+// run runs check, a check that doesn't return once ctx is done fails
+// anyway.
+func run(ctx context.Context, check Check) error {
+	errc := make(chan error, 1)
+	go func() {
+		errc <- check(ctx)
+	}()
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *Checker) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": StatusOK})
+}
+
+func (c *Checker) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	report := c.Run(r.Context())
+	status := http.StatusOK
+	if report.Status != StatusOK {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, report)
+}
+
+// Writable checks that files can be created in dir, which is what a file
+// backed store needs of its disk. dir is created like the stores do.
+func Writable(dir string) Check {
+	return func(context.Context) error {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+		f, err := os.CreateTemp(dir, ".healthz-*")
+		if err != nil {
+			return err
+		}
+		name := f.Name()
+		return errors.Join(f.Close(), os.Remove(name))
+	}
+}
+
+// Ping checks that endpoint's /healthz answers with 200.
+func Ping(endpoint string) Check {
+	return func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, "GET", endpoint+"/healthz", nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("%s responded with status code %d", endpoint, resp.StatusCode)
+		}
+		return nil
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(v)
+}
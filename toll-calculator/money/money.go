@@ -0,0 +1,254 @@
+// Package money does exact arithmetic on amounts and prices.
+//
+// Amounts are whole cents, hundredths of the unit of their currency, and
+// prices are millionths of the unit per kilometre, so class prices like
+// 1.575 are exact. The currency is carried by whatever holds the amounts.
+//
+// Rates are millionths as well, for tax rates and exchange rates.
+//
+// Rounding happens per line item: Price.Charge rounds what a line costs and
+// Rate.Of the tax of a tax line to the cent, halves away from zero. Totals
+// are sums of the rounded lines and are never rounded again. A price
+// converted to another currency with Rate.Convert is rounded to the
+// millionth before anything is charged at it.
+package money
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/geo"
+)
+
+const (
+	centsPerUnit  = 100
+	microsPerUnit = 1_000_000
+)
+
+var ErrInvalidAmount = errors.New("invalid amount")
+
+// ValidCurrency tells whether code looks like an ISO 4217 code, three upper
+// case letters.
+func ValidCurrency(code string) bool {
+	if len(code) != 3 {
+		return false
+	}
+	for _, r := range code {
+		if r < 'A' || r > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// Amount is an amount of money in cents. In JSON it is a number with two
+// decimals.
+type Amount int64
+
+// ParseAmount parses a decimal like "12.3" or "-0.05". More than two
+// decimals are refused rather than rounded.
+func ParseAmount(s string) (Amount, error) {
+	n, err := parseDecimal(s, 2)
+	if err != nil {
+		return 0, fmt.Errorf("%w %q", ErrInvalidAmount, s)
+	}
+	return Amount(n), nil
+}
+
+func (a Amount) String() string {
+	return formatDecimal(int64(a), 2, 2)
+}
+
+func (a Amount) MarshalJSON() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+// UnmarshalJSON takes a number or a string, null leaves a as it is.
+func (a *Amount) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		return nil
+	}
+	v, err := ParseAmount(strings.Trim(string(b), `"`))
+	if err != nil {
+		return err
+	}
+	*a = v
+	return nil
+}
+
+// Price is a price per kilometre in millionths of the currency unit. In
+// JSON it is a number with at least two decimals.
+type Price int64
+
+// ParsePrice parses a decimal with up to six decimals.
+func ParsePrice(s string) (Price, error) {
+	n, err := parseDecimal(s, 6)
+	if err != nil {
+		return 0, fmt.Errorf("invalid price %q", s)
+	}
+	return Price(n), nil
+}
+
+// MustParsePrice is for prices known at compile time.
+func MustParsePrice(s string) Price {
+	p, err := ParsePrice(s)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+func (p Price) String() string {
+	return formatDecimal(int64(p), 6, 2)
+}
+
+func (p Price) MarshalJSON() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+func (p *Price) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		return nil
+	}
+	v, err := ParsePrice(strings.Trim(string(b), `"`))
+	if err != nil {
+		return err
+	}
+	*p = v
+	return nil
+}
+
+// Charge is what driving d costs at p, rounded to the cent with halves
+// away from zero.
+func (p Price) Charge(d geo.Distance) Amount {
+	// micros per km * metres, in cents: / 1000 / (microsPerUnit / centsPerUnit)
+	n := new(big.Int).Mul(big.NewInt(int64(p)), big.NewInt(int64(d)))
+	return Amount(roundDiv(n, big.NewInt(1000*microsPerUnit/centsPerUnit)))
+}
+
+// Allocate splits a over weights pro rata, every share rounded to the cent
+// with halves away from zero. The shares add up to a, the rounding of each
+// is carried over to the next. Weights must not add up to zero.
+func Allocate(a Amount, weights []Amount) []Amount {
+	var total Amount
+	for _, w := range weights {
+		total += w
+	}
+	var (
+		shares       = make([]Amount, len(weights))
+		upto, shared Amount
+	)
+	for i, w := range weights {
+		upto += w
+		n := new(big.Int).Mul(big.NewInt(int64(a)), big.NewInt(int64(upto)))
+		shares[i] = Amount(roundDiv(n, big.NewInt(int64(total)))) - shared
+		shared += shares[i]
+	}
+	return shares
+}
+
+// Rate is a ratio in millionths: a tax rate of 0.21 or the exchange rate
+// 1.0825 of two currencies. In JSON it is a number.
+type Rate int64
+
+// ParseRate parses a decimal with up to six decimals.
+func ParseRate(s string) (Rate, error) {
+	n, err := parseDecimal(s, 6)
+	if err != nil {
+		return 0, fmt.Errorf("invalid rate %q", s)
+	}
+	return Rate(n), nil
+}
+
+func (r Rate) String() string {
+	return formatDecimal(int64(r), 6, 0)
+}
+
+// Percent formats r as a percentage, 0.21 is "21".
+func (r Rate) Percent() string {
+	return formatDecimal(int64(r), 4, 0)
+}
+
+func (r Rate) MarshalJSON() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+func (r *Rate) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		return nil
+	}
+	v, err := ParseRate(strings.Trim(string(b), `"`))
+	if err != nil {
+		return err
+	}
+	*r = v
+	return nil
+}
+
+// Of is r of a, rounded to the cent with halves away from zero.
+func (r Rate) Of(a Amount) Amount {
+	n := new(big.Int).Mul(big.NewInt(int64(r)), big.NewInt(int64(a)))
+	return Amount(roundDiv(n, big.NewInt(microsPerUnit)))
+}
+
+// Convert converts p with the exchange rate r, rounded to the millionth
+// with halves away from zero.
+func (r Rate) Convert(p Price) Price {
+	n := new(big.Int).Mul(big.NewInt(int64(r)), big.NewInt(int64(p)))
+	return Price(roundDiv(n, big.NewInt(microsPerUnit)))
+}
+
+// roundDiv divides n by the positive d, rounding halves away from zero.
+func roundDiv(n, d *big.Int) int64 {
+	q, r := new(big.Int).QuoRem(n, d, new(big.Int))
+	if new(big.Int).Mul(new(big.Int).Abs(r), big.NewInt(2)).Cmp(d) >= 0 {
+		if n.Sign() < 0 {
+			q.Sub(q, big.NewInt(1))
+		} else {
+			q.Add(q, big.NewInt(1))
+		}
+	}
+	return q.Int64()
+}
+
+// parseDecimal parses s into an integer of 10^-scale units.
+func parseDecimal(s string, scale int) (int64, error) {
+	neg := strings.HasPrefix(s, "-")
+	if neg || strings.HasPrefix(s, "+") {
+		s = s[1:]
+	}
+	whole, frac, _ := strings.Cut(s, ".")
+	if whole == "" && frac == "" || len(frac) > scale || strings.ContainsAny(whole+frac, "+-") {
+		return 0, errors.New("invalid decimal")
+	}
+	r, ok := new(big.Int).SetString(whole+frac+strings.Repeat("0", scale-len(frac)), 10)
+	if !ok || !r.IsInt64() {
+		return 0, errors.New("invalid decimal")
+	}
+	if neg {
+		r.Neg(r)
+	}
+	return r.Int64(), nil
+}
+
+// formatDecimal formats n 10^-scale units with at least min decimals.
+func formatDecimal(n int64, scale, min int) string {
+	sign := ""
+	if n < 0 {
+		sign = "-"
+	}
+	s := new(big.Int).Abs(big.NewInt(n)).String()
+	if len(s) <= scale {
+		s = strings.Repeat("0", scale-len(s)+1) + s
+	}
+	whole, frac := s[:len(s)-scale], strings.TrimRight(s[len(s)-scale:], "0")
+	if len(frac) < min {
+		frac += strings.Repeat("0", min-len(frac))
+	}
+	if frac == "" {
+		return sign + whole
+	}
+	return sign + whole + "." + frac
+}
@@ -0,0 +1,190 @@
+package money
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/geo"
+)
+
+func TestPriceCharge(t *testing.T) {
+	tests := []struct {
+		price Price
+		d     geo.Distance
+		want  Amount
+	}{
+		{MustParsePrice("3.15"), 1000, 315},
+		{MustParsePrice("1.575"), 10_000, 1575},
+		{MustParsePrice("1.575"), 333, 52},
+		// 157.5 cents
+		{MustParsePrice("1.575"), 1000, 158},
+		{MustParsePrice("1.575"), -1000, -158},
+		{MustParsePrice("1.00"), 5, 1},
+		{MustParsePrice("1.00"), -5, -1},
+		{MustParsePrice("1.00"), 4, 0},
+		{MustParsePrice("1.575"), 1, 0},
+		{MustParsePrice("3.15"), 0, 0},
+	}
+	for _, tt := range tests {
+		if got := tt.price.Charge(tt.d); got != tt.want {
+			t.Errorf("%s.Charge(%s) = %s, want %s", tt.price, tt.d, got, tt.want)
+		}
+	}
+}
+
+func TestRateOf(t *testing.T) {
+	tests := []struct {
+		rate Rate
+		a    Amount
+		want Amount
+	}{
+		{210_000, 1000, 210},
+		{210_000, 315, 66},
+		{210_000, -1000, -210},
+		{210_000, 1, 0},
+		{210_000, 3, 1},
+		{500_000, 1, 1},
+		{500_000, -1, -1},
+		{50_000, 10, 1},
+		{0, 1000, 0},
+	}
+	for _, tt := range tests {
+		if got := tt.rate.Of(tt.a); got != tt.want {
+			t.Errorf("%s.Of(%s) = %s, want %s", tt.rate, tt.a, got, tt.want)
+		}
+	}
+}
+
+func TestRateConvert(t *testing.T) {
+	tests := []struct {
+		rate Rate
+		p    Price
+		want Price
+	}{
+		{1_082_500, MustParsePrice("3.15"), 3_409_875},
+		// 1.3499325
+		{857_100, MustParsePrice("1.575"), 1_349_933},
+		{857_100, MustParsePrice("-1.575"), -1_349_933},
+		{500_000, 1, 1},
+		{500_000, -1, -1},
+		{1_000_000, MustParsePrice("6.30"), MustParsePrice("6.30")},
+	}
+	for _, tt := range tests {
+		if got := tt.rate.Convert(tt.p); got != tt.want {
+			t.Errorf("%s.Convert(%s) = %s, want %s", tt.rate, tt.p, got, tt.want)
+		}
+	}
+}
+
+func TestParseDecimal(t *testing.T) {
+	tests := []struct {
+		s       string
+		scale   int
+		want    int64
+		wantErr bool
+	}{
+		{s: "12.3", scale: 2, want: 1230},
+		{s: "-0.05", scale: 2, want: -5},
+		{s: "0.5", scale: 2, want: 50},
+		{s: ".5", scale: 2, want: 50},
+		{s: "5.", scale: 2, want: 500},
+		{s: "+1", scale: 2, want: 100},
+		{s: "-0", scale: 2, want: 0},
+		{s: "1.575", scale: 6, want: 1_575_000},
+		{s: "0.000001", scale: 6, want: 1},
+		{s: "-0.000001", scale: 6, want: -1},
+		{s: "1.234", scale: 2, wantErr: true},
+		{s: "", scale: 2, wantErr: true},
+		{s: "-", scale: 2, wantErr: true},
+		{s: ".", scale: 2, wantErr: true},
+		{s: "--1", scale: 2, wantErr: true},
+		{s: "1-2", scale: 2, wantErr: true},
+		{s: "1e3", scale: 2, wantErr: true},
+		{s: "abc", scale: 2, wantErr: true},
+		{s: "99999999999999999999", scale: 2, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseDecimal(tt.s, tt.scale)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseDecimal(%q, %d) error = %v, want error %t", tt.s, tt.scale, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseDecimal(%q, %d) = %d, want %d", tt.s, tt.scale, got, tt.want)
+		}
+	}
+}
+
+func TestFormatDecimal(t *testing.T) {
+	tests := []struct {
+		n          int64
+		scale, min int
+		want       string
+	}{
+		{1230, 2, 2, "12.30"},
+		{5, 2, 2, "0.05"},
+		{-5, 2, 2, "-0.05"},
+		{-50, 2, 2, "-0.50"},
+		{-99, 2, 2, "-0.99"},
+		{-100, 2, 2, "-1.00"},
+		{0, 2, 2, "0.00"},
+		{1_575_000, 6, 2, "1.575"},
+		{3_000_000, 6, 2, "3.00"},
+		{210_000, 6, 0, "0.21"},
+		{1_000_000, 6, 0, "1"},
+		{1, 6, 0, "0.000001"},
+		{-1, 6, 0, "-0.000001"},
+		{0, 6, 0, "0"},
+		{210_000, 4, 0, "21"},
+	}
+	for _, tt := range tests {
+		if got := formatDecimal(tt.n, tt.scale, tt.min); got != tt.want {
+			t.Errorf("formatDecimal(%d, %d, %d) = %q, want %q", tt.n, tt.scale, tt.min, got, tt.want)
+		}
+	}
+}
+
+func TestAllocate(t *testing.T) {
+	tests := []struct {
+		a       Amount
+		weights []Amount
+		want    []Amount
+	}{
+		{-473, []Amount{3150, 1575}, []Amount{-315, -158}},
+		{100, []Amount{1, 1, 1}, []Amount{33, 34, 33}},
+		{-100, []Amount{1, 1, 1}, []Amount{-33, -34, -33}},
+		{1, []Amount{1, 1}, []Amount{1, 0}},
+		{-4725, []Amount{3150, 1575}, []Amount{-3150, -1575}},
+		{0, []Amount{5, 5}, []Amount{0, 0}},
+		{10, []Amount{0, 5}, []Amount{0, 10}},
+	}
+	for _, tt := range tests {
+		got := Allocate(tt.a, tt.weights)
+		var sum Amount
+		for i := range got {
+			sum += got[i]
+			if got[i] != tt.want[i] {
+				t.Errorf("Allocate(%s, %v) = %v, want %v", tt.a, tt.weights, got, tt.want)
+				break
+			}
+		}
+		if sum != tt.a {
+			t.Errorf("Allocate(%s, %v) adds up to %s", tt.a, tt.weights, sum)
+		}
+	}
+}
+
+func TestUnmarshalNull(t *testing.T) {
+	var v struct {
+		Amount Amount `json:"amount"`
+		Price  Price  `json:"price"`
+		Rate   Rate   `json:"rate"`
+	}
+	v.Amount, v.Price, v.Rate = 315, 3_150_000, 210_000
+	if err := json.Unmarshal([]byte(`{"amount": null, "price": null, "rate": null}`), &v); err != nil {
+		t.Fatal(err)
+	}
+	if v.Amount != 315 || v.Price != 3_150_000 || v.Rate != 210_000 {
+		t.Errorf("null changed the values to %s %s %s", v.Amount, v.Price, v.Rate)
+	}
+}
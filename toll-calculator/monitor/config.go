@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/config"
+)
+
+type Config struct {
+	Kafka          config.Kafka `yaml:"kafka"`
+	SchemaRegistry string       `yaml:"schemaRegistry" usage:"the schema registry file"`
+	ListenAddr     string       `yaml:"listenAddr" usage:"the listen address of the alert API"`
+	// thresholds
+	SilentAfter   time.Duration `yaml:"silentAfter" usage:"an OBU not heard of for this long is silent"`
+	StuckAfter    time.Duration `yaml:"stuckAfter" usage:"an OBU reporting the exact same position for this long is stuck"`
+	MaxSpeed      float64       `yaml:"maxSpeed" usage:"the fastest an OBU can plausibly move, in km/h"`
+	ResolveAfter  time.Duration `yaml:"resolveAfter" usage:"a teleport alert resolves after the OBU moved plausibly for this long"`
+	CheckInterval time.Duration `yaml:"checkInterval" usage:"how often OBUs are checked for silence"`
+	KeepResolved  int           `yaml:"keepResolved" usage:"how many resolved alerts are kept for the API"`
+	// empty only logs alerts
+	Webhook         string        `yaml:"webhook" usage:"the URL alerts are posted to when they fire or resolve, empty only logs them"`
+	WebhookTimeout  time.Duration `yaml:"webhookTimeout" usage:"how long posting an alert to the webhook may take"`
+	WebhookQueue    int           `yaml:"webhookQueue" usage:"how many alerts may wait to be posted to the webhook before new ones are dropped"`
+	ShutdownTimeout time.Duration `yaml:"shutdownTimeout" usage:"how long the service gets to stop on SIGTERM"`
+}
+
+func NewConfig() *Config {
+	return &Config{
+		Kafka: config.Kafka{
+			Brokers: "localhost",
+			Topic:   "obuData",
+			GroupID: "monitor",
+		},
+		SchemaRegistry:  "./schemas/registry.json",
+		ListenAddr:      ":3003",
+		SilentAfter:     10 * time.Minute,
+		StuckAfter:      10 * time.Minute,
+		MaxSpeed:        300,
+		ResolveAfter:    5 * time.Minute,
+		CheckInterval:   30 * time.Second,
+		KeepResolved:    1000,
+		WebhookTimeout:  5 * time.Second,
+		WebhookQueue:    256,
+		ShutdownTimeout: 10 * time.Second,
+	}
+}
+
+func (c *Config) Validate() error {
+	if err := c.Kafka.Validate(); err != nil {
+		return err
+	}
+	if c.Kafka.GroupID == "" {
+		return errors.New("kafka.groupID is required")
+	}
+	if c.ListenAddr == "" {
+		return errors.New("listenAddr is required")
+	}
+	if c.SilentAfter <= 0 || c.StuckAfter <= 0 || c.ResolveAfter <= 0 || c.CheckInterval <= 0 {
+		return errors.New("alert durations must be positive")
+	}
+	if c.MaxSpeed <= 0 {
+		return errors.New("maxSpeed must be positive")
+	}
+	if c.KeepResolved < 0 {
+		return errors.New("keepResolved must not be negative")
+	}
+	if c.WebhookTimeout <= 0 {
+		return errors.New("webhookTimeout must be positive")
+	}
+	if c.WebhookQueue < 1 {
+		return errors.New("webhookQueue must be at least 1")
+	}
+	if c.ShutdownTimeout <= 0 {
+		return errors.New("shutdownTimeout must be positive")
+	}
+	return nil
+}
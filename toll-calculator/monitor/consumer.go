@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/sirupsen/logrus"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/config"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/schema"
+)
+
+type KafkaConsumer struct {
+	consumer  *kafka.Consumer
+	topic     string
+	isRunning atomic.Bool
+	// closed once the read loop finished the message it was on
+	done     chan struct{}
+	registry *schema.Registry
+	monitor  *Monitor
+}
+
+func NewKafkaConsumer(cfg config.Kafka, registry *schema.Registry, m *Monitor) (*KafkaConsumer, error) {
+	c, err := kafka.NewConsumer(&kafka.ConfigMap{
+		"bootstrap.servers": cfg.Brokers,
+		"group.id":          cfg.GroupID,
+		"auto.offset.reset": "earliest",
+		// offsets are stored once a reading was observed, and committed
+		// from there, so a restart doesn't skip the reading in flight
+		"enable.auto.offset.store": false,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.SubscribeTopics([]string{cfg.Topic}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &KafkaConsumer{
+		consumer: c,
+		topic:    cfg.Topic,
+		done:     make(chan struct{}),
+		registry: registry,
+		monitor:  m,
+	}, nil
+}
+
+// Start consumes until Stop is called.
+func (c *KafkaConsumer) Start() error {
+	logrus.Info("kafka monitor started")
+	c.isRunning.Store(true)
+	defer close(c.done)
+	c.readMessageLoop()
+	return nil
+}
+
+// Stop lets the reading in flight be observed, commits the offsets and
+// leaves the consumer group.
+func (c *KafkaConsumer) Stop(ctx context.Context) error {
+	c.isRunning.Store(false)
+	select {
+	case <-c.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if _, err := c.consumer.Commit(); err != nil {
+		// nothing was consumed since the last commit
+		if kerr, ok := err.(kafka.Error); !ok || kerr.Code() != kafka.ErrNoOffset {
+			logrus.Errorf("kafka commit error %s", err)
+		}
+	}
+	return c.consumer.Close()
+}
+
+func (c *KafkaConsumer) readMessageLoop() {
+	for c.isRunning.Load() {
+		msg, err := c.consumer.ReadMessage(time.Second)
+		if err != nil {
+			if kerr, ok := err.(kafka.Error); !ok || !kerr.IsTimeout() {
+				logrus.Errorf("Kafka consume error %s", err)
+			}
+			continue
+		}
+		c.handleMessage(msg)
+		if _, err := c.consumer.StoreMessage(msg); err != nil {
+			logrus.Errorf("kafka offset store error %s", err)
+		}
+	}
+}
+
+func (c *KafkaConsumer) handleMessage(msg *kafka.Message) {
+	data, _, err := schema.Decode(c.registry, msg.Value)
+	if err != nil {
+		logrus.Errorf("schema decode error %s", err)
+		return
+	}
+	if data.Unix == 0 {
+		data.Unix = msg.Timestamp.UnixNano()
+	}
+	c.monitor.Observe(data)
+}
+
+// Ready checks that the brokers answer and the consumer was assigned
+// partitions of the topic.
+func (c *KafkaConsumer) Ready(ctx context.Context) error {
+	timeout := 5 * time.Second
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+	if _, err := c.consumer.GetMetadata(&c.topic, false, int(timeout.Milliseconds())); err != nil {
+		return err
+	}
+	assigned, err := c.consumer.Assignment()
+	if err != nil {
+		return err
+	}
+	if len(assigned) == 0 {
+		return errors.New("no partitions assigned")
+	}
+	return nil
+}
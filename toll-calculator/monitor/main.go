@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/config"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/health"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/run"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/schema"
+)
+
+func main() {
+	cfg := NewConfig()
+	config.MustLoad("monitor", cfg)
+
+	registry, err := schema.LoadRegistry(cfg.SchemaRegistry)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	g := run.New(cfg.ShutdownTimeout)
+	var notifier AlertNotifier = LogNotifier{}
+	if cfg.Webhook != "" {
+		// stopped after the consumer and the checks, the alerts they
+		// raised last are still posted
+		queue := NewQueueNotifier(NewWebhookNotifier(cfg.Webhook, cfg.WebhookTimeout), cfg.WebhookQueue)
+		g.Add("webhook", queue.Start, queue.Close)
+		notifier = queue
+	}
+	monitor := NewMonitor(cfg, notifier)
+	kafkaConsumer, err := NewKafkaConsumer(cfg.Kafka, registry, monitor)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	checks := health.New()
+	checks.Add("kafka", kafkaConsumer.Ready)
+	checks.Register(http.DefaultServeMux)
+	http.HandleFunc("GET /alerts", handleAlerts(monitor))
+	http.HandleFunc("GET /obus", handleStatuses(monitor))
+	fmt.Println("HTTP Transport running on port", cfg.ListenAddr)
+
+	checkCtx, stopChecks := context.WithCancel(context.Background())
+	g.Add("silence check", func() error {
+		monitor.Run(checkCtx, cfg.CheckInterval)
+		return nil
+	}, func(context.Context) error {
+		stopChecks()
+		return nil
+	})
+	g.Add("kafka consumer", kafkaConsumer.Start, kafkaConsumer.Stop)
+	g.AddHTTPServer(&http.Server{Addr: cfg.ListenAddr})
+	if err := g.Run(); err != nil {
+		log.Fatal(err)
+	}
+}
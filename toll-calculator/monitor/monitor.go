@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/geo"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/types"
+)
+
+type AlertNotifier interface {
+	NotifyAlert(types.Alert) error
+}
+
+type alertKey struct {
+	obuID int
+	kind  types.AlertKind
+}
+
+type obuTrack struct {
+	status types.OBUStatus
+	// the reading time since which the OBU reports the same position
+	stuckSince time.Time
+	// when the OBU last moved faster than MaxSpeed
+	lastJump time.Time
+}
+
+// Monitor watches the readings of every OBU for silence, teleports and
+// stuck positions. Its state lives in memory, after a restart an OBU is
+// watched again from its first reading.
+type Monitor struct {
+	mu       sync.Mutex
+	cfg      *Config
+	obus     map[int]*obuTrack
+	firing   map[alertKey]*types.Alert
+	resolved []types.Alert
+	notifier AlertNotifier
+}
+
+func NewMonitor(cfg *Config, notifier AlertNotifier) *Monitor {
+	return &Monitor{
+		cfg:      cfg,
+		obus:     make(map[int]*obuTrack),
+		firing:   make(map[alertKey]*types.Alert),
+		notifier: notifier,
+	}
+}
+
+// Observe checks a reading against the previous one of the OBU.
+func (m *Monitor) Observe(data types.OBUdata) {
+	var (
+		now     = time.Now()
+		at      = time.Unix(0, data.Unix)
+		changes []types.Alert
+	)
+	m.mu.Lock()
+	defer func() {
+		m.mu.Unlock()
+		m.notify(changes)
+	}()
+
+	t, ok := m.obus[data.OBUID]
+	if !ok {
+		m.obus[data.OBUID] = &obuTrack{
+			status: types.OBUStatus{
+				OBUID:     data.OBUID,
+				LastSeen:  now,
+				Lat:       data.Lat,
+				Long:      data.Long,
+				ReadingAt: at,
+			},
+			stuckSince: at,
+		}
+		return
+	}
+	t.status.LastSeen = now
+	changes = m.resolve(changes, data.OBUID, types.AlertSilent, now)
+	// readings an OBU buffered while offline arrive after newer ones, they
+	// only tell it is alive
+	if !at.After(t.status.ReadingAt) {
+		return
+	}
+
+	var (
+		prev    = t.status
+		dist    = geo.Kilometres(prev.Lat, prev.Long, data.Lat, data.Long)
+		elapsed = at.Sub(prev.ReadingAt)
+	)
+	if dist/elapsed.Hours() > m.cfg.MaxSpeed {
+		t.lastJump = now
+		changes = m.fire(changes, data.OBUID, types.AlertTeleport, now,
+			fmt.Sprintf("moved %.3f km in %s, from %.5f,%.5f to %.5f,%.5f", dist, elapsed, prev.Lat, prev.Long, data.Lat, data.Long))
+	}
+	if data.Lat == prev.Lat && data.Long == prev.Long {
+		if at.Sub(t.stuckSince) > m.cfg.StuckAfter {
+			changes = m.fire(changes, data.OBUID, types.AlertStuck, now,
+				fmt.Sprintf("reported %.5f,%.5f since %s", data.Lat, data.Long, t.stuckSince.UTC().Format(time.RFC3339)))
+		}
+	} else {
+		t.stuckSince = at
+		changes = m.resolve(changes, data.OBUID, types.AlertStuck, now)
+	}
+	t.status.Lat, t.status.Long, t.status.ReadingAt = data.Lat, data.Long, at
+}
+
+// Check fires silent alerts for OBUs not heard of in SilentAfter and
+// resolves teleport alerts of OBUs that moved plausibly for ResolveAfter.
+func (m *Monitor) Check(now time.Time) {
+	var changes []types.Alert
+	m.mu.Lock()
+	for id, t := range m.obus {
+		if silence := now.Sub(t.status.LastSeen); silence > m.cfg.SilentAfter {
+			changes = m.fire(changes, id, types.AlertSilent, now,
+				fmt.Sprintf("not heard of since %s", t.status.LastSeen.UTC().Format(time.RFC3339)))
+		}
+		if now.Sub(t.lastJump) > m.cfg.ResolveAfter {
+			changes = m.resolve(changes, id, types.AlertTeleport, now)
+		}
+	}
+	m.mu.Unlock()
+	m.notify(changes)
+}
+
+// Run checks every interval until ctx is done.
+func (m *Monitor) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			m.Check(now)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// fire raises an alert unless one of the kind is firing for the OBU
+// already, and appends it to changes.
+func (m *Monitor) fire(changes []types.Alert, obuID int, kind types.AlertKind, now time.Time, msg string) []types.Alert {
+	key := alertKey{obuID: obuID, kind: kind}
+	if _, ok := m.firing[key]; ok {
+		return changes
+	}
+	a := &types.Alert{
+		ID:      fmt.Sprintf("%s-%d-%d", kind, obuID, now.UnixNano()),
+		OBUID:   obuID,
+		Kind:    kind,
+		State:   types.AlertFiring,
+		Message: msg,
+		FiredAt: now,
+	}
+	m.firing[key] = a
+	return append(changes, *a)
+}
+
+// resolve resolves the firing alert of the kind of the OBU, if there is
+// one, and appends it to changes.
+func (m *Monitor) resolve(changes []types.Alert, obuID int, kind types.AlertKind, now time.Time) []types.Alert {
+	key := alertKey{obuID: obuID, kind: kind}
+	a, ok := m.firing[key]
+	if !ok {
+		return changes
+	}
+	delete(m.firing, key)
+	a.State = types.AlertResolved
+	a.ResolvedAt = &now
+	m.resolved = append(m.resolved, *a)
+	if n := len(m.resolved) - m.cfg.KeepResolved; n > 0 {
+		m.resolved = append([]types.Alert(nil), m.resolved[n:]...)
+	}
+	return append(changes, *a)
+}
+
+func (m *Monitor) notify(changes []types.Alert) {
+	for _, a := range changes {
+		if err := m.notifier.NotifyAlert(a); err != nil {
+			logrus.WithField("alert", a.ID).Errorf("alert notify error %s", err)
+		}
+	}
+}
+
+// Alerts returns the firing and the kept resolved alerts, newest first.
+// An empty state or an obuID of 0 doesn't filter.
+func (m *Monitor) Alerts(state types.AlertState, obuID int) []types.Alert {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	alerts := []types.Alert{}
+	keep := func(a types.Alert) {
+		if (state == "" || a.State == state) && (obuID == 0 || a.OBUID == obuID) {
+			alerts = append(alerts, a)
+		}
+	}
+	for _, a := range m.firing {
+		keep(*a)
+	}
+	for _, a := range m.resolved {
+		keep(a)
+	}
+	sort.Slice(alerts, func(i, j int) bool { return alerts[i].FiredAt.After(alerts[j].FiredAt) })
+	return alerts
+}
+
+func (m *Monitor) Statuses() []types.OBUStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	statuses := make([]types.OBUStatus, 0, len(m.obus))
+	for _, t := range m.obus {
+		statuses = append(statuses, t.status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].OBUID < statuses[j].OBUID })
+	return statuses
+}
+
+// LogNotifier only logs alerts.
+type LogNotifier struct{}
+
+func (LogNotifier) NotifyAlert(a types.Alert) error {
+	logrus.WithFields(logrus.Fields{
+		"obuID": a.OBUID,
+		"kind":  a.Kind,
+		"state": a.State,
+	}).Warn(a.Message)
+	return nil
+}
+
+// WebhookNotifier posts the alert as JSON, every time it fires and every
+// time it resolves.
+type WebhookNotifier struct {
+	URL    string
+	client *http.Client
+}
+
+// NewWebhookNotifier returns a notifier giving up on a post after timeout.
+func NewWebhookNotifier(url string, timeout time.Duration) *WebhookNotifier {
+	return &WebhookNotifier{
+		URL:    url,
+		client: &http.Client{Timeout: timeout},
+	}
+}
+
+func (n *WebhookNotifier) NotifyAlert(a types.Alert) error {
+	b, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	resp, err := n.client.Post(n.URL, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("alert webhook responded with %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// QueueNotifier hands alerts to next on a goroutine of its own, so a slow
+// next doesn't hold up the readings. Alerts that don't fit in the queue are
+// dropped.
+type QueueNotifier struct {
+	next  AlertNotifier
+	queue chan types.Alert
+	// stop is closed by Close, stopped by Start once it delivered what was
+	// left in the queue
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+func NewQueueNotifier(next AlertNotifier, size int) *QueueNotifier {
+	return &QueueNotifier{
+		next:    next,
+		queue:   make(chan types.Alert, size),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+}
+
+func (q *QueueNotifier) NotifyAlert(a types.Alert) error {
+	select {
+	case q.queue <- a:
+		return nil
+	default:
+		return fmt.Errorf("alert queue of %d is full, alert dropped", cap(q.queue))
+	}
+}
+
+// Start delivers the queued alerts until Close is called, then delivers
+// what is left in the queue.
+func (q *QueueNotifier) Start() error {
+	defer close(q.stopped)
+	for {
+		select {
+		case a := <-q.queue:
+			q.deliver(a)
+		case <-q.stop:
+			for {
+				select {
+				case a := <-q.queue:
+					q.deliver(a)
+				default:
+					return nil
+				}
+			}
+		}
+	}
+}
+
+// Close stops Start and waits for it to deliver the queued alerts, or for
+// ctx to be done.
+func (q *QueueNotifier) Close(ctx context.Context) error {
+	close(q.stop)
+	select {
+	case <-q.stopped:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%d alerts left undelivered: %w", len(q.queue), ctx.Err())
+	}
+}
+
+func (q *QueueNotifier) deliver(a types.Alert) {
+	if err := q.next.NotifyAlert(a); err != nil {
+		logrus.WithField("alert", a.ID).Errorf("alert notify error %s", err)
+	}
+}
+
+// handleAlerts lists alerts, filtered by ?state= and ?obu=.
+func handleAlerts(m *Monitor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		state := types.AlertState(r.URL.Query().Get("state"))
+		if state != "" && state != types.AlertFiring && state != types.AlertResolved {
+			WriteJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("unknown state %q", state)})
+			return
+		}
+		var obuID int
+		if s := r.URL.Query().Get("obu"); s != "" {
+			id, err := strconv.Atoi(s)
+			if err != nil {
+				WriteJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid OBU ID"})
+				return
+			}
+			obuID = id
+		}
+		WriteJSON(w, http.StatusOK, m.Alerts(state, obuID))
+	}
+}
+
+func handleStatuses(m *Monitor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		WriteJSON(w, http.StatusOK, m.Statuses())
+	}
+}
+
+func WriteJSON(w http.ResponseWriter, status int, v any) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(v)
+}
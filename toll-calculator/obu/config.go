@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/device"
+)
+
+type Config struct {
+	WSEndpoint      string        `yaml:"wsEndpoint" usage:"the websocket endpoint of the receiver"`
+	BatchEndpoint   string        `yaml:"batchEndpoint" usage:"the endpoint buffered readings are uploaded to"`
+	DeviceSecret    string        `yaml:"deviceSecret" secret:"true" usage:"the secret OBU tokens and HMAC keys are derived from, needed to sign and upload batches"`
+	Dev             bool          `yaml:"dev" usage:"fall back to the development device secret if deviceSecret is empty"`
+	OBUs            int           `yaml:"obus" usage:"how many OBUs to simulate"`
+	SendInterval    time.Duration `yaml:"sendInterval" usage:"how often every OBU sends a reading"`
+	Offline         bool          `yaml:"offline" usage:"periodically drop the connection and upload the buffered readings in batches on reconnect"`
+	OnlineFor       time.Duration `yaml:"onlineFor" usage:"how long the OBUs stay connected in offline mode"`
+	OfflineFor      time.Duration `yaml:"offlineFor" usage:"how long the OBUs stay disconnected in offline mode"`
+	Format          string        `yaml:"format" usage:"the wire format readings are sent in, json or protobuf"`
+	Sign            bool          `yaml:"sign" usage:"sign every reading with the device key"`
+	ShutdownTimeout time.Duration `yaml:"shutdownTimeout" usage:"how long the service gets to stop on SIGTERM"`
+}
+
+func NewConfig() *Config {
+	return &Config{
+		WSEndpoint:      "ws://127.0.0.1:30000/ws",
+		BatchEndpoint:   "http://127.0.0.1:30000/batch",
+		OBUs:            20,
+		SendInterval:    time.Second * 5,
+		OnlineFor:       time.Minute,
+		OfflineFor:      time.Second * 30,
+		Format:          "json",
+		ShutdownTimeout: 10 * time.Second,
+	}
+}
+
+func (c *Config) Validate() error {
+	if c.WSEndpoint == "" {
+		return errors.New("wsEndpoint is required")
+	}
+	if c.Offline && c.BatchEndpoint == "" {
+		return errors.New("batchEndpoint is required in offline mode")
+	}
+	if (c.Sign || c.Offline) && c.DeviceSecret == "" && !c.Dev {
+		return errors.New("deviceSecret is required to sign or upload batches, start with -dev to use the development secret")
+	}
+	if c.OBUs < 1 {
+		return errors.New("obus must be at least 1")
+	}
+	if c.SendInterval <= 0 {
+		return errors.New("sendInterval must be positive")
+	}
+	if c.Format != "json" && c.Format != "protobuf" {
+		return fmt.Errorf("unknown format %q", c.Format)
+	}
+	if c.ShutdownTimeout <= 0 {
+		return errors.New("shutdownTimeout must be positive")
+	}
+	return nil
+}
+
+// deviceSecret is the configured secret, or the development one in dev mode.
+func (c *Config) deviceSecret() []byte {
+	if c.DeviceSecret == "" {
+		return []byte(device.DevSecret)
+	}
+	return []byte(c.DeviceSecret)
+}
@@ -1,19 +1,25 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
 	"log"
 	"math"
 	"math/rand"
+	"net/http"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/config"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/device"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/run"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/schema"
 	"github.com/tunangoo/full-time-go-dev/toll-calculator/types"
 )
 
-const wsEndpoint = "ws://127.0.0.1:30000/ws"
-
-var sendInterval = time.Second * 5
-
 func generateCoordinate() float64 {
 	n := float64(rand.Intn(100) + 1)
 	f := rand.Float64()
@@ -21,7 +27,7 @@ func generateCoordinate() float64 {
 }
 
 func generateLatLong() (float64, float64) {
-	return generateCoordinate(), generateCoordinate()
+	return math.Mod(generateCoordinate(), 90), generateCoordinate()
 }
 
 func generateOBUIDS(n int) []int {
@@ -33,25 +39,180 @@ func generateOBUIDS(n int) []int {
 }
 
 func main() {
-	obusID := generateOBUIDS(20)
-	conn, _, err := websocket.DefaultDialer.Dial(wsEndpoint, nil)
-	if err != nil {
+	cfg := NewConfig()
+	config.MustLoad("obu", cfg)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	g := run.New(cfg.ShutdownTimeout)
+	g.Add("simulator", func() error {
+		return simulate(ctx, cfg)
+	}, func(context.Context) error {
+		cancel()
+		return nil
+	})
+	if err := g.Run(); err != nil {
 		log.Fatal(err)
 	}
+}
+
+// simulate sends readings of cfg.OBUs OBUs until ctx is done.
+func simulate(ctx context.Context, cfg *Config) error {
+	subprotocol := schema.SubprotocolJSON
+	if cfg.Format == "protobuf" {
+		subprotocol = schema.SubprotocolProtobuf
+	}
+
+	obusID := generateOBUIDS(cfg.OBUs)
+	conn, err := dial(cfg.WSEndpoint, subprotocol)
+	if err != nil {
+		return err
+	}
+
+	var (
+		buffered   = make(map[int][]types.OBUdata)
+		phaseStart = time.Now()
+	)
 	for {
+		if cfg.Offline && conn != nil && time.Since(phaseStart) > cfg.OnlineFor {
+			log.Println("going offline")
+			hangUp(conn)
+			conn, phaseStart = nil, time.Now()
+		}
+		if conn == nil && time.Since(phaseStart) > cfg.OfflineFor {
+			log.Println("reconnecting")
+			conn, err = dial(cfg.WSEndpoint, subprotocol)
+			if err != nil {
+				return err
+			}
+			phaseStart = time.Now()
+			uploadBatches(cfg, buffered)
+		}
+
 		for i := 0; i < len(obusID); i++ {
 			lat, long := generateLatLong()
 			data := types.OBUdata{
 				OBUID: obusID[i],
 				Lat:   lat,
 				Long:  long,
+				Unix:  time.Now().UnixNano(),
+			}
+			if cfg.Sign {
+				device.SignHMAC(cfg.deviceSecret(), &data)
 			}
-			if err := conn.WriteJSON(data); err != nil {
-				log.Fatal(err)
+			if conn == nil {
+				buffered[data.OBUID] = append(buffered[data.OBUID], data)
+				continue
+			}
+			if err := send(conn, data); err != nil {
+				return err
 			}
 		}
-		time.Sleep(sendInterval)
+
+		select {
+		case <-time.After(cfg.SendInterval):
+		case <-ctx.Done():
+			if conn != nil {
+				hangUp(conn)
+			}
+			return nil
+		}
+	}
+}
+
+// dial asks the receiver for subprotocol. A receiver that doesn't know it
+// answers without one, readings are sent as JSON then.
+func dial(endpoint, subprotocol string) (*websocket.Conn, error) {
+	dialer := *websocket.DefaultDialer
+	dialer.Subprotocols = []string{subprotocol}
+	conn, _, err := dialer.Dial(endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	if conn.Subprotocol() != subprotocol {
+		log.Printf("receiver refused %s, falling back to json", subprotocol)
+	}
+	go readLoop(conn)
+	return conn, nil
+}
+
+// readLoop logs the rejections the receiver reports. Reading is also what
+// answers the close frame of a receiver shutting down.
+func readLoop(conn *websocket.Conn) {
+	for {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		log.Printf("rejected: %s", msg)
+	}
+}
+
+// hangUp closes the connection with a close frame, so the receiver knows
+// no reading is lost.
+func hangUp(conn *websocket.Conn) {
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+	conn.Close()
+}
+
+func send(conn *websocket.Conn, data types.OBUdata) error {
+	if conn.Subprotocol() == schema.SubprotocolProtobuf {
+		return conn.WriteMessage(websocket.BinaryMessage, schema.MarshalOBUData(data))
+	}
+	return conn.WriteJSON(data)
+}
+
+// uploadBatches sends every OBU's buffered readings as one batch and drops
+// the ones the receiver acknowledged.
+func uploadBatches(cfg *Config, buffered map[int][]types.OBUdata) {
+	for obuID, readings := range buffered {
+		batch := types.Batch{
+			BatchID:  fmt.Sprintf("%d-%d", obuID, readings[0].Unix),
+			OBUID:    obuID,
+			Readings: readings,
+		}
+		receipt, err := uploadBatch(cfg, batch)
+		if err != nil {
+			log.Printf("batch %s upload failed, keeping it for the next reconnect: %s", batch.BatchID, err)
+			continue
+		}
+		log.Printf("batch %s: %d accepted, %d rejected", receipt.BatchID, receipt.Accepted, len(receipt.Rejected))
+		delete(buffered, obuID)
+	}
+}
+
+func uploadBatch(cfg *Config, batch types.Batch) (*types.BatchReceipt, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(gz).Encode(batch); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", cfg.BatchEndpoint, &buf)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+	req.Header.Set("Authorization", "Bearer "+device.Token(cfg.deviceSecret(), batch.OBUID))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("the receiver responded with non 200 status code %d", resp.StatusCode)
+	}
+	var receipt types.BatchReceipt
+	if err := json.NewDecoder(resp.Body).Decode(&receipt); err != nil {
+		return nil, err
 	}
+	return &receipt, nil
 }
 
 func init() {
@@ -0,0 +1,99 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/types"
+)
+
+var ErrUnknownOBU = errors.New("unknown obu")
+
+type Client struct {
+	Endpoint string
+}
+
+func NewClient(endpoint string) *Client {
+	return &Client{
+		Endpoint: endpoint,
+	}
+}
+
+// LookupOBU returns who the OBU belongs to at at, or ErrUnknownOBU if it
+// isn't registered to any vehicle then.
+func (c *Client) LookupOBU(obuID int, at time.Time) (*types.OBURecord, error) {
+	q := url.Values{
+		"id": {strconv.Itoa(obuID)},
+		"at": {at.Format(time.RFC3339)},
+	}
+	resp, err := http.Get(c.Endpoint + "/obu?" + q.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, fmt.Errorf("%w %d", ErrUnknownOBU, obuID)
+	default:
+		return nil, fmt.Errorf("the service responded with non 200 status code %d", resp.StatusCode)
+	}
+	var rec types.OBURecord
+	if err := json.NewDecoder(resp.Body).Decode(&rec); err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+// LookupOBUs looks up many OBUs with a single request, the OBUs that aren't
+// registered to any vehicle at at are left out.
+func (c *Client) LookupOBUs(obuIDs []int, at time.Time) (map[int]*types.OBURecord, error) {
+	b, err := json.Marshal(map[string]any{"obuIDs": obuIDs, "at": at})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.Post(c.Endpoint+"/obu/lookup", "application/json", bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("the service responded with non 200 status code %d", resp.StatusCode)
+	}
+	var recs map[int]*types.OBURecord
+	if err := json.NewDecoder(resp.Body).Decode(&recs); err != nil {
+		return nil, err
+	}
+	return recs, nil
+}
+
+// ActiveOBUs returns the OBUs registered to a vehicle at any time in
+// [from, to).
+func (c *Client) ActiveOBUs(from, to time.Time) ([]int, error) {
+	q := url.Values{
+		"from": {from.Format(time.RFC3339)},
+		"to":   {to.Format(time.RFC3339)},
+	}
+	resp, err := http.Get(c.Endpoint + "/obu/active?" + q.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("the service responded with non 200 status code %d", resp.StatusCode)
+	}
+	var ids []int
+	if err := json.NewDecoder(resp.Body).Decode(&ids); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+type Config struct {
+	ListenAddr      string        `yaml:"listenAddr" usage:"the listen address of HTTP Server"`
+	Store           string        `yaml:"store" usage:"the file the registry is kept in"`
+	ShutdownTimeout time.Duration `yaml:"shutdownTimeout" usage:"how long the service gets to stop on SIGTERM"`
+}
+
+func NewConfig() *Config {
+	return &Config{
+		ListenAddr:      ":3100",
+		Store:           "./data/registry.json",
+		ShutdownTimeout: 10 * time.Second,
+	}
+}
+
+func (c *Config) Validate() error {
+	if c.ListenAddr == "" {
+		return errors.New("listenAddr is required")
+	}
+	if c.Store == "" {
+		return errors.New("store is required")
+	}
+	if c.ShutdownTimeout <= 0 {
+		return errors.New("shutdownTimeout must be positive")
+	}
+	return nil
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/config"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/health"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/run"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/types"
+)
+
+func main() {
+	cfg := NewConfig()
+	config.MustLoad("registry", cfg)
+
+	store, err := NewFileStore(cfg.Store)
+	if err != nil {
+		log.Fatal(err)
+	}
+	svc := NewLogMiddleware(NewVehicleRegistry(store))
+	checks := health.New()
+	checks.Add("store", health.Writable(filepath.Dir(cfg.Store)))
+	checks.Register(http.DefaultServeMux)
+	g := run.New(cfg.ShutdownTimeout)
+	g.AddHTTPServer(makeHTTPTransport(cfg.ListenAddr, svc))
+	if err := g.Run(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func makeHTTPTransport(listenAddr string, svc Registry) *http.Server {
+	fmt.Println("HTTP Transport running on port", listenAddr)
+	http.HandleFunc("/account", handleAccount(svc))
+	http.HandleFunc("PUT /account/{id}", handleUpdateAccount(svc))
+	http.HandleFunc("/vehicle", handleVehicle(svc))
+	http.HandleFunc("PUT /vehicle/{id}", handleUpdateVehicle(svc))
+	http.HandleFunc("/obu", handleOBU(svc))
+	http.HandleFunc("/obu/deactivate", handleDeactivateOBU(svc))
+	http.HandleFunc("/obu/active", handleActiveOBUs(svc))
+	http.HandleFunc("/obu/lookup", handleLookupOBUs(svc))
+	return &http.Server{Addr: listenAddr}
+}
+
+func handleAccount(svc Registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			var acc types.Account
+			if err := json.NewDecoder(r.Body).Decode(&acc); err != nil {
+				WriteJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
+			res, err := svc.CreateAccount(acc)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			WriteJSON(w, http.StatusOK, res)
+			return
+		}
+		acc, err := svc.GetAccount(r.URL.Query().Get("id"))
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		WriteJSON(w, http.StatusOK, acc)
+	}
+}
+
+func handleVehicle(svc Registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			var v types.Vehicle
+			if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
+				WriteJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
+			res, err := svc.CreateVehicle(v)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			WriteJSON(w, http.StatusOK, res)
+			return
+		}
+		v, err := svc.GetVehicle(r.URL.Query().Get("id"))
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		WriteJSON(w, http.StatusOK, v)
+	}
+}
+
+// handleUpdateAccount replaces the account with the ID in the path.
+func handleUpdateAccount(svc Registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var acc types.Account
+		if err := json.NewDecoder(r.Body).Decode(&acc); err != nil {
+			WriteJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		acc.ID = r.PathValue("id")
+		res, err := svc.UpdateAccount(acc)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		WriteJSON(w, http.StatusOK, res)
+	}
+}
+
+// handleUpdateVehicle replaces the vehicle with the ID in the path.
+func handleUpdateVehicle(svc Registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var v types.Vehicle
+		if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
+			WriteJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		v.ID = r.PathValue("id")
+		res, err := svc.UpdateVehicle(v)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		WriteJSON(w, http.StatusOK, res)
+	}
+}
+
+// handleOBU registers an OBU on POST and otherwise looks up who it belongs
+// to, now or at the RFC3339 time in ?at=.
+func handleOBU(svc Registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			var reg types.OBURegistration
+			if err := json.NewDecoder(r.Body).Decode(&reg); err != nil {
+				WriteJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
+			res, err := svc.RegisterOBU(reg)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			WriteJSON(w, http.StatusOK, res)
+			return
+		}
+
+		obuID, err := strconv.Atoi(r.URL.Query().Get("id"))
+		if err != nil {
+			WriteJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid OBU ID"})
+			return
+		}
+		at, err := parseAt(r)
+		if err != nil {
+			WriteJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		rec, err := svc.LookupOBU(obuID, at)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		WriteJSON(w, http.StatusOK, rec)
+	}
+}
+
+func handleDeactivateOBU(svc Registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			OBUID int        `json:"obuID"`
+			At    *time.Time `json:"at"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			WriteJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		at := time.Now()
+		if req.At != nil {
+			at = *req.At
+		}
+		if err := svc.DeactivateOBU(req.OBUID, at); err != nil {
+			writeError(w, err)
+			return
+		}
+		WriteJSON(w, http.StatusOK, map[string]any{"obuID": req.OBUID, "deactivatedAt": at})
+	}
+}
+
+// handleActiveOBUs lists the OBUs registered at any time in the RFC3339
+// ?from= to ?to=.
+func handleActiveOBUs(svc Registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		from, err := time.Parse(time.RFC3339, r.URL.Query().Get("from"))
+		if err != nil {
+			WriteJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("invalid from: %s", err)})
+			return
+		}
+		to, err := time.Parse(time.RFC3339, r.URL.Query().Get("to"))
+		if err != nil {
+			WriteJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("invalid to: %s", err)})
+			return
+		}
+		ids, err := svc.ActiveOBUs(from, to)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		WriteJSON(w, http.StatusOK, ids)
+	}
+}
+
+// handleLookupOBUs looks up many OBUs at once, it answers the records of the
+// ones registered at at keyed by OBU ID and leaves the others out.
+func handleLookupOBUs(svc Registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			WriteJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+			return
+		}
+		var req struct {
+			OBUIDs []int     `json:"obuIDs"`
+			At     time.Time `json:"at"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			WriteJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		recs := make(map[int]*types.OBURecord, len(req.OBUIDs))
+		for _, id := range req.OBUIDs {
+			rec, err := svc.LookupOBU(id, req.At)
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+			if err != nil {
+				WriteJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+				return
+			}
+			recs[id] = rec
+		}
+		WriteJSON(w, http.StatusOK, recs)
+	}
+}
+
+func parseAt(r *http.Request) (time.Time, error) {
+	at := r.URL.Query().Get("at")
+	if at == "" {
+		return time.Now(), nil
+	}
+	return time.Parse(time.RFC3339, at)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusBadRequest
+	switch {
+	case errors.Is(err, ErrNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, ErrExists):
+		status = http.StatusConflict
+	}
+	WriteJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func WriteJSON(w http.ResponseWriter, status int, v any) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(v)
+}
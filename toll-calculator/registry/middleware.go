@@ -0,0 +1,114 @@
+package main
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/types"
+)
+
+type LoggingMiddleware struct {
+	next Registry
+}
+
+func NewLogMiddleware(next Registry) Registry {
+	return &LoggingMiddleware{
+		next: next,
+	}
+}
+
+func (l *LoggingMiddleware) CreateAccount(acc types.Account) (res *types.Account, err error) {
+	defer func(start time.Time) {
+		logrus.WithFields(logrus.Fields{
+			"took": time.Since(start),
+			"err":  err,
+			"name": acc.Name,
+		}).Info("CreateAccount")
+	}(time.Now())
+	res, err = l.next.CreateAccount(acc)
+	return
+}
+
+func (l *LoggingMiddleware) UpdateAccount(acc types.Account) (res *types.Account, err error) {
+	defer func(start time.Time) {
+		logrus.WithFields(logrus.Fields{
+			"took": time.Since(start),
+			"err":  err,
+			"id":   acc.ID,
+			"name": acc.Name,
+		}).Info("UpdateAccount")
+	}(time.Now())
+	res, err = l.next.UpdateAccount(acc)
+	return
+}
+
+func (l *LoggingMiddleware) GetAccount(id string) (*types.Account, error) {
+	return l.next.GetAccount(id)
+}
+
+func (l *LoggingMiddleware) CreateVehicle(v types.Vehicle) (res *types.Vehicle, err error) {
+	defer func(start time.Time) {
+		logrus.WithFields(logrus.Fields{
+			"took":      time.Since(start),
+			"err":       err,
+			"plate":     v.Plate,
+			"class":     v.Class,
+			"accountID": v.AccountID,
+		}).Info("CreateVehicle")
+	}(time.Now())
+	res, err = l.next.CreateVehicle(v)
+	return
+}
+
+func (l *LoggingMiddleware) UpdateVehicle(v types.Vehicle) (res *types.Vehicle, err error) {
+	defer func(start time.Time) {
+		logrus.WithFields(logrus.Fields{
+			"took":      time.Since(start),
+			"err":       err,
+			"id":        v.ID,
+			"plate":     v.Plate,
+			"class":     v.Class,
+			"accountID": v.AccountID,
+		}).Info("UpdateVehicle")
+	}(time.Now())
+	res, err = l.next.UpdateVehicle(v)
+	return
+}
+
+func (l *LoggingMiddleware) GetVehicle(id string) (*types.Vehicle, error) {
+	return l.next.GetVehicle(id)
+}
+
+func (l *LoggingMiddleware) RegisterOBU(reg types.OBURegistration) (res *types.OBURegistration, err error) {
+	defer func(start time.Time) {
+		logrus.WithFields(logrus.Fields{
+			"took":      time.Since(start),
+			"err":       err,
+			"obuID":     reg.OBUID,
+			"vehicleID": reg.VehicleID,
+		}).Info("RegisterOBU")
+	}(time.Now())
+	res, err = l.next.RegisterOBU(reg)
+	return
+}
+
+func (l *LoggingMiddleware) DeactivateOBU(obuID int, at time.Time) (err error) {
+	defer func(start time.Time) {
+		logrus.WithFields(logrus.Fields{
+			"took":  time.Since(start),
+			"err":   err,
+			"obuID": obuID,
+			"at":    at,
+		}).Info("DeactivateOBU")
+	}(time.Now())
+	err = l.next.DeactivateOBU(obuID, at)
+	return
+}
+
+func (l *LoggingMiddleware) LookupOBU(obuID int, at time.Time) (*types.OBURecord, error) {
+	return l.next.LookupOBU(obuID, at)
+}
+
+func (l *LoggingMiddleware) ActiveOBUs(from, to time.Time) ([]int, error) {
+	return l.next.ActiveOBUs(from, to)
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/money"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/types"
+)
+
+var (
+	ErrNotFound = errors.New("not found")
+	ErrExists   = errors.New("already exists")
+)
+
+var vehicleClasses = map[types.VehicleClass]struct{}{
+	types.VehicleClassMotorcycle: {},
+	types.VehicleClassCar:        {},
+	types.VehicleClassBus:        {},
+	types.VehicleClassTruck:      {},
+	types.VehicleClassEmergency:  {},
+}
+
+type Registry interface {
+	// CreateAccount and CreateVehicle refuse IDs that exist with
+	// ErrExists, UpdateAccount and UpdateVehicle IDs that don't with
+	// ErrNotFound.
+	CreateAccount(types.Account) (*types.Account, error)
+	UpdateAccount(types.Account) (*types.Account, error)
+	GetAccount(string) (*types.Account, error)
+	CreateVehicle(types.Vehicle) (*types.Vehicle, error)
+	UpdateVehicle(types.Vehicle) (*types.Vehicle, error)
+	GetVehicle(string) (*types.Vehicle, error)
+	RegisterOBU(types.OBURegistration) (*types.OBURegistration, error)
+	DeactivateOBU(int, time.Time) error
+	LookupOBU(int, time.Time) (*types.OBURecord, error)
+	// ActiveOBUs returns the OBUs registered to a vehicle at any time in
+	// [from, to), in ascending order.
+	ActiveOBUs(from, to time.Time) ([]int, error)
+}
+
+type Storer interface {
+	PutAccount(types.Account) error
+	GetAccount(string) (*types.Account, error)
+	PutVehicle(types.Vehicle) error
+	GetVehicle(string) (*types.Vehicle, error)
+	// PutRegistrations replaces every registration of the OBU.
+	PutRegistrations(int, []types.OBURegistration) error
+	GetRegistrations(int) ([]types.OBURegistration, error)
+	// OBUIDs returns every OBU that has registrations.
+	OBUIDs() ([]int, error)
+}
+
+type VehicleRegistry struct {
+	// serializes the changes, the checks of a change and its write have to
+	// see the same accounts, vehicles and registrations
+	mu    sync.Mutex
+	store Storer
+}
+
+func NewVehicleRegistry(store Storer) Registry {
+	return &VehicleRegistry{
+		store: store,
+	}
+}
+
+func (r *VehicleRegistry) CreateAccount(acc types.Account) (*types.Account, error) {
+	if err := validateAccount(acc); err != nil {
+		return nil, err
+	}
+	if acc.ID == "" {
+		acc.ID = newID()
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, err := r.store.GetAccount(acc.ID); err == nil {
+		return nil, fmt.Errorf("account %s: %w", acc.ID, ErrExists)
+	}
+	if err := r.store.PutAccount(acc); err != nil {
+		return nil, err
+	}
+	return &acc, nil
+}
+
+func (r *VehicleRegistry) UpdateAccount(acc types.Account) (*types.Account, error) {
+	if err := validateAccount(acc); err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, err := r.store.GetAccount(acc.ID); err != nil {
+		return nil, fmt.Errorf("account %s: %w", acc.ID, err)
+	}
+	if err := r.store.PutAccount(acc); err != nil {
+		return nil, err
+	}
+	return &acc, nil
+}
+
+func validateAccount(acc types.Account) error {
+	if acc.Name == "" {
+		return errors.New("missing account name")
+	}
+	if acc.Country != "" && !validCountry(acc.Country) {
+		return fmt.Errorf("country %q is not an ISO 3166 alpha-2 code", acc.Country)
+	}
+	if acc.Currency != "" && !money.ValidCurrency(acc.Currency) {
+		return fmt.Errorf("currency %q is not an ISO 4217 code", acc.Currency)
+	}
+	return nil
+}
+
+// validCountry tells whether code looks like an ISO 3166 alpha-2 code, two
+// upper case letters.
+func validCountry(code string) bool {
+	return len(code) == 2 &&
+		code[0] >= 'A' && code[0] <= 'Z' &&
+		code[1] >= 'A' && code[1] <= 'Z'
+}
+
+func (r *VehicleRegistry) GetAccount(id string) (*types.Account, error) {
+	return r.store.GetAccount(id)
+}
+
+func (r *VehicleRegistry) CreateVehicle(v types.Vehicle) (*types.Vehicle, error) {
+	if v.ID == "" {
+		v.ID = newID()
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.validateVehicle(v); err != nil {
+		return nil, err
+	}
+	if _, err := r.store.GetVehicle(v.ID); err == nil {
+		return nil, fmt.Errorf("vehicle %s: %w", v.ID, ErrExists)
+	}
+	if err := r.store.PutVehicle(v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+func (r *VehicleRegistry) UpdateVehicle(v types.Vehicle) (*types.Vehicle, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.validateVehicle(v); err != nil {
+		return nil, err
+	}
+	if _, err := r.store.GetVehicle(v.ID); err != nil {
+		return nil, fmt.Errorf("vehicle %s: %w", v.ID, err)
+	}
+	if err := r.store.PutVehicle(v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+func (r *VehicleRegistry) validateVehicle(v types.Vehicle) error {
+	if v.Plate == "" {
+		return errors.New("missing plate")
+	}
+	if _, ok := vehicleClasses[v.Class]; !ok {
+		return fmt.Errorf("unknown vehicle class %q", v.Class)
+	}
+	if _, err := r.store.GetAccount(v.AccountID); err != nil {
+		return fmt.Errorf("account %s: %w", v.AccountID, err)
+	}
+	return nil
+}
+
+func (r *VehicleRegistry) GetVehicle(id string) (*types.Vehicle, error) {
+	return r.store.GetVehicle(id)
+}
+
+// RegisterOBU installs an OBU in a vehicle. An OBU can move between
+// vehicles over time, but can't be active in two of them at once.
+func (r *VehicleRegistry) RegisterOBU(reg types.OBURegistration) (*types.OBURegistration, error) {
+	if reg.OBUID <= 0 {
+		return nil, errors.New("invalid obu id")
+	}
+	if _, err := r.store.GetVehicle(reg.VehicleID); err != nil {
+		return nil, fmt.Errorf("vehicle %s: %w", reg.VehicleID, err)
+	}
+	if reg.ActiveFrom.IsZero() {
+		reg.ActiveFrom = time.Now()
+	}
+	if reg.ActiveTo != nil && !reg.ActiveTo.After(reg.ActiveFrom) {
+		return nil, errors.New("deactivation must be after activation")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	regs, err := r.store.GetRegistrations(reg.OBUID)
+	if err != nil {
+		return nil, err
+	}
+	for _, other := range regs {
+		if overlaps(reg, other) {
+			return nil, fmt.Errorf("obu %d is already registered to vehicle %s from %s", reg.OBUID, other.VehicleID, other.ActiveFrom.Format(time.RFC3339))
+		}
+	}
+	if err := r.store.PutRegistrations(reg.OBUID, append(regs, reg)); err != nil {
+		return nil, err
+	}
+	return &reg, nil
+}
+
+// DeactivateOBU ends the registration of the OBU that is active at at.
+func (r *VehicleRegistry) DeactivateOBU(obuID int, at time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	regs, err := r.store.GetRegistrations(obuID)
+	if err != nil {
+		return err
+	}
+	for i, reg := range regs {
+		if reg.ActiveAt(at) {
+			regs[i].ActiveTo = &at
+			return r.store.PutRegistrations(obuID, regs)
+		}
+	}
+	return fmt.Errorf("no active registration for obu %d: %w", obuID, ErrNotFound)
+}
+
+func (r *VehicleRegistry) LookupOBU(obuID int, at time.Time) (*types.OBURecord, error) {
+	regs, err := r.store.GetRegistrations(obuID)
+	if err != nil {
+		return nil, err
+	}
+	for _, reg := range regs {
+		if !reg.ActiveAt(at) {
+			continue
+		}
+		v, err := r.store.GetVehicle(reg.VehicleID)
+		if err != nil {
+			return nil, err
+		}
+		acc, err := r.store.GetAccount(v.AccountID)
+		if err != nil {
+			return nil, err
+		}
+		return &types.OBURecord{
+			Registration: reg,
+			Vehicle:      *v,
+			Account:      *acc,
+		}, nil
+	}
+	return nil, fmt.Errorf("no active registration for obu %d: %w", obuID, ErrNotFound)
+}
+
+func (r *VehicleRegistry) ActiveOBUs(from, to time.Time) ([]int, error) {
+	ids, err := r.store.OBUIDs()
+	if err != nil {
+		return nil, err
+	}
+	period := types.OBURegistration{ActiveFrom: from, ActiveTo: &to}
+	active := []int{}
+	for _, id := range ids {
+		regs, err := r.store.GetRegistrations(id)
+		if err != nil {
+			return nil, err
+		}
+		if slices.ContainsFunc(regs, func(reg types.OBURegistration) bool { return overlaps(period, reg) }) {
+			active = append(active, id)
+		}
+	}
+	slices.Sort(active)
+	return active, nil
+}
+
+func overlaps(a, b types.OBURegistration) bool {
+	aEndsBeforeB := a.ActiveTo != nil && !a.ActiveTo.After(b.ActiveFrom)
+	bEndsBeforeA := b.ActiveTo != nil && !b.ActiveTo.After(a.ActiveFrom)
+	return !aEndsBeforeB && !bEndsBeforeA
+}
+
+func newID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/types"
+)
+
+// FileStore keeps the registry in memory and writes all of it to path on
+// every change. Registry data changes rarely and must survive restarts.
+type FileStore struct {
+	mu            sync.RWMutex
+	path          string
+	accounts      map[string]types.Account
+	vehicles      map[string]types.Vehicle
+	registrations map[int][]types.OBURegistration
+}
+
+type fileStoreData struct {
+	Accounts      map[string]types.Account        `json:"accounts"`
+	Vehicles      map[string]types.Vehicle        `json:"vehicles"`
+	Registrations map[int][]types.OBURegistration `json:"registrations"`
+}
+
+func NewFileStore(path string) (*FileStore, error) {
+	s := &FileStore{
+		path:          path,
+		accounts:      make(map[string]types.Account),
+		vehicles:      make(map[string]types.Vehicle),
+		registrations: make(map[int][]types.OBURegistration),
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var data fileStoreData
+	if err := json.Unmarshal(b, &data); err != nil {
+		return nil, fmt.Errorf("registry %s: %w", path, err)
+	}
+	for id, acc := range data.Accounts {
+		s.accounts[id] = acc
+	}
+	for id, v := range data.Vehicles {
+		s.vehicles[id] = v
+	}
+	for id, regs := range data.Registrations {
+		s.registrations[id] = regs
+	}
+	return s, nil
+}
+
+func (s *FileStore) PutAccount(acc types.Account) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	accounts := maps.Clone(s.accounts)
+	accounts[acc.ID] = acc
+	if err := s.save(accounts, s.vehicles, s.registrations); err != nil {
+		return err
+	}
+	s.accounts = accounts
+	return nil
+}
+
+func (s *FileStore) GetAccount(id string) (*types.Account, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	acc, ok := s.accounts[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &acc, nil
+}
+
+func (s *FileStore) PutVehicle(v types.Vehicle) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	vehicles := maps.Clone(s.vehicles)
+	vehicles[v.ID] = v
+	if err := s.save(s.accounts, vehicles, s.registrations); err != nil {
+		return err
+	}
+	s.vehicles = vehicles
+	return nil
+}
+
+func (s *FileStore) GetVehicle(id string) (*types.Vehicle, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	v, ok := s.vehicles[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &v, nil
+}
+
+func (s *FileStore) PutRegistrations(obuID int, regs []types.OBURegistration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	registrations := maps.Clone(s.registrations)
+	registrations[obuID] = regs
+	if err := s.save(s.accounts, s.vehicles, registrations); err != nil {
+		return err
+	}
+	s.registrations = registrations
+	return nil
+}
+
+func (s *FileStore) GetRegistrations(obuID int) ([]types.OBURegistration, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]types.OBURegistration(nil), s.registrations[obuID]...), nil
+}
+
+func (s *FileStore) OBUIDs() ([]int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return slices.Collect(maps.Keys(s.registrations)), nil
+}
+
+// save writes a temp file and renames it over path, callers hold s.mu.
+// Callers change a copy of the maps and only swap it in once it is saved,
+// a failed save leaves the store as it is on disk.
+func (s *FileStore) save(accounts map[string]types.Account, vehicles map[string]types.Vehicle, registrations map[int][]types.OBURegistration) error {
+	b, err := json.MarshalIndent(fileStoreData{
+		Accounts:      accounts,
+		Vehicles:      vehicles,
+		Registrations: registrations,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
@@ -0,0 +1,134 @@
+// Package run ties the lifetime of the parts of a service together. A
+// Group runs its actors until one of them returns or the process is asked
+// to terminate, then stops all of them within a deadline.
+package run
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var ErrDeadlineExceeded = errors.New("shutdown deadline exceeded")
+
+type actor struct {
+	name string
+	run  func() error
+	stop func(context.Context) error
+}
+
+type Group struct {
+	timeout time.Duration
+	actors  []actor
+	// closed once the group starts shutting down
+	done chan struct{}
+}
+
+// New returns a group that gives its actors timeout to stop.
+func New(timeout time.Duration) *Group {
+	return &Group{
+		timeout: timeout,
+		done:    make(chan struct{}),
+	}
+}
+
+// Add adds an actor. run is expected to block until stop is called, a run
+// returning early shuts the whole group down. Actors are stopped in the
+// reverse order they were added in, add what takes work in last so it is
+// stopped before what it hands the work to.
+func (g *Group) Add(name string, run func() error, stop func(context.Context) error) {
+	g.actors = append(g.actors, actor{name: name, run: run, stop: stop})
+}
+
+// AddStop adds something that only needs to be stopped, like a producer
+// that has to be flushed.
+func (g *Group) AddStop(name string, stop func(context.Context) error) {
+	g.Add(name, func() error {
+		<-g.done
+		return nil
+	}, stop)
+}
+
+// AddHTTPServer adds srv, it is shut down gracefully, waiting for the
+// requests in flight.
+func (g *Group) AddHTTPServer(srv *http.Server) {
+	g.Add("http "+srv.Addr, func() error {
+		if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+		return nil
+	}, srv.Shutdown)
+}
+
+// Run runs the group until SIGINT, SIGTERM or the first actor returning,
+// and returns why it stopped. A second signal gives up on stopping.
+func (g *Group) Run() error {
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sig)
+
+	type result struct {
+		name string
+		err  error
+	}
+	results := make(chan result, len(g.actors))
+	for _, a := range g.actors {
+		go func(a actor) {
+			results <- result{name: a.name, err: a.run()}
+		}(a)
+	}
+
+	var (
+		cause   error
+		running = len(g.actors)
+	)
+	select {
+	case s := <-sig:
+		logrus.Infof("received %s, shutting down", s)
+	case res := <-results:
+		running--
+		if res.err != nil {
+			cause = fmt.Errorf("%s: %w", res.name, res.err)
+		}
+		logrus.WithField("err", res.err).Infof("%s stopped, shutting down", res.name)
+	}
+	close(g.done)
+
+	ctx, cancel := context.WithTimeout(context.Background(), g.timeout)
+	defer cancel()
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for i := len(g.actors) - 1; i >= 0; i-- {
+			a := g.actors[i]
+			if err := a.stop(ctx); err != nil {
+				logrus.Errorf("stopping %s: %s", a.name, err)
+			}
+		}
+	}()
+
+	for running > 0 || stopped != nil {
+		select {
+		case res := <-results:
+			running--
+			if res.err != nil && cause == nil {
+				cause = fmt.Errorf("%s: %w", res.name, res.err)
+			}
+		case <-stopped:
+			stopped = nil
+		case <-ctx.Done():
+			return ErrDeadlineExceeded
+		case s := <-sig:
+			return fmt.Errorf("received %s while shutting down", s)
+		}
+	}
+	logrus.Info("shut down")
+	return cause
+}
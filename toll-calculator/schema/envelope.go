@@ -0,0 +1,104 @@
+package schema
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/types"
+)
+
+// An envelope is a magic byte, the big endian schema ID and the encoded
+// payload. Messages produced before envelopes existed are bare JSON objects
+// and are still accepted as version 1.
+const (
+	magicByte  = 0x0
+	headerSize = 5
+)
+
+var legacySchema = Schema{
+	Subject:  SubjectOBUData,
+	Version:  1,
+	Encoding: EncodingJSON,
+}
+
+type codec interface {
+	marshal(Schema, types.OBUdata) ([]byte, error)
+	unmarshal([]byte, *types.OBUdata) error
+}
+
+var codecs = map[Encoding]codec{
+	EncodingJSON:     jsonCodec{},
+	EncodingProtobuf: protobufCodec{},
+}
+
+// Encode wraps data in an envelope using schema s.
+func Encode(s Schema, data types.OBUdata) ([]byte, error) {
+	if s.Subject != SubjectOBUData {
+		return nil, fmt.Errorf("schema %d is not an %s schema", s.ID, SubjectOBUData)
+	}
+	c, ok := codecs[s.Encoding]
+	if !ok {
+		return nil, fmt.Errorf("unsupported encoding %q", s.Encoding)
+	}
+	if s.Version < 3 {
+		// the signature fields came with version 3
+		data.SigAlg, data.Signature = "", nil
+	}
+	payload, err := c.marshal(s, data)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, headerSize, headerSize+len(payload))
+	b[0] = magicByte
+	binary.BigEndian.PutUint32(b[1:headerSize], s.ID)
+	return append(b, payload...), nil
+}
+
+// Decode unwraps an envelope with any schema known to r. Fields a newer
+// version added are skipped by both encodings, so consumers keep working
+// while producers are being upgraded.
+func Decode(r *Registry, b []byte) (types.OBUdata, Schema, error) {
+	var data types.OBUdata
+	if len(b) > 0 && b[0] == '{' {
+		err := jsonCodec{}.unmarshal(b, &data)
+		return data, legacySchema, err
+	}
+	if len(b) < headerSize || b[0] != magicByte {
+		return data, Schema{}, errors.New("message is not a schema envelope")
+	}
+	s, err := r.Lookup(binary.BigEndian.Uint32(b[1:headerSize]))
+	if err != nil {
+		return data, Schema{}, err
+	}
+	if s.Subject != SubjectOBUData {
+		return data, s, fmt.Errorf("schema %d is not an %s schema", s.ID, SubjectOBUData)
+	}
+	err = codecs[s.Encoding].unmarshal(b[headerSize:], &data)
+	return data, s, err
+}
+
+type jsonCodec struct{}
+
+// obuDataV1 is the JSON shape of version 1, before readings were timestamped.
+type obuDataV1 struct {
+	OBUID int     `json:"obuID"`
+	Lat   float64 `json:"lat"`
+	Long  float64 `json:"long"`
+}
+
+func (jsonCodec) marshal(s Schema, data types.OBUdata) ([]byte, error) {
+	if s.Version == 1 {
+		return json.Marshal(obuDataV1{
+			OBUID: data.OBUID,
+			Lat:   data.Lat,
+			Long:  data.Long,
+		})
+	}
+	return json.Marshal(data)
+}
+
+func (jsonCodec) unmarshal(b []byte, data *types.OBUdata) error {
+	return json.Unmarshal(b, data)
+}
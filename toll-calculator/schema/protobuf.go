@@ -0,0 +1,117 @@
+package schema
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/types"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Field numbers of the OBUData message in types/ptypes.proto.
+const (
+	fieldOBUID protowire.Number = 1
+	fieldLat   protowire.Number = 2
+	fieldLong  protowire.Number = 3
+	fieldUnix  protowire.Number = 4
+	// since version 3
+	fieldSigAlg    protowire.Number = 5
+	fieldSignature protowire.Number = 6
+)
+
+type protobufCodec struct{}
+
+func (protobufCodec) marshal(_ Schema, data types.OBUdata) ([]byte, error) {
+	return MarshalOBUData(data), nil
+}
+
+func (protobufCodec) unmarshal(b []byte, data *types.OBUdata) error {
+	return UnmarshalOBUData(b, data)
+}
+
+// MarshalOBUData encodes data as an OBUData message of types/ptypes.proto.
+func MarshalOBUData(data types.OBUdata) []byte {
+	var b []byte
+	if data.OBUID != 0 {
+		b = protowire.AppendTag(b, fieldOBUID, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(data.OBUID))
+	}
+	if data.Lat != 0 {
+		b = protowire.AppendTag(b, fieldLat, protowire.Fixed64Type)
+		b = protowire.AppendFixed64(b, math.Float64bits(data.Lat))
+	}
+	if data.Long != 0 {
+		b = protowire.AppendTag(b, fieldLong, protowire.Fixed64Type)
+		b = protowire.AppendFixed64(b, math.Float64bits(data.Long))
+	}
+	if data.Unix != 0 {
+		b = protowire.AppendTag(b, fieldUnix, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(data.Unix))
+	}
+	if data.SigAlg != "" {
+		b = protowire.AppendTag(b, fieldSigAlg, protowire.BytesType)
+		b = protowire.AppendString(b, data.SigAlg)
+	}
+	if len(data.Signature) > 0 {
+		b = protowire.AppendTag(b, fieldSignature, protowire.BytesType)
+		b = protowire.AppendBytes(b, data.Signature)
+	}
+	return b
+}
+
+func UnmarshalOBUData(b []byte, data *types.OBUdata) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		switch {
+		case num == fieldOBUID && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			data.OBUID, b = int(int64(v)), b[n:]
+		case num == fieldUnix && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			data.Unix, b = int64(v), b[n:]
+		case (num == fieldLat || num == fieldLong) && typ == protowire.Fixed64Type:
+			v, n := protowire.ConsumeFixed64(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			if num == fieldLat {
+				data.Lat = math.Float64frombits(v)
+			} else {
+				data.Long = math.Float64frombits(v)
+			}
+			b = b[n:]
+		case (num == fieldSigAlg || num == fieldSignature) && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			if num == fieldSigAlg {
+				data.SigAlg = string(v)
+			} else {
+				data.Signature = append([]byte(nil), v...)
+			}
+			b = b[n:]
+		case num >= fieldOBUID && num <= fieldSignature:
+			return fmt.Errorf("field %d has wire type %d", num, typ)
+		default:
+			// a field from a newer version
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			b = b[n:]
+		}
+	}
+	return nil
+}
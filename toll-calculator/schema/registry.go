@@ -0,0 +1,87 @@
+package schema
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+const SubjectOBUData = "obuData"
+
+type Encoding string
+
+const (
+	EncodingJSON     Encoding = "json"
+	EncodingProtobuf Encoding = "protobuf"
+)
+
+type Schema struct {
+	ID         uint32   `json:"id"`
+	Subject    string   `json:"subject"`
+	Version    int      `json:"version"`
+	Encoding   Encoding `json:"encoding"`
+	Definition string   `json:"definition,omitempty"`
+}
+
+// Registry is a local, file-based schema registry. Every schema a producer
+// can write with is listed there under a unique ID, which is what goes on
+// the wire in front of the payload.
+type Registry struct {
+	byID map[uint32]Schema
+}
+
+func LoadRegistry(path string) (*Registry, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var schemas []Schema
+	if err := json.Unmarshal(b, &schemas); err != nil {
+		return nil, fmt.Errorf("schema registry %s: %w", path, err)
+	}
+	return NewRegistry(schemas...)
+}
+
+func NewRegistry(schemas ...Schema) (*Registry, error) {
+	r := &Registry{
+		byID: make(map[uint32]Schema, len(schemas)),
+	}
+	for _, s := range schemas {
+		if _, ok := r.byID[s.ID]; ok {
+			return nil, fmt.Errorf("duplicate schema id %d", s.ID)
+		}
+		if _, ok := codecs[s.Encoding]; !ok {
+			return nil, fmt.Errorf("schema %d: unsupported encoding %q", s.ID, s.Encoding)
+		}
+		r.byID[s.ID] = s
+	}
+	return r, nil
+}
+
+func (r *Registry) Lookup(id uint32) (Schema, error) {
+	s, ok := r.byID[id]
+	if !ok {
+		return Schema{}, fmt.Errorf("unknown schema id %d", id)
+	}
+	return s, nil
+}
+
+// Latest returns the highest version of subject available in enc.
+func (r *Registry) Latest(subject string, enc Encoding) (Schema, error) {
+	var (
+		latest Schema
+		found  bool
+	)
+	for _, s := range r.byID {
+		if s.Subject != subject || s.Encoding != enc {
+			continue
+		}
+		if !found || s.Version > latest.Version {
+			latest, found = s, true
+		}
+	}
+	if !found {
+		return Schema{}, fmt.Errorf("no %s schema for subject %s", enc, subject)
+	}
+	return latest, nil
+}
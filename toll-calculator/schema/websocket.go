@@ -0,0 +1,8 @@
+package schema
+
+// Websocket subprotocols an OBU can negotiate on /ws. Without one, readings
+// are JSON text frames like before subprotocols existed.
+const (
+	SubprotocolJSON     = "obu.json.v1"
+	SubprotocolProtobuf = "obu.protobuf.v1"
+)
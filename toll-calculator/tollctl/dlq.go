@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/aggregator/client"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/types"
+)
+
+// dlqReplay is the outcome of a replay of the dead letter topic.
+type dlqReplay struct {
+	Distances int `json:"distances"`
+	Trips     int `json:"trips"`
+	// the dead letters that failed again and were passed over, with
+	// -skip-failed
+	Skipped []dlqFailure `json:"skipped,omitempty"`
+	// the dead letter the replay stopped early at, it is replayed first
+	// next time
+	StoppedAt string `json:"stoppedAt,omitempty"`
+	// why the replay stopped early
+	Error string `json:"error,omitempty"`
+}
+
+// dlqFailure is a dead letter that failed again, at its
+// topic[partition]@offset.
+type dlqFailure struct {
+	Offset string `json:"offset"`
+	Error  string `json:"error"`
+}
+
+func runDLQ(c *client.Client, out *output, args []string) error {
+	fs := flag.NewFlagSet("dlq", flag.ContinueOnError)
+	brokers := fs.String("brokers", envOr("TOLLCTL_BROKERS", "localhost"), "the kafka bootstrap servers")
+	topic := fs.String("topic", "obuDataDLQ", "the dead letter topic of the calculator")
+	group := fs.String("group", "tollctl-dlq", "the consumer group remembering what was replayed")
+	idle := fs.Duration("idle", 10*time.Second, "stop once no dead letter arrived for this long")
+	skipFailed := fs.Bool("skip-failed", false, "pass over the dead letters that fail again instead of stopping at them, unless the aggregator can't be reached")
+	action, args := positional(args)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if action != "replay" {
+		return errors.New("dlq takes replay")
+	}
+
+	consumer, err := kafka.NewConsumer(&kafka.ConfigMap{
+		"bootstrap.servers":        *brokers,
+		"group.id":                 *group,
+		"auto.offset.reset":        "earliest",
+		"enable.auto.commit":       false,
+		"enable.auto.offset.store": false,
+	})
+	if err != nil {
+		return err
+	}
+	defer consumer.Close()
+	if err := consumer.SubscribeTopics([]string{*topic}, nil); err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	res, err := replayDeadLetters(ctx, consumer, c, *idle, *skipFailed)
+	if err != nil {
+		res.Error = err.Error()
+	}
+	// only what was replayed is committed
+	if _, err := consumer.Commit(); err != nil {
+		if kerr, ok := err.(kafka.Error); !ok || kerr.Code() != kafka.ErrNoOffset {
+			return fmt.Errorf("commit: %w", err)
+		}
+	}
+	if err := out.dlqReplay(res); err != nil {
+		return err
+	}
+	if res.Error != "" {
+		return errors.New("replay stopped early")
+	}
+	return nil
+}
+
+// replayDeadLetters aggregates the dead letters in the order they were
+// produced until none arrived for idle. It stops at the first that fails
+// again, or with skipFailed passes over it, unless the aggregator couldn't
+// be reached: the letters after it would all fail.
+func replayDeadLetters(ctx context.Context, consumer *kafka.Consumer, c *client.Client, idle time.Duration, skipFailed bool) (*dlqReplay, error) {
+	res := &dlqReplay{}
+	last := time.Now()
+	for ctx.Err() == nil && time.Since(last) < idle {
+		msg, err := consumer.ReadMessage(time.Second)
+		if err != nil {
+			if kerr, ok := err.(kafka.Error); ok && kerr.IsTimeout() {
+				continue
+			}
+			return res, err
+		}
+		last = time.Now()
+
+		err = replayDeadLetter(msg, c, res)
+		var unreachable *url.Error
+		switch {
+		case err == nil:
+		case skipFailed && !errors.As(err, &unreachable):
+			res.Skipped = append(res.Skipped, dlqFailure{Offset: msg.TopicPartition.String(), Error: err.Error()})
+		default:
+			res.StoppedAt = msg.TopicPartition.String()
+			return res, err
+		}
+		if _, err := consumer.StoreMessage(msg); err != nil {
+			return res, err
+		}
+	}
+	return res, nil
+}
+
+// replayDeadLetter aggregates the dead letter in msg and counts it in res.
+func replayDeadLetter(msg *kafka.Message, c *client.Client, res *dlqReplay) error {
+	var letter types.DeadLetter
+	if err := json.Unmarshal(msg.Value, &letter); err != nil {
+		return err
+	}
+	switch {
+	case letter.Distance != nil:
+		if err := c.AggregateInvoice(*letter.Distance); err != nil {
+			return err
+		}
+		res.Distances++
+	case letter.Trip != nil:
+		if err := c.AggregateTrip(*letter.Trip); err != nil {
+			return err
+		}
+		res.Trips++
+	}
+	return nil
+}
@@ -0,0 +1,307 @@
+// tollctl is the command-line client operators use to query and operate
+// an aggregator node.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/aggregator/client"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/types"
+)
+
+type command struct {
+	args  string
+	usage string
+	run   func(c *client.Client, out *output, args []string) error
+}
+
+var commands = map[string]command{
+	"invoice":  {"-obu ID [-from TIME] [-to TIME]", "the running invoice of an OBU", runInvoice},
+	"invoices": {"-obu ID | NUMBER...", "invoice documents of an OBU, or by number", runInvoices},
+	"obus":     {"[-sort obu|distance|amount|trips]", "every OBU with its totals", runOBUs},
+	"top":      {"distance|amount", "the OBUs that drove the most", runTop},
+	"totals":   {"day|week|zone", "fleet totals per group", runTotals},
+	"active":   {"", "how many OBUs drove", runActive},
+	"tail":     {"[-obu ID,...] [-account ID]", "follow live distance and invoice updates", runTail},
+	"bill":     {"", "run billing right away", runBill},
+	"dlq":      {"replay [-brokers LIST] [-skip-failed]", "aggregate what the calculator failed to", runDLQ},
+}
+
+func main() {
+	fs := flag.NewFlagSet("tollctl", flag.ContinueOnError)
+	endpoint := fs.String("aggregator", envOr("TOLLCTL_AGGREGATOR", "http://localhost:3000"), "the aggregator node to talk to")
+	format := fs.String("o", "table", "the output format, table or json")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: tollctl [-aggregator URL] [-o table|json] COMMAND [flags]")
+		names := make([]string, 0, len(commands))
+		for name := range commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			cmd := commands[name]
+			fmt.Fprintf(fs.Output(), "  %-9s %-34s %s\n", name, cmd.args, cmd.usage)
+		}
+		fmt.Fprintln(fs.Output(), "the analytics commands also take -from, -to, -offset and -limit")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(os.Args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return
+		}
+		os.Exit(2)
+	}
+	if *format != "table" && *format != "json" {
+		fatal(fmt.Errorf("unknown output format %q", *format))
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[fs.Arg(0)]
+	if !ok {
+		fatal(fmt.Errorf("unknown command %q", fs.Arg(0)))
+	}
+
+	out := &output{w: os.Stdout, json: *format == "json"}
+	err := cmd.run(client.NewClient(strings.TrimRight(*endpoint, "/")), out, fs.Args()[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fatal(err)
+	}
+}
+
+func runInvoice(c *client.Client, out *output, args []string) error {
+	fs := flag.NewFlagSet("invoice", flag.ContinueOnError)
+	obuID := fs.Int("obu", 0, "the OBU ID")
+	var from, to timeFlag
+	fs.Var(&from, "from", "start of the period, RFC3339 or a date")
+	fs.Var(&to, "to", "end of the period, RFC3339 or a date")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *obuID == 0 {
+		return errors.New("-obu is required")
+	}
+
+	var (
+		inv *types.Invoice
+		err error
+	)
+	if from.IsZero() && to.IsZero() {
+		inv, err = c.GetInvoice(*obuID)
+	} else {
+		inv, err = c.GetPeriodInvoice(*obuID, from.Time, to.Time)
+	}
+	if err != nil {
+		return err
+	}
+	return out.invoice(inv)
+}
+
+func runInvoices(c *client.Client, out *output, args []string) error {
+	fs := flag.NewFlagSet("invoices", flag.ContinueOnError)
+	obuID := fs.Int("obu", 0, "list the invoices of this OBU")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var docs []types.InvoiceDocument
+	switch {
+	case *obuID != 0:
+		list, err := c.ListInvoices(*obuID)
+		if err != nil {
+			return err
+		}
+		docs = list
+	case fs.NArg() > 0:
+		for _, number := range fs.Args() {
+			doc, err := c.Invoice(number)
+			if err != nil {
+				return fmt.Errorf("%s: %w", number, err)
+			}
+			docs = append(docs, *doc)
+		}
+	default:
+		return errors.New("either -obu or invoice numbers are required")
+	}
+	return out.invoiceDocuments(docs)
+}
+
+func runOBUs(c *client.Client, out *output, args []string) error {
+	fs := flag.NewFlagSet("obus", flag.ContinueOnError)
+	q := queryFlags(fs)
+	fs.StringVar(&q.sortBy, "sort", "", "obu, distance, amount or trips")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	page, err := c.OBUTotals(q.query())
+	if err != nil {
+		return err
+	}
+	return out.obuTotals(page)
+}
+
+func runTop(c *client.Client, out *output, args []string) error {
+	fs := flag.NewFlagSet("top", flag.ContinueOnError)
+	q := queryFlags(fs)
+	by, args := positional(args)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if by == "" {
+		return errors.New("top takes distance or amount")
+	}
+	page, err := c.TopOBUs(by, q.query())
+	if err != nil {
+		return err
+	}
+	return out.obuTotals(page)
+}
+
+func runTotals(c *client.Client, out *output, args []string) error {
+	fs := flag.NewFlagSet("totals", flag.ContinueOnError)
+	q := queryFlags(fs)
+	group, args := positional(args)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if group == "" {
+		return errors.New("totals takes day, week or zone")
+	}
+	page, err := c.GroupTotals(group, q.query())
+	if err != nil {
+		return err
+	}
+	return out.groupTotals(page)
+}
+
+func runActive(c *client.Client, out *output, args []string) error {
+	fs := flag.NewFlagSet("active", flag.ContinueOnError)
+	q := queryFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	active, err := c.ActiveVehicles(q.query())
+	if err != nil {
+		return err
+	}
+	return out.activeVehicles(active)
+}
+
+func runTail(c *client.Client, out *output, args []string) error {
+	fs := flag.NewFlagSet("tail", flag.ContinueOnError)
+	obus := fs.String("obu", "", "comma separated OBU IDs to follow")
+	account := fs.String("account", "", "the account to follow")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	var ids []int
+	if *obus != "" {
+		for _, s := range strings.Split(*obus, ",") {
+			id, err := strconv.Atoi(strings.TrimSpace(s))
+			if err != nil {
+				return fmt.Errorf("invalid OBU ID %q", s)
+			}
+			ids = append(ids, id)
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	out.updateHeader()
+	return c.Stream(ctx, ids, *account, out.update)
+}
+
+func runBill(c *client.Client, out *output, args []string) error {
+	fs := flag.NewFlagSet("bill", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	run, err := c.RunBilling()
+	if err != nil {
+		return err
+	}
+	return out.billingRun(run)
+}
+
+// positional splits off the argument commands like top take before their
+// flags.
+func positional(args []string) (string, []string) {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return "", args
+	}
+	return args[0], args[1:]
+}
+
+// rangeFlags are the flags every analytics command takes.
+type rangeFlags struct {
+	from, to      timeFlag
+	offset, limit int
+	sortBy        string
+}
+
+func queryFlags(fs *flag.FlagSet) *rangeFlags {
+	f := &rangeFlags{}
+	fs.Var(&f.from, "from", "start of the period, RFC3339 or a date")
+	fs.Var(&f.to, "to", "end of the period, RFC3339 or a date")
+	fs.IntVar(&f.offset, "offset", 0, "how many items to skip")
+	fs.IntVar(&f.limit, "limit", 0, "how many items to list, the aggregator's default if 0")
+	return f
+}
+
+func (f *rangeFlags) query() client.Query {
+	return client.Query{
+		From:   f.from.Time,
+		To:     f.to.Time,
+		Sort:   f.sortBy,
+		Offset: f.offset,
+		Limit:  f.limit,
+	}
+}
+
+// timeFlag takes RFC3339 times and plain dates, which are midnight UTC.
+type timeFlag struct {
+	time.Time
+}
+
+func (t *timeFlag) Set(s string) error {
+	for _, layout := range []string{time.RFC3339, time.DateOnly} {
+		if v, err := time.Parse(layout, s); err == nil {
+			t.Time = v
+			return nil
+		}
+	}
+	return fmt.Errorf("%q is neither RFC3339 nor a date", s)
+}
+
+func (t *timeFlag) String() string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+func envOr(key, def string) string {
+	if v, ok := os.LookupEnv(key); ok {
+		return v
+	}
+	return def
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "tollctl:", err)
+	os.Exit(1)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/types"
+)
+
+// output prints results as aligned tables for people, or as JSON for
+// scripts. Streams are printed as one JSON document per line.
+type output struct {
+	w    io.Writer
+	json bool
+}
+
+func (o *output) encode(v any) error {
+	enc := json.NewEncoder(o.w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// table calls fn with a tabwriter whose columns are the tab separated
+// header.
+func (o *output) table(header string, fn func(w io.Writer)) error {
+	tw := tabwriter.NewWriter(o.w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, header)
+	fn(tw)
+	return tw.Flush()
+}
+
+func (o *output) invoice(inv *types.Invoice) error {
+	if o.json {
+		return o.encode(inv)
+	}
+	err := o.table("OBU\tACCOUNT\tPLATE\tCLASS\tUNIT PRICE\tDISTANCE\tNET\tTAX\tGROSS\tCURRENCY", func(w io.Writer) {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", inv.OBUID, inv.AccountID, inv.Plate, inv.VehicleClass, inv.UnitPrice,
+			inv.TotalDistance, inv.TotalAmount, inv.TotalTax, inv.TotalGross, inv.Currency)
+	})
+	if err != nil {
+		return err
+	}
+	if len(inv.Trips) > 0 {
+		fmt.Fprintln(o.w)
+		err = o.table("TRIP START\tEND\tDISTANCE\tAMOUNT", func(w io.Writer) {
+			for _, t := range inv.Trips {
+				fmt.Fprintf(w, "%s\t%s\t%.3f\t%s\n", formatUnix(t.StartUnix), formatUnix(t.EndUnix), t.Distance, t.Amount)
+			}
+		})
+	}
+	if err != nil || len(inv.Discounts) == 0 {
+		return err
+	}
+	fmt.Fprintln(o.w)
+	return o.table("DISCOUNT\tKIND\tAMOUNT", func(w io.Writer) {
+		for _, d := range inv.Discounts {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", d.Name, d.Kind, d.Amount)
+		}
+	})
+}
+
+func (o *output) invoiceDocuments(docs []types.InvoiceDocument) error {
+	if o.json {
+		return o.encode(docs)
+	}
+	return o.table("NUMBER\tSTATUS\tOBU\tACCOUNT\tPERIOD\tADJUSTS\tDISTANCE\tNET\tTAX\tGROSS\tCURRENCY\tDUE", func(w io.Writer) {
+		for _, d := range docs {
+			due := "-"
+			if d.DueAt != nil {
+				due = d.DueAt.Format(time.DateOnly)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s..%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", d.Number, d.Status, d.OBUID, d.AccountID,
+				d.PeriodStart.Format(time.DateOnly), d.PeriodEnd.Format(time.DateOnly), d.Adjusts,
+				d.TotalDistance, d.TotalAmount, d.TotalTax, d.TotalGross, d.Currency, due)
+		}
+	})
+}
+
+func (o *output) obuTotals(page *types.Page[types.OBUTotal]) error {
+	if o.json {
+		return o.encode(page)
+	}
+	err := o.table("OBU\tACCOUNT\tPLATE\tCLASS\tDISTANCE\tAMOUNT\tTAX\tTRIPS\tERROR", func(w io.Writer) {
+		for _, t := range page.Items {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%d\t%s\n", t.OBUID, t.AccountID, t.Plate, t.VehicleClass, t.Distance, t.Amount, t.Tax, t.Trips, t.Error)
+		}
+	})
+	o.pageFooter(page.Offset, len(page.Items), page.Total)
+	return err
+}
+
+func (o *output) groupTotals(page *types.Page[types.GroupTotal]) error {
+	if o.json {
+		return o.encode(page)
+	}
+	err := o.table("GROUP\tDISTANCE\tAMOUNT\tTAX\tTRIPS\tACTIVE\tUNPRICED", func(w io.Writer) {
+		for _, g := range page.Items {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%d\t%d\n", g.Group, g.Distance, g.Amount, g.Tax, g.Trips, g.Active, g.Unpriced)
+		}
+	})
+	o.pageFooter(page.Offset, len(page.Items), page.Total)
+	return err
+}
+
+func (o *output) pageFooter(offset, n, total int) {
+	if n < total {
+		fmt.Fprintf(o.w, "\n%d-%d of %d\n", offset+1, offset+n, total)
+	}
+}
+
+func (o *output) activeVehicles(a *types.ActiveVehicles) error {
+	if o.json {
+		return o.encode(a)
+	}
+	return o.table("FROM\tTO\tACTIVE\tKNOWN", func(w io.Writer) {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\n", a.From.Format(time.RFC3339), a.To.Format(time.RFC3339), a.Active, a.Known)
+	})
+}
+
+func (o *output) billingRun(run *types.BillingRun) error {
+	if o.json {
+		return o.encode(run)
+	}
+	return o.table("AT\tPERIODS\tISSUED\tFAILED", func(w io.Writer) {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\n", run.At.Format(time.RFC3339), run.Periods, len(run.Invoices), run.Failed)
+	})
+}
+
+func (o *output) dlqReplay(res *dlqReplay) error {
+	if o.json {
+		return o.encode(res)
+	}
+	err := o.table("DISTANCES\tTRIPS\tSKIPPED\tSTOPPED AT\tERROR", func(w io.Writer) {
+		fmt.Fprintf(w, "%d\t%d\t%d\t%s\t%s\n", res.Distances, res.Trips, len(res.Skipped), res.StoppedAt, res.Error)
+	})
+	if err != nil || len(res.Skipped) == 0 {
+		return err
+	}
+	fmt.Fprintln(o.w)
+	return o.table("SKIPPED\tERROR", func(w io.Writer) {
+		for _, f := range res.Skipped {
+			fmt.Fprintf(w, "%s\t%s\n", f.Offset, f.Error)
+		}
+	})
+}
+
+// the columns of tailed updates, fixed width as rows come one at a time
+const updateRow = "%-30s  %-10s  %10s  %12s  %12s  %s\n"
+
+func (o *output) updateHeader() {
+	if !o.json {
+		fmt.Fprintf(o.w, updateRow, "AT", "OBU", "DISTANCE", "TOTAL", "AMOUNT", "DROPPED")
+	}
+}
+
+func (o *output) update(u types.InvoiceUpdate) error {
+	if o.json {
+		return json.NewEncoder(o.w).Encode(u)
+	}
+	total, amount, dropped := "-", "-", ""
+	if u.Invoice != nil {
+		total = u.Invoice.TotalDistance.String()
+		amount = u.Invoice.TotalAmount.String()
+	}
+	if u.Dropped > 0 {
+		dropped = fmt.Sprint(u.Dropped)
+	}
+	_, err := fmt.Fprintf(o.w, updateRow, formatUnix(u.Distance.Unix), fmt.Sprint(u.Distance.OBUID),
+		fmt.Sprintf("%.4f", u.Distance.Value), total, amount, dropped)
+	return err
+}
+
+func formatUnix(nanos int64) string {
+	return time.Unix(0, nanos).UTC().Format(time.RFC3339Nano)
+}
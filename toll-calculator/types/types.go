@@ -1,12 +1,209 @@
 package types
 
+import (
+	"time"
+
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/geo"
+	"github.com/tunangoo/full-time-go-dev/toll-calculator/money"
+)
+
 type Invoice struct {
-	OBUID         int     `json:"obuID"`
-	TotalDistance float64 `json:"totalDistance"`
-	TotalAmount   float64 `json:"totalAmount"`
+	OBUID        int          `json:"obuID"`
+	AccountID    string       `json:"accountID,omitempty"`
+	Plate        string       `json:"plate,omitempty"`
+	VehicleClass VehicleClass `json:"vehicleClass,omitempty"`
+	// set when the invoice only covers [PeriodStart, PeriodEnd)
+	PeriodStart *time.Time `json:"periodStart,omitempty"`
+	PeriodEnd   *time.Time `json:"periodEnd,omitempty"`
+	// ISO 3166, the country of the account, which may tax the invoice
+	Country string `json:"country,omitempty"`
+	// ISO 4217, the currency of every amount on the invoice
+	Currency string `json:"currency"`
+	// set when the account is billed in another currency than the tariff's,
+	// UnitPrice is converted already
+	ExchangeRate *ExchangeRate `json:"exchangeRate,omitempty"`
+	UnitPrice    money.Price   `json:"unitPrice"`
+	// the sums of the trips and the road usage outside of them, see the
+	// money package for how they are rounded. TotalAmount is after the
+	// discounts and before tax.
+	TotalDistance geo.Distance      `json:"totalDistance"`
+	TotalAmount   money.Amount      `json:"totalAmount"`
+	Discounts     []InvoiceDiscount `json:"discounts,omitempty"`
+	Taxes         []InvoiceTax      `json:"taxes,omitempty"`
+	TotalTax      money.Amount      `json:"totalTax"`
+	TotalGross    money.Amount      `json:"totalGross"`
+	Trips         []InvoiceTrip     `json:"trips,omitempty"`
+}
+
+// InvoiceTrip is a single trip listed as a line item on an invoice.
+type InvoiceTrip struct {
+	Trip
+	Amount money.Amount `json:"amount"`
+}
+
+type PricingRuleKind string
+
+const (
+	// exempts the vehicle from paying at all
+	PricingExempt PricingRuleKind = "exempt"
+	// takes Rate off the charge
+	PricingDiscount PricingRuleKind = "discount"
+	// limits the charge of a calendar month to Cap
+	PricingCap PricingRuleKind = "cap"
+)
+
+// PricingRule lowers the charge of the invoices of vehicles of Classes, or
+// of every vehicle if there are none. A rule only applies once the period
+// of the invoice has MinTrips trips and MinDistance.
+type PricingRule struct {
+	Name        string          `json:"name"`
+	Kind        PricingRuleKind `json:"kind"`
+	Classes     []VehicleClass  `json:"classes,omitempty"`
+	MinTrips    int             `json:"minTrips,omitempty"`
+	MinDistance geo.Distance    `json:"minDistance,omitempty"`
+	Rate        money.Rate      `json:"rate,omitempty"`
+	// in the currency of the tariff
+	Cap money.Amount `json:"cap,omitempty"`
+}
+
+// InvoiceDiscount is what a pricing rule took off an invoice, Amount is
+// negative.
+type InvoiceDiscount struct {
+	PricingRule
+	Amount money.Amount `json:"amount"`
+}
+
+// TaxRule taxes the road usage in a jurisdiction: every line invoiced to
+// accounts of Country, or the trips starting in Zone.
+type TaxRule struct {
+	Name    string     `json:"name"`
+	Country string     `json:"country,omitempty"`
+	Zone    string     `json:"zone,omitempty"`
+	Rate    money.Rate `json:"rate"`
+}
+
+// InvoiceTax is a tax rule applied to the lines of an invoice it covers,
+// Base is their sum.
+type InvoiceTax struct {
+	TaxRule
+	Base   money.Amount `json:"base"`
+	Amount money.Amount `json:"amount"`
+}
+
+// ExchangeRate converts amounts in From to To, a unit of From is Rate
+// units of To.
+type ExchangeRate struct {
+	From string     `json:"from"`
+	To   string     `json:"to"`
+	Rate money.Rate `json:"rate"`
+}
+
+type InvoiceStatus string
+
+const (
+	InvoiceStatusDraft  InvoiceStatus = "draft"
+	InvoiceStatusIssued InvoiceStatus = "issued"
+	InvoiceStatusPaid   InvoiceStatus = "paid"
+	InvoiceStatusVoid   InvoiceStatus = "void"
+)
+
+type InvoiceLine struct {
+	Description string       `json:"description"`
+	Distance    geo.Distance `json:"distance"`
+	UnitPrice   money.Price  `json:"unitPrice"`
+	Amount      money.Amount `json:"amount"`
+	Trip        *Trip        `json:"trip,omitempty"`
+	// set on discount and tax lines, they have no distance or unit price
+	Discount *InvoiceDiscount `json:"discount,omitempty"`
+	Tax      *InvoiceTax      `json:"tax,omitempty"`
 }
 
+// InvoiceDocument is an invoice as it was issued to the customer. Its lines
+// and totals never change after it was created, only its status moves on.
+type InvoiceDocument struct {
+	Number string        `json:"number"`
+	Status InvoiceStatus `json:"status"`
+	// set on adjustments, the number of the invoice whose period they
+	// bill distance for that arrived after it was invoiced
+	Adjusts       string        `json:"adjusts,omitempty"`
+	OBUID         int           `json:"obuID"`
+	AccountID     string        `json:"accountID,omitempty"`
+	Plate         string        `json:"plate,omitempty"`
+	VehicleClass  VehicleClass  `json:"vehicleClass,omitempty"`
+	PeriodStart   time.Time     `json:"periodStart"`
+	PeriodEnd     time.Time     `json:"periodEnd"`
+	CreatedAt     time.Time     `json:"createdAt"`
+	IssuedAt      *time.Time    `json:"issuedAt,omitempty"`
+	DueAt         *time.Time    `json:"dueAt,omitempty"`
+	PaidAt        *time.Time    `json:"paidAt,omitempty"`
+	VoidedAt      *time.Time    `json:"voidedAt,omitempty"`
+	Currency      string        `json:"currency"`
+	ExchangeRate  *ExchangeRate `json:"exchangeRate,omitempty"`
+	Lines         []InvoiceLine `json:"lines"`
+	TotalDistance geo.Distance  `json:"totalDistance"`
+	// after discounts and before tax, the sum of the lines that aren't tax
+	// lines
+	TotalAmount money.Amount `json:"totalAmount"`
+	TotalTax    money.Amount `json:"totalTax"`
+	// what the customer pays
+	TotalGross money.Amount `json:"totalGross"`
+}
+
+// BillingRun is what one run of the billing scheduler did.
+type BillingRun struct {
+	At       time.Time `json:"at"`
+	Periods  int       `json:"periods"`
+	Invoices []string  `json:"invoices"`
+	Failed   int       `json:"failed"`
+}
+
+type LedgerEntryKind string
+
+const (
+	LedgerEntryTopUp    LedgerEntryKind = "topup"
+	LedgerEntryCharge   LedgerEntryKind = "charge"
+	LedgerEntryPayment  LedgerEntryKind = "payment"
+	LedgerEntryReversal LedgerEntryKind = "reversal"
+)
+
+// LedgerEntry is never changed once it was posted, a wrong entry is undone
+// by posting a reversal of it.
+type LedgerEntry struct {
+	ID        int             `json:"id"`
+	AccountID string          `json:"accountID"`
+	Kind      LedgerEntryKind `json:"kind"`
+	// what the entry did to the balance, charges are negative
+	Amount    money.Amount `json:"amount"`
+	Invoice   string       `json:"invoice,omitempty"`
+	Reverses  int          `json:"reverses,omitempty"`
+	Reference string       `json:"reference,omitempty"`
+	At        time.Time    `json:"at"`
+	// the balance of the account after the entry
+	Balance money.Amount `json:"balance"`
+}
+
+// LedgerAccount is how an account pays. Accounts the ledger has no
+// settings for pay after invoicing.
+type LedgerAccount struct {
+	ID string `json:"id"`
+	// prepaid accounts pay their invoices from their balance right away, as
+	// long as it covers them
+	Prepaid bool `json:"prepaid"`
+	// a prepaid account whose balance drops below LowBalance gets notified,
+	// zero turns notifications off
+	LowBalance money.Amount `json:"lowBalance,omitempty"`
+}
+
+type AccountBalance struct {
+	LedgerAccount
+	Balance money.Amount `json:"balance"`
+	// the amount of issued invoices that isn't paid yet
+	Outstanding money.Amount `json:"outstanding"`
+}
+
+// Distance is what an OBU drove between two readings.
 type Distance struct {
+	// in kilometres
 	Value float64 `json:"value"`
 	OBUID int     `json:"obuID"`
 	Unix  int64   `json:"unix"`
@@ -16,4 +213,225 @@ type OBUdata struct {
 	OBUID int     `json:"obuID"`
 	Lat   float64 `json:"lat"`
 	Long  float64 `json:"long"`
+	Unix  int64   `json:"unix"`
+	// optional, see the device package for what is signed and how
+	SigAlg    string `json:"sigAlg,omitempty"`
+	Signature []byte `json:"sig,omitempty"`
+}
+
+// Trip is one journey of an OBU, from the moment it started moving
+// until it stopped or went silent.
+type Trip struct {
+	OBUID     int     `json:"obuID"`
+	StartUnix int64   `json:"startUnix"`
+	EndUnix   int64   `json:"endUnix"`
+	StartLat  float64 `json:"startLat"`
+	StartLong float64 `json:"startLong"`
+	EndLat    float64 `json:"endLat"`
+	EndLong   float64 `json:"endLong"`
+	// in kilometres
+	Distance float64 `json:"distance"`
+}
+
+// DeadLetter is distance or a trip the calculator failed to aggregate,
+// kept in the dead letter topic until it is replayed. One of Distance and
+// Trip is set.
+type DeadLetter struct {
+	Distance *Distance `json:"distance,omitempty"`
+	Trip     *Trip     `json:"trip,omitempty"`
+	Error    string    `json:"error"`
+	FailedAt time.Time `json:"failedAt"`
+}
+
+// InvoiceUpdate is pushed to live subscribers every time distance of an
+// OBU was aggregated, with the running invoice of the OBU without its
+// trips.
+type InvoiceUpdate struct {
+	Distance Distance `json:"distance"`
+	Invoice  *Invoice `json:"invoice,omitempty"`
+	// how many updates the subscriber missed since the previous one,
+	// because it didn't keep up
+	Dropped int `json:"dropped,omitempty"`
+}
+
+// OBUTotal is what an OBU drove in a period and what it costs.
+type OBUTotal struct {
+	OBUID        int          `json:"obuID"`
+	AccountID    string       `json:"accountID,omitempty"`
+	Plate        string       `json:"plate,omitempty"`
+	VehicleClass VehicleClass `json:"vehicleClass,omitempty"`
+	Distance     geo.Distance `json:"distance"`
+	// after discounts, before Tax
+	Amount money.Amount `json:"amount"`
+	Tax    money.Amount `json:"tax"`
+	Trips  int          `json:"trips"`
+	// why the OBU couldn't be priced, its amount is left out of all totals
+	Error string `json:"error,omitempty"`
+}
+
+// DayTotal is what one OBU drove on one UTC day.
+type DayTotal struct {
+	Day      time.Time `json:"day"`
+	OBUID    int       `json:"obuID"`
+	Distance float64   `json:"distance"`
+}
+
+// GroupTotal sums the OBUs of a group of the fleet: a day, a week or a
+// zone. Active counts the OBUs that drove in the group.
+type GroupTotal struct {
+	Group    string       `json:"group"`
+	From     *time.Time   `json:"from,omitempty"`
+	To       *time.Time   `json:"to,omitempty"`
+	Distance geo.Distance `json:"distance"`
+	// after discounts, before Tax
+	Amount money.Amount `json:"amount"`
+	Tax    money.Amount `json:"tax"`
+	Trips  int          `json:"trips"`
+	Active int          `json:"active"`
+	// how many of the active OBUs couldn't be priced, their distance and
+	// trips count but not their amount
+	Unpriced int `json:"unpriced,omitempty"`
+}
+
+// ActiveVehicles counts the OBUs that drove in [From, To) out of all OBUs
+// the aggregator knows.
+type ActiveVehicles struct {
+	From   time.Time `json:"from"`
+	To     time.Time `json:"to"`
+	Active int       `json:"active"`
+	Known  int       `json:"known"`
+}
+
+// Page is one page of a listing, Total is the length of the whole listing.
+type Page[T any] struct {
+	Items  []T `json:"items"`
+	Total  int `json:"total"`
+	Offset int `json:"offset"`
+	Limit  int `json:"limit"`
+}
+
+// OBUState is everything an aggregator holds for one OBU, used to hand
+// ownership of the OBU over to another aggregator node.
+type OBUState struct {
+	// unique per hand over, a node merges a transfer at most once so a
+	// transfer that may have failed can be sent again
+	TransferID string  `json:"transferID,omitempty"`
+	OBUID      int     `json:"obuID"`
+	Distance   float64 `json:"distance"`
+	// distance per UTC day, keyed by the unix seconds the day starts at
+	Days  map[int64]float64 `json:"days,omitempty"`
+	Trips []Trip            `json:"trips"`
+}
+
+// Batch is a set of readings an OBU buffered while it was offline.
+type Batch struct {
+	BatchID  string    `json:"batchID"`
+	OBUID    int       `json:"obuID"`
+	Readings []OBUdata `json:"readings"`
+}
+
+type BatchRejection struct {
+	Index  int    `json:"index"`
+	Reason string `json:"reason"`
+}
+
+// BatchReceipt tells the OBU which part of a batch kafka delivered.
+// Readings are handled in the order they were taken, Handled counts the
+// ones that were either delivered or rejected, a retry of a batch that failed
+// part way resumes after them.
+type BatchReceipt struct {
+	BatchID   string           `json:"batchID"`
+	OBUID     int              `json:"obuID"`
+	Handled   int              `json:"handled"`
+	Accepted  int              `json:"accepted"`
+	Rejected  []BatchRejection `json:"rejected,omitempty"`
+	Duplicate bool             `json:"duplicate,omitempty"`
+	Error     string           `json:"error,omitempty"`
+}
+
+type VehicleClass string
+
+const (
+	VehicleClassMotorcycle VehicleClass = "motorcycle"
+	VehicleClassCar        VehicleClass = "car"
+	VehicleClassBus        VehicleClass = "bus"
+	VehicleClassTruck      VehicleClass = "truck"
+	VehicleClassEmergency  VehicleClass = "emergency"
+)
+
+type Account struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// ISO 3166 alpha-2, where the account is taxed
+	Country string `json:"country,omitempty"`
+	// ISO 4217, the currency the account is billed in, empty is the
+	// currency of the tariff
+	Currency string `json:"currency,omitempty"`
+}
+
+type Vehicle struct {
+	ID        string       `json:"id"`
+	Plate     string       `json:"plate"`
+	Class     VehicleClass `json:"class"`
+	AccountID string       `json:"accountID"`
+}
+
+// OBURegistration installs an OBU in a vehicle from ActiveFrom until
+// ActiveTo, a nil ActiveTo means it is still installed.
+type OBURegistration struct {
+	OBUID      int        `json:"obuID"`
+	VehicleID  string     `json:"vehicleID"`
+	ActiveFrom time.Time  `json:"activeFrom"`
+	ActiveTo   *time.Time `json:"activeTo,omitempty"`
+}
+
+func (r OBURegistration) ActiveAt(t time.Time) bool {
+	return !t.Before(r.ActiveFrom) && (r.ActiveTo == nil || t.Before(*r.ActiveTo))
+}
+
+// OBURecord is who an OBU belongs to at a point in time.
+type OBURecord struct {
+	Registration OBURegistration `json:"registration"`
+	Vehicle      Vehicle         `json:"vehicle"`
+	Account      Account         `json:"account"`
+}
+
+type AlertKind string
+
+const (
+	// the OBU stopped reporting
+	AlertSilent AlertKind = "silent"
+	// the OBU moved faster than a vehicle can
+	AlertTeleport AlertKind = "teleport"
+	// the OBU keeps reporting the exact same position
+	AlertStuck AlertKind = "stuck"
+)
+
+type AlertState string
+
+const (
+	AlertFiring   AlertState = "firing"
+	AlertResolved AlertState = "resolved"
+)
+
+// Alert is raised by the monitor when an OBU misbehaves. An OBU has at
+// most one firing alert of a kind.
+type Alert struct {
+	ID         string     `json:"id"`
+	OBUID      int        `json:"obuID"`
+	Kind       AlertKind  `json:"kind"`
+	State      AlertState `json:"state"`
+	Message    string     `json:"message"`
+	FiredAt    time.Time  `json:"firedAt"`
+	ResolvedAt *time.Time `json:"resolvedAt,omitempty"`
+}
+
+// OBUStatus is what the monitor last heard of an OBU.
+type OBUStatus struct {
+	OBUID    int       `json:"obuID"`
+	LastSeen time.Time `json:"lastSeen"`
+	Lat      float64   `json:"lat"`
+	Long     float64   `json:"long"`
+	// the time of the last reading, as reported by the OBU
+	ReadingAt time.Time `json:"readingAt"`
 }